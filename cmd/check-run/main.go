@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/google/go-github/v32/github"
@@ -17,8 +18,67 @@ import (
 	"github.com/brigadecore/brigade-github-app/pkg/webhook"
 )
 
+// exitCode is the status check-run exits with, so that builds can tell why
+// it failed.
+type exitCode int
+
+const (
+	// exitFailure is used for errors that don't fit any other code.
+	exitFailure exitCode = 1
+	// exitData is used when the repository, commit or branch can't be found in
+	// the payload.
+	exitData exitCode = 2
+	// exitAuth is used when no GitHub client can be created from the token.
+	exitAuth exitCode = 3
+	// exitPayload is used when CHECK_PAYLOAD or CHECK_PAYLOAD_FILE can't be
+	// read or parsed.
+	exitPayload exitCode = 4
+	// exitValidation is used when any other variable is invalid.
+	exitValidation exitCode = 5
+	// exitAPI is used when GitHub refuses to create the check run.
+	exitAPI exitCode = 6
+)
+
+// exitError is an error that check-run exits with a specific code for.
+type exitError struct {
+	code exitCode
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// exitErrorf formats an error that makes check-run exit with code.
+func exitErrorf(code exitCode, format string, args ...interface{}) error {
+	return &exitError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// exitCodeOf returns the code check-run exits with after err.
+func exitCodeOf(err error) exitCode {
+	if err == nil {
+		return 0
+	}
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return exitFailure
+}
+
 func main() {
-	payload := os.Getenv("CHECK_PAYLOAD")
+	if err := runCheck(); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(int(exitCodeOf(err)))
+	}
+}
+
+// runCheck creates the check run described by the environment and prints it.
+func runCheck() error {
 	name := envOr("CHECK_NAME", "Brigade")
 	title := envOr("CHECK_TITLE", "Running Check")
 	summary := envOr("CHECK_SUMMARY", "")
@@ -26,51 +86,89 @@ func main() {
 	conclusion := envOr("CHECK_CONCLUSION", "")
 	detailsURL := envOr("CHECK_DETAILS_URL", "")
 	externalID := envOr("CHECK_EXTERNAL_ID", "")
-	startedAt := envOr("CHECK_STARTED_AT", time.Now().Format(check.RFC8601))
+	buildID := envOr("CHECK_BUILD_ID", "")
+	now := time.Now()
+	startedAt, err := envTime("CHECK_STARTED_AT", now)
+	if err != nil {
+		return &exitError{code: exitValidation, err: err}
+	}
+	completedAt, err := envTime("CHECK_COMPLETED_AT", now)
+	if err != nil {
+		return &exitError{code: exitValidation, err: err}
+	}
 
 	// Support for GH Enterprise.
 	ghBaseURL := envOr("GITHUB_BASE_URL", "")
 	ghUploadURL := envOr("GITHUB_UPLOAD_URL", ghBaseURL)
+	check.MediaType = envOr("GITHUB_CHECKS_MEDIA_TYPE", check.MediaType)
+	var clientOpts []ghlib.ClientOption
+	if caFile := envOr("GITHUB_CA_FILE", ""); caFile != "" {
+		pool, err := ghlib.LoadCAFile(caFile)
+		if err != nil {
+			return exitErrorf(exitValidation, "could not load CA certificates: %s", err)
+		}
+		clientOpts = append(clientOpts, ghlib.WithRootCAs(pool))
+	}
 
 	var actions []check.Action
 	actionsJSON := envOr("CHECK_ACTIONS", "")
 	if actionsJSON != "" {
 		if err := json.Unmarshal([]byte(actionsJSON), &actions); err != nil {
-			fmt.Printf("Error: could not parse actions: %s\n", err)
-			os.Exit(1)
+			return exitErrorf(exitValidation, "could not parse actions: %s", err)
 		}
 	}
 
-	data := &webhook.Payload{}
-	if err := json.Unmarshal([]byte(payload), data); err != nil {
-		fmt.Printf("Error: could not parse payload: %s\n", err)
-		os.Exit(1)
+	var annotations []check.Annotation
+	if annotationsJSON := envOr("CHECK_ANNOTATIONS", ""); annotationsJSON != "" {
+		if err := json.Unmarshal([]byte(annotationsJSON), &annotations); err != nil {
+			return exitErrorf(exitValidation, "could not parse annotations: %s", err)
+		}
+	}
+
+	data, err := loadPayload(envOr("CHECK_PAYLOAD_FILE", ""), os.Getenv("CHECK_PAYLOAD"))
+	if err != nil {
+		return &exitError{code: exitPayload, err: err}
 	}
 	token := data.Token
 
-	repo, commit, branch, err := repoCommitBranch(data)
+	target, err := repoCommitBranch(data)
 	if err != nil {
-		fmt.Printf("Error processing data: %s", err)
-		os.Exit(2)
+		return exitErrorf(exitData, "could not process payload: %s", err)
 	}
 
-	parts := strings.Split(repo, "/")
-	if len(parts) != 2 {
-		fmt.Println("Error: CheckSuite.Repository.FullName is required")
-		os.Exit(1)
+	// Stdout is reserved for the check run, so this goes to stderr
+	if target.prNumber != 0 {
+		fmt.Fprintf(os.Stderr, "CHECK_PR_NUMBER=%d\nCHECK_BASE_REF=%s\n", target.prNumber, target.baseRef)
+	}
+
+	owner, repo, err := ghlib.SplitRepoName(target.repo)
+	if err != nil {
+		return exitErrorf(exitData, "CheckSuite.Repository.FullName is required: %s", err)
+	}
+
+	detailsURL, err = renderDetailsURL(detailsURL, detailsData{
+		ExternalID: externalID,
+		BuildID:    buildID,
+		Repo:       target.repo,
+		Commit:     target.commit,
+		Branch:     target.branch,
+	})
+	if err != nil {
+		return &exitError{code: exitValidation, err: err}
 	}
 
 	run := check.Run{
 		Name:       name,
-		HeadBranch: branch,
-		HeadSHA:    commit,
+		HeadBranch: target.branch,
+		HeadSHA:    target.commit,
 		StartedAt:  startedAt,
 		ExternalID: externalID,
 		DetailsURL: detailsURL,
 		Output: check.Output{
-			Title:   title,
-			Summary: summary,
-			Text:    text,
+			Title:       title,
+			Summary:     summary,
+			Text:        text,
+			Annotations: annotations,
 		},
 		Status: "in_progress",
 	}
@@ -78,7 +176,7 @@ func main() {
 	if len(conclusion) > 0 {
 		run.Conclusion = conclusion
 		run.Status = "completed"
-		run.CompletedAt = time.Now().Format(check.RFC8601)
+		run.CompletedAt = completedAt
 	}
 
 	if actions != nil {
@@ -91,98 +189,146 @@ func main() {
 		ghBaseURL,
 		ghUploadURL,
 		token,
+		clientOpts...,
 	)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(3)
+		return &exitError{code: exitAuth, err: err}
 	}
-	ct := &checkTool{
-		client: ghc,
-		owner:  parts[0],
-		repo:   parts[1],
+	cr, err := check.CreateRun(context.Background(), ghc, owner, repo, run)
+	if err != nil {
+		return &exitError{code: exitAPI, err: err}
 	}
-
-	out, err := ct.createRun(run)
+	out, err := json.Marshal(cr)
 	if err != nil {
-		fmt.Printf("Error: %s (got %s)\n", err, out)
-		os.Exit(1)
+		return err
 	}
-	fmt.Println(out)
+	fmt.Println(string(out))
+	return nil
 }
 
-func repoCommitBranch(payload *webhook.Payload) (string, string, string, error) {
-	var repo, commit, branch string
-	// As ridiculous as this is, we have to remarshal the Body and unmarshal it
-	// into the right object.
-	tmp, err := json.Marshal(payload.Body)
-	if err != nil {
-		return repo, commit, branch, err
+// loadPayload parses the payload in file, or in payload if file is empty.
+// Reading it from a file allows payloads larger than the environment
+// variables of some runtimes can hold.
+func loadPayload(file, payload string) (*webhook.Payload, error) {
+	raw := []byte(payload)
+	if file != "" {
+		var err error
+		if raw, err = ioutil.ReadFile(file); err != nil {
+			return nil, fmt.Errorf("could not read payload: %s", err)
+		}
 	}
+	data := &webhook.Payload{}
+	if err := json.Unmarshal(raw, data); err != nil {
+		return nil, fmt.Errorf("could not parse payload: %s", err)
+	}
+	return data, nil
+}
+
+// checkTarget describes what a check run is reported against.
+type checkTarget struct {
+	repo   string
+	commit string
+	branch string
+	// prNumber and baseRef describe the pull request being checked, if any
+	prNumber int
+	baseRef  string
+}
+
+func repoCommitBranch(payload *webhook.Payload) (checkTarget, error) {
+	var t checkTarget
+	// The Body is kept as raw JSON, so it can be unmarshaled straight into the
+	// right object without losing precision on large IDs.
 	switch payload.Type {
 	case "check_run":
 		event := &github.CheckRunEvent{}
-		if err = json.Unmarshal(tmp, event); err != nil {
-			return repo, commit, branch, err
+		if err := json.Unmarshal(payload.Body, event); err != nil {
+			return t, err
+		}
+		t.repo = event.Repo.GetFullName()
+		t.commit = event.CheckRun.CheckSuite.GetHeadSHA()
+		t.branch = event.CheckRun.CheckSuite.GetHeadBranch()
+		prs := event.CheckRun.PullRequests
+		if len(prs) == 0 {
+			prs = event.CheckRun.CheckSuite.PullRequests
 		}
-		repo = event.Repo.GetFullName()
-		commit = event.CheckRun.CheckSuite.GetHeadSHA()
-		branch = event.CheckRun.CheckSuite.GetHeadBranch()
+		t.prNumber, t.baseRef = firstPullRequest(prs)
 	case "check_suite":
 		event := &github.CheckSuiteEvent{}
-		if err = json.Unmarshal(tmp, event); err != nil {
-			return repo, commit, branch, err
+		if err := json.Unmarshal(payload.Body, event); err != nil {
+			return t, err
 		}
-		repo = event.Repo.GetFullName()
-		commit = event.CheckSuite.GetHeadSHA()
-		branch = event.CheckSuite.GetHeadBranch()
+		t.repo = event.Repo.GetFullName()
+		t.commit = event.CheckSuite.GetHeadSHA()
+		t.branch = event.CheckSuite.GetHeadBranch()
+		t.prNumber, t.baseRef = firstPullRequest(event.CheckSuite.PullRequests)
 	case "issue_comment":
 		event := &github.IssueCommentEvent{}
-		if err = json.Unmarshal(tmp, event); err != nil {
-			return repo, commit, branch, err
+		if err := json.Unmarshal(payload.Body, event); err != nil {
+			return t, err
 		}
-		repo = event.Repo.GetFullName()
+		t.repo = event.Repo.GetFullName()
 		// A github.IssueCommentEvent event does not have commit or branch fields,
 		// therefore, we will expect them to be set on the payload itself
-		if commit = payload.Commit; commit == "" {
-			return repo, commit, branch, fmt.Errorf("commit empty")
+		if t.commit = payload.Commit; t.commit == "" {
+			return t, fmt.Errorf("commit empty")
 		}
-		if branch = payload.Branch; branch == "" {
-			return repo, commit, branch, fmt.Errorf("branch empty")
+		if t.branch = payload.Branch; t.branch == "" {
+			return t, fmt.Errorf("branch empty")
 		}
+		t.prNumber, t.baseRef = payload.PRNumber, payload.BaseRef
 	default:
-		return repo, commit, branch, fmt.Errorf("unknown payload type %s", payload.Type)
+		return t, fmt.Errorf("unknown payload type %s", payload.Type)
 	}
-	return repo, commit, branch, nil
+	return t, nil
 }
 
-type checkTool struct {
-	client *github.Client
-	owner  string
-	repo   string
+// detailsData is what a CHECK_DETAILS_URL template is rendered with.
+type detailsData struct {
+	ExternalID string
+	BuildID    string
+	Repo       string
+	Commit     string
+	Branch     string
 }
 
-func (c *checkTool) createRun(cr check.Run) (string, error) {
-	out := bytes.NewBuffer(nil) // FIXME
-
-	u := fmt.Sprintf("repos/%s/%s/check-runs", c.owner, c.repo)
-	req, err := c.client.NewRequest("POST", u, cr)
+// renderDetailsURL renders the CHECK_DETAILS_URL text/template in tmpl with
+// data, so that the URL can point at the build the check run reports on.
+// URLs without template actions are returned verbatim.
+func renderDetailsURL(tmpl string, data detailsData) (string, error) {
+	if !strings.Contains(tmpl, "{{") {
+		return tmpl, nil
+	}
+	t, err := template.New("CHECK_DETAILS_URL").Parse(tmpl)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("could not parse CHECK_DETAILS_URL: %s", err)
 	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("could not render CHECK_DETAILS_URL: %s", err)
+	}
+	return b.String(), nil
+}
 
-	// Turn on beta feature.
-	req.Header.Set("Accept", "application/vnd.github.antiope-preview+json")
-
-	ctx := context.Background()
-	res, err := c.client.Do(ctx, req, out)
-	if err != nil {
-		body, _ := ioutil.ReadAll(res.Body)
-		res.Body.Close()
-		fmt.Printf("%+v", res)
+// firstPullRequest returns the number and base branch of the first of the
+// given pull requests, if there are any.
+func firstPullRequest(prs []*github.PullRequest) (int, string) {
+	if len(prs) == 0 {
+		return 0, ""
+	}
+	return prs[0].GetNumber(), prs[0].Base.GetRef()
+}
 
-		return string(body), err
+// envTime returns the RFC 3339 timestamp in envvar verbatim, or now if it is
+// unset or empty.
+func envTime(envvar string, now time.Time) (string, error) {
+	val := envOr(envvar, "")
+	if val == "" {
+		return now.Format(check.RFC8601), nil
+	}
+	if _, err := time.Parse(time.RFC3339, val); err != nil {
+		return "", fmt.Errorf("%s must be an RFC 3339 timestamp: %s", envvar, err)
 	}
-	return out.String(), nil
+	return val, nil
 }
 
 func envOr(envvar, defaultText string) string {
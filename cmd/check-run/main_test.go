@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade-github-app/pkg/webhook"
+)
+
+func TestRepoCommitBranch(t *testing.T) {
+	tests := []struct {
+		name        string
+		payloadType string
+		payloadFile string
+		payload     webhook.Payload
+		expected    checkTarget
+	}{
+		{
+			name:        "check run without pull requests",
+			payloadType: "check_run",
+			payloadFile: "../../pkg/webhook/testdata/github-check_run-payload.json",
+			expected: checkTarget{
+				repo:   "technosophos/-whale-eyes-",
+				commit: "c61cc68b5c2ec7d48d6d5e89d9e3d99182a4f817",
+				branch: "test/check_suite",
+			},
+		},
+		{
+			name:        "check run with pull requests",
+			payloadType: "check_run",
+			payloadFile: "../../pkg/webhook/testdata/github-check_run-pull_request-payload.json",
+			expected: checkTarget{
+				repo:     "technosophos/-whale-eyes-",
+				commit:   "c61cc68b5c2ec7d48d6d5e89d9e3d99182a4f817",
+				branch:   "test/check_suite",
+				prNumber: 7,
+				baseRef:  "master",
+			},
+		},
+		{
+			name:        "issue comment",
+			payloadType: "issue_comment",
+			payloadFile: "../../pkg/webhook/testdata/github-issue_comment-payload.json",
+			payload: webhook.Payload{
+				Commit:   "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+				Branch:   "refs/pull/2/head",
+				PRNumber: 2,
+				BaseRef:  "master",
+			},
+			expected: checkTarget{
+				repo:     "Codertocat/Hello-World",
+				commit:   "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+				branch:   "refs/pull/2/head",
+				prNumber: 2,
+				baseRef:  "master",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+			payload := tt.payload
+			payload.Type = tt.payloadType
+			payload.Body = body
+
+			target, err := repoCommitBranch(&payload)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if target != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, target)
+			}
+		})
+	}
+}
+
+func TestEnvTime(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		value     string
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "unset",
+			expected: "2020-06-01T12:00:00Z",
+		},
+		{
+			name:     "utc",
+			value:    "2020-05-31T08:15:00Z",
+			expected: "2020-05-31T08:15:00Z",
+		},
+		{
+			name:     "offset",
+			value:    "2020-05-31T10:15:00+02:00",
+			expected: "2020-05-31T10:15:00+02:00",
+		},
+		{
+			name:      "invalid",
+			value:     "yesterday",
+			expectErr: true,
+		},
+		{
+			name:      "no zone",
+			value:     "2020-05-31T08:15:00",
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("CHECK_TEST_TIME", tt.value)
+			defer os.Unsetenv("CHECK_TEST_TIME")
+
+			got, err := envTime("CHECK_TEST_TIME", now)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestRenderDetailsURL(t *testing.T) {
+	data := detailsData{
+		ExternalID: "brigade-worker-01e4f1",
+		BuildID:    "01e4f1",
+		Repo:       "Codertocat/Hello-World",
+		Commit:     "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+		Branch:     "master",
+	}
+	tests := []struct {
+		name      string
+		tmpl      string
+		expected  string
+		expectErr bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:     "static",
+			tmpl:     "https://kashti.example.com/",
+			expected: "https://kashti.example.com/",
+		},
+		{
+			name:     "build",
+			tmpl:     "https://kashti.example.com/#!/build/{{ .BuildID }}",
+			expected: "https://kashti.example.com/#!/build/01e4f1",
+		},
+		{
+			name:     "several fields",
+			tmpl:     "https://ci.example.com/{{ .Repo }}/{{ .Commit }}?id={{ .ExternalID }}",
+			expected: "https://ci.example.com/Codertocat/Hello-World/0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c?id=brigade-worker-01e4f1",
+		},
+		{
+			name:      "unknown field",
+			tmpl:      "https://kashti.example.com/#!/build/{{ .Build }}",
+			expectErr: true,
+		},
+		{
+			name:      "invalid",
+			tmpl:      "https://kashti.example.com/#!/build/{{ .BuildID",
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderDetailsURL(tt.tmpl, data)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestExitCodeOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected exitCode
+	}{
+		{
+			name: "success",
+		},
+		{
+			name:     "unclassified",
+			err:      errors.New("boom"),
+			expected: exitFailure,
+		},
+		{
+			name:     "payload",
+			err:      exitErrorf(exitPayload, "could not parse payload: %s", "unexpected EOF"),
+			expected: exitPayload,
+		},
+		{
+			name:     "data",
+			err:      exitErrorf(exitData, "could not process payload: %s", "commit empty"),
+			expected: exitData,
+		},
+		{
+			name:     "auth",
+			err:      &exitError{code: exitAuth, err: errors.New("no token")},
+			expected: exitAuth,
+		},
+		{
+			name:     "validation",
+			err:      exitErrorf(exitValidation, "could not parse actions: %s", "unexpected EOF"),
+			expected: exitValidation,
+		},
+		{
+			name:     "api",
+			err:      &exitError{code: exitAPI, err: errors.New("422 Unprocessable Entity")},
+			expected: exitAPI,
+		},
+		{
+			name:     "wrapped",
+			err:      fmt.Errorf("creating check run: %w", &exitError{code: exitAPI, err: errors.New("502 Bad Gateway")}),
+			expected: exitAPI,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCodeOf(tt.err); got != tt.expected {
+				t.Errorf("expected exit code %d, got %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestRunCheck_exitCodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected exitCode
+	}{
+		{
+			name: "invalid timestamp",
+			env: map[string]string{
+				"CHECK_STARTED_AT": "yesterday",
+			},
+			expected: exitValidation,
+		},
+		{
+			name: "invalid actions",
+			env: map[string]string{
+				"CHECK_ACTIONS": "[",
+			},
+			expected: exitValidation,
+		},
+		{
+			name:     "invalid payload",
+			env:      map[string]string{"CHECK_PAYLOAD": "{"},
+			expected: exitPayload,
+		},
+		{
+			name:     "unknown payload type",
+			env:      map[string]string{"CHECK_PAYLOAD": `{"type":"push","body":{}}`},
+			expected: exitData,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			err := runCheck()
+			if got := exitCodeOf(err); got != tt.expected {
+				t.Errorf("expected exit code %d, got %d: %v", tt.expected, got, err)
+			}
+		})
+	}
+}
+
+func TestLoadPayload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fromFile := `{"type":"check_suite","token":"file-token","body":{}}`
+	valid := filepath.Join(dir, "payload.json")
+	if err := ioutil.WriteFile(valid, []byte(fromFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "truncated.json")
+	if err := ioutil.WriteFile(invalid, []byte(fromFile[:20]), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fromEnv := `{"type":"check_run","token":"env-token","body":{}}`
+	tests := []struct {
+		name          string
+		file          string
+		payload       string
+		expectedType  string
+		expectedToken string
+		expectErr     bool
+	}{
+		{
+			name:          "env",
+			payload:       fromEnv,
+			expectedType:  "check_run",
+			expectedToken: "env-token",
+		},
+		{
+			// The file takes precedence over the environment
+			name:          "file",
+			file:          valid,
+			payload:       fromEnv,
+			expectedType:  "check_suite",
+			expectedToken: "file-token",
+		},
+		{
+			name:      "missing file",
+			file:      filepath.Join(dir, "missing.json"),
+			payload:   fromEnv,
+			expectErr: true,
+		},
+		{
+			name:      "invalid file",
+			file:      invalid,
+			expectErr: true,
+		},
+		{
+			name:      "unset",
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := loadPayload(tt.file, tt.payload)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if data.Type != tt.expectedType || data.Token != tt.expectedToken {
+				t.Errorf("expected type %q and token %q, got %q and %q", tt.expectedType, tt.expectedToken, data.Type, data.Token)
+			}
+		})
+	}
+}
@@ -1,37 +1,103 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	gin "gopkg.in/gin-gonic/gin.v1"
 	v1 "k8s.io/api/core/v1"
 
+	"github.com/brigadecore/brigade/pkg/storage"
 	"github.com/brigadecore/brigade/pkg/storage/kube"
 
+	ghlib "github.com/brigadecore/brigade-github-app/pkg/github"
 	"github.com/brigadecore/brigade-github-app/pkg/webhook"
 )
 
 var (
-	kubeconfig     string
-	master         string
-	namespace      string
-	gatewayPort    string
-	keyFile        string
-	allowedAuthors authors
-	emittedEvents  events
+	kubeconfig      string
+	master          string
+	namespace       string
+	gatewayPort     string
+	keyFile         string
+	defaultRef      string
+	appSecret       string
+	orgProject      string
+	instProject     string
+	replayToken     string
+	checksToken     string
+	debugToken      string
+	buildLogLevel   string
+	forkAllowLabel  string
+	skipPRLabel     string
+	forkPolicy      string
+	maxEventAge     time.Duration
+	githubTimeout   time.Duration
+	requestTimeout  time.Duration
+	githubCAFile    string
+	wildcardActions bool
+	noActionEvents  bool
+	repoTopics      bool
+	topicEvents     bool
+	forwardUnknown  bool
+	pushHeadOnly    bool
+	strictEvents    bool
+	projectNS       bool
+	verifySource    bool
+	statusAllow     contexts
+	statusDeny      contexts
+	environments    contexts
+	repoAllowlist   contexts
+	orgAllowlist    contexts
+	trustedNetworks networks
+	prewarm         installations
+	prewarmBaseURL  string
+	auditLog        string
+	reportMode      string
+	buildURL        string
+	workerImage     string
+	eventPrefix     string
+	healthPath      string
+	maxInflight     int
+	maxBodyLog      int
+	allowedAuthors  authors
+	emittedEvents   events
+	providerMap     = providers{}
+	eventAliases    = aliases{}
+)
+
+// version, commit and buildDate describe the build of the gateway. They are
+// set with -ldflags "-X main.version=..." when building release images.
+var (
+	version   = "unversioned"
+	commit    = ""
+	buildDate = ""
 )
 
 // defaultAllowedAuthors is the default set of authors allowed to PR
 // https://developer.github.com/v4/reference/enum/commentauthorassociation/
 var defaultAllowedAuthors = []string{"COLLABORATOR", "OWNER", "MEMBER"}
 
+// defaultStatusContextDeny is the default set of status contexts to ignore,
+// which covers statuses reported by Brigade jobs so that they don't trigger
+// further builds
+var defaultStatusContextDeny = []string{"brigade*"}
+
+// sourceRefreshInterval is how often GitHub's webhook ranges are fetched again
+// when --verify-github-source is set
+const sourceRefreshInterval = time.Hour
+
 // defaultEmittedEvents is the default set of events to be emitted by the gateway
 var defaultEmittedEvents = []string{"*"}
 
@@ -40,8 +106,50 @@ func init() {
 	flag.StringVar(&master, "master", "", "master url")
 	flag.StringVar(&namespace, "namespace", defaultNamespace(), "kubernetes namespace")
 	flag.StringVar(&gatewayPort, "gateway-port", defaultGatewayPort(), "TCP port to use for brigade-github-gateway")
-	flag.StringVar(&keyFile, "key-file", "/etc/brigade-github-app/key.pem", "path to x509 key for GitHub app")
+	flag.StringVar(&keyFile, "key-file", "/etc/brigade-github-app/key.pem", "path to x509 key for GitHub app; while rotating keys, paths of the new and the old key separated by a comma, which are tried in order when minting installation tokens")
+	flag.StringVar(&defaultRef, "default-ref", "refs/heads/master", "ref to build for events without one when the repository's default branch cannot be determined")
+	flag.StringVar(&appSecret, "app-webhook-secret", os.Getenv("APP_WEBHOOK_SECRET"), "webhook secret of the GitHub App, used to validate check suite, check run and issue comment events")
+	flag.StringVar(&orgProject, "org-project", os.Getenv("BRIGADE_ORG_PROJECT"), "name of the Brigade project to emit organization events that aren't tied to a repository to")
+	flag.StringVar(&instProject, "installation-project", os.Getenv("BRIGADE_INSTALLATION_PROJECT"), "name of the Brigade project to emit installation and installation_repositories events to (they are skipped if empty)")
 	flag.Var(&allowedAuthors, "authors", "allowed author associations, separated by commas (COLLABORATOR, CONTRIBUTOR, FIRST_TIMER, FIRST_TIME_CONTRIBUTOR, MEMBER, OWNER, NONE)")
+	flag.StringVar(&replayToken, "replay-token", os.Getenv("BRIGADE_REPLAY_TOKEN"), "bearer token for replaying captured deliveries with POST /events/replay (the endpoint is disabled if empty)")
+	flag.StringVar(&buildLogLevel, "build-log-level", os.Getenv("BRIGADE_BUILD_LOG_LEVEL"), "log level for the workers of created builds (log, info, warn or error; defaults to the worker's own)")
+	flag.StringVar(&forkAllowLabel, "fork-allow-label", os.Getenv("BRIGADE_FORK_ALLOW_LABEL"), "label that allows a forked PR to be built regardless of its author's association, e.g. ok-to-test")
+	flag.DurationVar(&maxEventAge, "max-event-age", 0, "skip deliveries of events that happened longer ago than this, e.g. 1h (0 accepts any age)")
+	flag.DurationVar(&githubTimeout, "github-timeout", ghlib.DefaultTimeout, "timeout for requests to the GitHub API (0 disables it)")
+	flag.DurationVar(&requestTimeout, "request-timeout", defaultRequestTimeout(), "time after which handling a request is abandoned and answered with 503, e.g. 1m (0 disables it)")
+	flag.StringVar(&githubCAFile, "github-ca-file", os.Getenv("BRIGADE_GITHUB_CA_FILE"), "path to a PEM bundle of CA certificates to trust for the GitHub API instead of the system's, e.g. for GitHub Enterprise with an internal CA")
+	flag.StringVar(&skipPRLabel, "skip-pr-label", os.Getenv("BRIGADE_SKIP_PR_LABEL"), "label that suppresses all builds for a PR carrying it, e.g. wip")
+	flag.StringVar(&forkPolicy, "fork-secret-policy", defaultForkSecretPolicy(), "installation token passed to builds of forked PRs: full, limited (read-only, but may report check runs) or none")
+	flag.StringVar(&checksToken, "checks-token", os.Getenv("BRIGADE_CHECKS_TOKEN"), "bearer token for requesting check suites with POST /checks/:owner/:repo (the endpoint is disabled if empty)")
+	flag.StringVar(&debugToken, "debug-token", os.Getenv("BRIGADE_DEBUG_TOKEN"), "bearer token for reading the effective configuration, with secrets redacted, with GET /debug/config (the endpoint is disabled if empty)")
+	flag.Var(&providerMap, "provider-map", "providers to record on builds of specific events, as event=provider pairs separated by commas (events default to `github`)")
+	flag.Var(&statusAllow, "status-context-allow", "contexts of status events to build, separated by commas; globs such as `ci/*` are supported (defaults to all)")
+	flag.Var(&statusDeny, "status-context-deny", "contexts of status events to skip, separated by commas; takes precedence over --status-context-allow (defaults to `brigade*`)")
+	flag.Var(&environments, "deployment-environments", "environments of deployment and deployment_status events to build, separated by commas (defaults to all)")
+	flag.Var(&repoAllowlist, "repo-allowlist", "repositories to build, separated by commas; globs such as `brigadecore/*` are supported (defaults to all)")
+	flag.Var(&orgAllowlist, "org-allowlist", "organizations or users whose repositories to build, separated by commas; globs are supported (defaults to all)")
+	flag.BoolVar(&wildcardActions, "emit-wildcard-actions", defaultEmitWildcardActions(), "also emit eventType:* for events that have an action, e.g. pull_request:*")
+	flag.BoolVar(&noActionEvents, "no-action-events", defaultNoActionEvents(), "emit only the bare event type, e.g. pull_request, never eventType:action")
+	flag.BoolVar(&repoTopics, "repo-topics", defaultRepoTopics(), "add the repository's GitHub topics to build payloads as topics, looking them up via the GitHub API if the delivery lacks them")
+	flag.BoolVar(&topicEvents, "emit-topic-events", defaultEmitTopicEvents(), "also emit eventType:topic for each of the repository's GitHub topics, e.g. push:team-payments (implies --repo-topics)")
+	flag.BoolVar(&forwardUnknown, "forward-unknown-events", defaultForwardUnknownEvents(), "emit the bare event type for signed events the gateway can't parse because they are newer than it, instead of rejecting them")
+	flag.BoolVar(&pushHeadOnly, "push-head-only", defaultPushHeadOnly(), "reduce the commits in push payloads to the head commit, which is the only one built")
+	flag.BoolVar(&strictEvents, "strict-events", false, "fail to start if --events names an unknown event type, instead of logging a warning")
+	flag.BoolVar(&verifySource, "verify-github-source", defaultVerifySource(), "reject deliveries, other than replays and those from --trust-network, whose address is outside the webhook ranges github.com publishes in its meta API")
+	flag.BoolVar(&projectNS, "project-namespaces", defaultProjectNamespaces(), "create builds in the namespace configured for each project instead of --namespace (the gateway needs access to those namespaces)")
+	flag.StringVar(&reportMode, "report-mode", defaultReportMode(), "what to report to GitHub about scheduled builds: none, or status to set a pending commit status for pull requests and pushes")
+	flag.StringVar(&workerImage, "worker-image", os.Getenv("BRIGADE_WORKER_IMAGE"), "worker image to name in the gateway.workerImage field of every build payload")
+	flag.StringVar(&buildURL, "build-url", os.Getenv("BRIGADE_BUILD_URL"), "URL of a build in a Brigade UI, linked from reported statuses; {id} is replaced by the build ID")
+	flag.Var(&trustedNetworks, "trust-network", "CIDRs, separated by commas, whose deliveries skip webhook signature validation; only for networks that can't be reached by anyone else (disabled by default)")
+	flag.IntVar(&maxInflight, "max-inflight-per-installation", defaultMaxInflight(), "maximum concurrent GitHub API operations per app installation; deliveries that can't get a slot within a few seconds are answered with 429 (0 disables the limit)")
+	flag.IntVar(&maxBodyLog, "max-body-log-bytes", defaultMaxBodyLogBytes(), "how many bytes of a delivery's body to log when it can't be handled; bodies may contain secrets (0 never logs them)")
+	flag.StringVar(&auditLog, "audit-log", os.Getenv("BRIGADE_AUDIT_LOG"), "file to append a JSON line to for every signature validation, author check and installation token, or - for standard output (disabled if empty)")
+	flag.Var(&prewarm, "prewarm-installations", "`appID:installationID` pairs, separated by commas, whose installation tokens are minted at startup and refreshed before they expire")
+	flag.StringVar(&prewarmBaseURL, "prewarm-base-url", os.Getenv("BRIGADE_PREWARM_BASE_URL"), "GitHub Enterprise API URL of the prewarmed installations, as in their projects (defaults to github.com)")
+	flag.StringVar(&healthPath, "health-path", defaultHealthPath(), "path of the health check endpoint")
+	flag.StringVar(&eventPrefix, "event-prefix", os.Getenv("BRIGADE_EVENT_PREFIX"), "prefix for the type of every emitted event, e.g. `gh:` to emit gh:push")
+	flag.Var(&eventAliases, "event-aliases", "additional event types to emit whenever an event is, as event=alias,alias pairs separated by semicolons, e.g. `push=ci,deploy-preview`")
 	flag.Var(&emittedEvents, "events", "events to be emitted and passed to worker, separated by commas (defaults to `*`, which matches everything)")
 }
 
@@ -53,10 +161,9 @@ func main() {
 		os.Exit(1)
 	}
 
-	key, err := ioutil.ReadFile(keyFile)
+	key, err := loadKeys(strings.Split(keyFile, ","))
 	if err != nil {
-		log.Fatalf("could not load key from %q: %s", keyFile, err)
-		os.Exit(1)
+		log.Fatal(err)
 	}
 
 	if len(allowedAuthors) == 0 {
@@ -71,6 +178,74 @@ func main() {
 		log.Printf("Forked PRs will be built for roles %s", strings.Join(allowedAuthors, " | "))
 	}
 
+	if len(providerMap) == 0 {
+		if pm, ok := os.LookupEnv("BRIGADE_PROVIDER_MAP"); ok {
+			if err := (&providerMap).Set(pm); err != nil {
+				log.Fatalf("invalid BRIGADE_PROVIDER_MAP: %s", err)
+			}
+		}
+	}
+
+	if len(eventAliases) == 0 {
+		if ea, ok := os.LookupEnv("BRIGADE_EVENT_ALIASES"); ok {
+			if err := (&eventAliases).Set(ea); err != nil {
+				log.Fatalf("invalid BRIGADE_EVENT_ALIASES: %s", err)
+			}
+		}
+	}
+
+	if len(statusAllow) == 0 {
+		if sa, ok := os.LookupEnv("BRIGADE_STATUS_CONTEXT_ALLOW"); ok {
+			(&statusAllow).Set(sa)
+		}
+	}
+
+	// An empty --status-context-deny disables the default
+	if !isFlagSet("status-context-deny") {
+		if sd, ok := os.LookupEnv("BRIGADE_STATUS_CONTEXT_DENY"); ok {
+			(&statusDeny).Set(sd)
+		} else {
+			statusDeny = defaultStatusContextDeny
+		}
+	}
+
+	if len(environments) == 0 {
+		if de, ok := os.LookupEnv("BRIGADE_DEPLOYMENT_ENVIRONMENTS"); ok {
+			(&environments).Set(de)
+		}
+	}
+
+	if len(repoAllowlist) == 0 {
+		if ra, ok := os.LookupEnv("BRIGADE_REPO_ALLOWLIST"); ok {
+			(&repoAllowlist).Set(ra)
+		}
+	}
+
+	if len(orgAllowlist) == 0 {
+		if oa, ok := os.LookupEnv("BRIGADE_ORG_ALLOWLIST"); ok {
+			(&orgAllowlist).Set(oa)
+		}
+	}
+
+	if len(trustedNetworks) == 0 {
+		if tn, ok := os.LookupEnv("BRIGADE_TRUST_NETWORK"); ok {
+			if err := (&trustedNetworks).Set(tn); err != nil {
+				log.Fatalf("invalid BRIGADE_TRUST_NETWORK: %s", err)
+			}
+		}
+	}
+	if len(prewarm) == 0 {
+		if pi, ok := os.LookupEnv("BRIGADE_PREWARM_INSTALLATIONS"); ok {
+			if err := (&prewarm).Set(pi); err != nil {
+				log.Fatalf("invalid BRIGADE_PREWARM_INSTALLATIONS: %s", err)
+			}
+		}
+	}
+
+	for _, n := range trustedNetworks {
+		log.Printf("WARNING: deliveries from %s will be accepted without a valid signature", n)
+	}
+
 	if len(emittedEvents) == 0 {
 		if ee, ok := os.LookupEnv("BRIGADE_EVENTS"); ok {
 			(&emittedEvents).Set(ee)
@@ -78,6 +253,17 @@ func main() {
 			emittedEvents = defaultEmittedEvents
 		}
 	}
+	// --events entries may carry the event prefix
+	unprefixedEvents := make([]string, len(emittedEvents))
+	for i, e := range emittedEvents {
+		unprefixedEvents[i] = strings.TrimPrefix(e, eventPrefix)
+	}
+	if unknown := webhook.UnknownEvents(unprefixedEvents); len(unknown) > 0 {
+		if strictEvents {
+			log.Fatalf("unknown events %q (known events are %s)", unknown, strings.Join(webhook.KnownEvents, ", "))
+		}
+		log.Printf("WARNING: no builds will be emitted for unknown events %q", unknown)
+	}
 
 	envOrBool := func(env string, defaultVal bool) bool {
 		s, ok := os.LookupEnv(env)
@@ -106,11 +292,64 @@ func main() {
 		return realVal
 	}
 
+	clientOpts := []ghlib.ClientOption{ghlib.WithTimeout(githubTimeout)}
+	if githubCAFile != "" {
+		pool, err := ghlib.LoadCAFile(githubCAFile)
+		if err != nil {
+			log.Fatalf("could not load CA certificates from %q: %s", githubCAFile, err)
+		}
+		clientOpts = append(clientOpts, ghlib.WithRootCAs(pool))
+	}
+
+	switch webhook.ForkSecretPolicy(forkPolicy) {
+	case webhook.ForkSecretsFull, webhook.ForkSecretsLimited, webhook.ForkSecretsNone:
+	default:
+		log.Fatalf("invalid fork secret policy %q", forkPolicy)
+	}
+
+	switch webhook.ReportMode(reportMode) {
+	case webhook.ReportNone, webhook.ReportStatus:
+	default:
+		log.Fatalf("invalid report mode %q", reportMode)
+	}
+
 	ghOpts := webhook.GithubOpts{
-		CheckSuiteOnPR:      envOrBool("CHECK_SUITE_ON_PR", true),
-		AppID:               envOrInt("APP_ID", 0),
-		DefaultSharedSecret: os.Getenv("DEFAULT_SHARED_SECRET"),
-		EmittedEvents:       emittedEvents,
+		CheckSuiteOnPR:         envOrBool("CHECK_SUITE_ON_PR", true),
+		AppID:                  envOrInt("APP_ID", 0),
+		DefaultSharedSecret:    os.Getenv("DEFAULT_SHARED_SECRET"),
+		AppWebhookSecret:       appSecret,
+		EmittedEvents:          emittedEvents,
+		EmitWildcardActions:    wildcardActions,
+		NoActionEvents:         noActionEvents,
+		RepoTopics:             repoTopics,
+		EmitTopicEvents:        topicEvents,
+		ForwardUnknownEvents:   forwardUnknown,
+		PushHeadOnly:           pushHeadOnly,
+		DefaultRef:             defaultRef,
+		OrgProject:             orgProject,
+		InstallationProject:    instProject,
+		ProviderMap:            providerMap,
+		EventAliases:           eventAliases,
+		EventPrefix:            eventPrefix,
+		ReplayToken:            replayToken,
+		ChecksToken:            checksToken,
+		DebugToken:             debugToken,
+		BuildLogLevel:          buildLogLevel,
+		ForkAllowLabel:         forkAllowLabel,
+		SkipPRLabel:            skipPRLabel,
+		ForkSecretPolicy:       webhook.ForkSecretPolicy(forkPolicy),
+		MaxEventAge:            maxEventAge,
+		StatusContextAllow:     statusAllow,
+		StatusContextDeny:      statusDeny,
+		DeploymentEnvironments: environments,
+		RepoAllowlist:          repoAllowlist,
+		OrgAllowlist:           orgAllowlist,
+		MaxBodyLogBytes:        maxBodyLog,
+		TrustedNetworks:        trustedNetworks,
+		ReportMode:             webhook.ReportMode(reportMode),
+		BuildURL:               buildURL,
+		WorkerImage:            workerImage,
+		ClientOptions:          clientOpts,
 	}
 
 	clientset, err := kube.GetClient(master, kubeconfig)
@@ -120,22 +359,97 @@ func main() {
 
 	store := kube.New(clientset, namespace)
 
+	if maxInflight > 0 {
+		ghOpts.InstallationLimiter = webhook.NewInstallationLimiter(maxInflight)
+	}
+
+	if projectNS {
+		ghOpts.NamespaceStores = webhook.NewNamespaceStores(func(ns string) storage.Store {
+			if ns == namespace {
+				return store
+			}
+			return kube.New(clientset, ns)
+		})
+	}
+
+	if auditLog != "" {
+		ghOpts.AuditLog = webhook.NewAuditLogger(openAuditLog(auditLog))
+	}
+
+	if verifySource {
+		ghOpts.SourceRanges = webhook.NewSourceRanges(func(ctx context.Context) ([]string, error) {
+			return ghlib.HookRanges(ctx, "", "", clientOpts...)
+		})
+		if err := ghOpts.SourceRanges.Refresh(context.Background()); err != nil {
+			log.Fatalf("could not fetch GitHub hook ranges: %s", err)
+		}
+		ghOpts.SourceRanges.KeepFresh(context.Background(), sourceRefreshInterval)
+	}
+
+	ghOpts.TokenCache = ghlib.NewTokenCache(key, clientOpts...)
+	ghOpts.TokenCache.Prewarm(context.Background(), prewarmBaseURL, prewarmBaseURL, prewarm)
+
 	router := gin.New()
 	router.Use(gin.Recovery())
+	if requestTimeout > 0 {
+		router.Use(webhook.RequestTimeout(requestTimeout))
+	}
 
 	events := router.Group("/events")
 	{
-		events.Use(gin.Logger())
+		events.Use(webhook.RequestLogger())
 		events.POST("/github", webhook.NewGithubHookHandler(store, allowedAuthors, key, ghOpts))
 		events.POST("/github/:app/:inst", webhook.NewGithubHookHandler(store, allowedAuthors, key, ghOpts))
+		if replayToken != "" {
+			events.POST("/replay", webhook.NewReplayHandler(store, allowedAuthors, key, ghOpts))
+		}
+	}
+
+	if checksToken != "" {
+		router.POST("/checks/:owner/:repo", webhook.RequestLogger(), webhook.NewCheckSuiteHandler(store, key, ghOpts))
+	}
+
+	if debugToken != "" {
+		router.GET("/debug/config", webhook.NewConfigHandler(allowedAuthors, ghOpts))
 	}
 
-	router.GET("/healthz", healthz)
+	router.GET(healthPath, healthz)
+	router.GET("/version", versionHandler)
 
 	formattedGatewayPort := fmt.Sprintf(":%v", gatewayPort)
 	router.Run(formattedGatewayPort)
 }
 
+// openAuditLog opens the audit log at path for appending, or returns standard
+// output for "-".
+func openAuditLog(path string) io.Writer {
+	if path == "-" {
+		return os.Stdout
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Fatalf("could not open audit log: %s", err)
+	}
+	return f
+}
+
+// loadKeys reads and parses the app's private keys, so that a missing or
+// invalid key is reported at startup rather than on the first delivery.
+func loadKeys(paths []string) (*ghlib.AppKey, error) {
+	keyPEMs := make([][]byte, len(paths))
+	for i, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not load key from %q: %s", path, err)
+		}
+		if _, err := ghlib.ParseAppKey(data); err != nil {
+			return nil, fmt.Errorf("invalid GitHub app key in %q: %s", path, err)
+		}
+		keyPEMs[i] = data
+	}
+	return ghlib.ParseAppKeys(keyPEMs...)
+}
+
 func defaultNamespace() string {
 	if ns, ok := os.LookupEnv("BRIGADE_NAMESPACE"); ok {
 		return ns
@@ -143,6 +457,82 @@ func defaultNamespace() string {
 	return v1.NamespaceDefault
 }
 
+func defaultForkSecretPolicy() string {
+	if policy, ok := os.LookupEnv("BRIGADE_FORK_SECRET_POLICY"); ok {
+		return policy
+	}
+	return string(webhook.ForkSecretsFull)
+}
+
+func defaultEmitWildcardActions() bool {
+	emit, _ := strconv.ParseBool(os.Getenv("BRIGADE_EMIT_WILDCARD_ACTIONS"))
+	return emit
+}
+
+func defaultProjectNamespaces() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("BRIGADE_PROJECT_NAMESPACES"))
+	return enabled
+}
+
+func defaultVerifySource() bool {
+	verify, _ := strconv.ParseBool(os.Getenv("BRIGADE_VERIFY_GITHUB_SOURCE"))
+	return verify
+}
+
+func defaultRepoTopics() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("BRIGADE_REPO_TOPICS"))
+	return enabled
+}
+
+func defaultEmitTopicEvents() bool {
+	emit, _ := strconv.ParseBool(os.Getenv("BRIGADE_EMIT_TOPIC_EVENTS"))
+	return emit
+}
+
+func defaultForwardUnknownEvents() bool {
+	forward, _ := strconv.ParseBool(os.Getenv("BRIGADE_FORWARD_UNKNOWN_EVENTS"))
+	return forward
+}
+
+func defaultRequestTimeout() time.Duration {
+	timeout, _ := time.ParseDuration(os.Getenv("BRIGADE_REQUEST_TIMEOUT"))
+	return timeout
+}
+
+func defaultPushHeadOnly() bool {
+	headOnly, _ := strconv.ParseBool(os.Getenv("BRIGADE_PUSH_HEAD_ONLY"))
+	return headOnly
+}
+
+func defaultNoActionEvents() bool {
+	disabled, _ := strconv.ParseBool(os.Getenv("BRIGADE_NO_ACTION_EVENTS"))
+	return disabled
+}
+
+func defaultReportMode() string {
+	if mode, ok := os.LookupEnv("BRIGADE_REPORT_MODE"); ok {
+		return mode
+	}
+	return string(webhook.ReportNone)
+}
+
+func defaultMaxInflight() int {
+	max, _ := strconv.Atoi(os.Getenv("BRIGADE_MAX_INFLIGHT_PER_INSTALLATION"))
+	return max
+}
+
+func defaultMaxBodyLogBytes() int {
+	max, _ := strconv.Atoi(os.Getenv("BRIGADE_MAX_BODY_LOG_BYTES"))
+	return max
+}
+
+func defaultHealthPath() string {
+	if p, ok := os.LookupEnv("BRIGADE_HEALTH_PATH"); ok {
+		return p
+	}
+	return "/healthz"
+}
+
 func defaultGatewayPort() string {
 	if port, ok := os.LookupEnv("BRIGADE_GATEWAY_PORT"); ok {
 		return port
@@ -150,10 +540,29 @@ func defaultGatewayPort() string {
 	return "7746"
 }
 
+// isFlagSet returns true if the named flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func healthz(c *gin.Context) {
 	c.String(http.StatusOK, http.StatusText(http.StatusOK))
 }
 
+func versionHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"version": version,
+		"commit":  commit,
+		"date":    buildDate,
+	})
+}
+
 type authors []string
 
 func (a *authors) Set(value string) error {
@@ -179,3 +588,133 @@ func (a *events) Set(value string) error {
 func (a *events) String() string {
 	return strings.Join(*a, ",")
 }
+
+type contexts []string
+
+func (a *contexts) Set(value string) error {
+	for _, aa := range strings.Split(value, ",") {
+		if aa = strings.TrimSpace(aa); aa != "" {
+			*a = append(*a, aa)
+		}
+	}
+	return nil
+}
+
+func (a *contexts) String() string {
+	return strings.Join(*a, ",")
+}
+
+type networks []*net.IPNet
+
+func (a *networks) Set(value string) error {
+	for _, cidr := range strings.Split(value, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		*a = append(*a, n)
+	}
+	return nil
+}
+
+func (a *networks) String() string {
+	cidrs := make([]string, 0, len(*a))
+	for _, n := range *a {
+		cidrs = append(cidrs, n.String())
+	}
+	return strings.Join(cidrs, ",")
+}
+
+type installations []ghlib.Installation
+
+func (a *installations) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 {
+			return fmt.Errorf("expected appID:installationID, got %q", pair)
+		}
+		appID, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid app ID in %q: %s", pair, err)
+		}
+		instID, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid installation ID in %q: %s", pair, err)
+		}
+		*a = append(*a, ghlib.Installation{AppID: appID, InstallationID: instID})
+	}
+	return nil
+}
+
+func (a *installations) String() string {
+	pairs := make([]string, 0, len(*a))
+	for _, i := range *a {
+		pairs = append(pairs, fmt.Sprintf("%d:%d", i.AppID, i.InstallationID))
+	}
+	return strings.Join(pairs, ",")
+}
+
+type aliases map[string][]string
+
+func (a *aliases) Set(value string) error {
+	for _, pair := range strings.Split(value, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		event := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || event == "" {
+			return fmt.Errorf("expected event=alias,alias, got %q", pair)
+		}
+		for _, alias := range strings.Split(kv[1], ",") {
+			if alias = strings.TrimSpace(alias); alias != "" {
+				(*a)[event] = append((*a)[event], alias)
+			}
+		}
+		if len((*a)[event]) == 0 {
+			return fmt.Errorf("expected event=alias,alias, got %q", pair)
+		}
+	}
+	return nil
+}
+
+func (a *aliases) String() string {
+	pairs := make([]string, 0, len(*a))
+	for k, v := range *a {
+		pairs = append(pairs, k+"="+strings.Join(v, ","))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ";")
+}
+
+type providers map[string]string
+
+func (p *providers) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("expected event=provider, got %q", pair)
+		}
+		event, provider := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if event == "" || provider == "" {
+			return fmt.Errorf("expected event=provider, got %q", pair)
+		}
+		(*p)[event] = provider
+	}
+	return nil
+}
+
+func (p *providers) String() string {
+	pairs := make([]string, 0, len(*p))
+	for k, v := range *p {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -1,6 +1,20 @@
 package main
 
-import "testing"
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
 
 func TestAuthors(t *testing.T) {
 	expand := "a,b,c"
@@ -22,3 +36,150 @@ func TestAuthors(t *testing.T) {
 		t.Errorf("Expected %q, got %q", expect, got)
 	}
 }
+
+func TestProviders(t *testing.T) {
+	p := providers{}
+	if err := p.Set("check_suite=github-checks, check_run=github-checks"); err != nil {
+		t.Fatal(err)
+	}
+	if p["check_suite"] != "github-checks" || p["check_run"] != "github-checks" {
+		t.Errorf("unexpected providers: %v", p)
+	}
+	expect := "check_run=github-checks,check_suite=github-checks"
+	if got := p.String(); expect != got {
+		t.Errorf("Expected %q, got %q", expect, got)
+	}
+
+	if err := (&providers{}).Set("check_suite"); err == nil {
+		t.Error("expected an error for a pair without a provider")
+	}
+	for _, blank := range []string{" =github-checks", "check_suite= "} {
+		if err := (&providers{}).Set(blank); err == nil {
+			t.Errorf("expected an error for %q", blank)
+		}
+	}
+}
+
+func TestAliases(t *testing.T) {
+	a := aliases{}
+	if err := a.Set("push=ci, deploy-preview; pull_request:opened=ci"); err != nil {
+		t.Fatal(err)
+	}
+	if len(a["push"]) != 2 || a["push"][0] != "ci" || a["push"][1] != "deploy-preview" {
+		t.Errorf("unexpected aliases for push: %v", a["push"])
+	}
+	expect := "pull_request:opened=ci;push=ci,deploy-preview"
+	if got := a.String(); expect != got {
+		t.Errorf("Expected %q, got %q", expect, got)
+	}
+
+	for _, bad := range []string{"push", "push=", "=ci"} {
+		if err := (&aliases{}).Set(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	n := networks{}
+	if err := n.Set("10.0.0.0/8, 192.168.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	expect := "10.0.0.0/8,192.168.1.0/24"
+	if got := n.String(); expect != got {
+		t.Errorf("Expected %q, got %q", expect, got)
+	}
+
+	if err := (&networks{}).Set("10.0.0.1"); err == nil {
+		t.Error("expected an error for an address without a prefix length")
+	}
+}
+
+func TestInstallations(t *testing.T) {
+	i := installations{}
+	if err := i.Set("12345:777777, 12345:888888"); err != nil {
+		t.Fatal(err)
+	}
+	expect := "12345:777777,12345:888888"
+	if got := i.String(); expect != got {
+		t.Errorf("Expected %q, got %q", expect, got)
+	}
+
+	for _, bad := range []string{"777777", "app:777777", "12345:777777:1"} {
+		if err := (&installations{}).Set(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "v1.2.3", "abc1234", "2020-01-02T03:04:05Z"
+
+	router := gin.New()
+	router.GET("/version", versionHandler)
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/version", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	got := map[string]string{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	expect := map[string]string{"version": "v1.2.3", "commit": "abc1234", "date": "2020-01-02T03:04:05Z"}
+	if len(got) != len(expect) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+	for k, v := range expect {
+		if got[k] != v {
+			t.Errorf("expected %s %q, got %q", k, v, got[k])
+		}
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	valid := filepath.Join(dir, "valid.pem")
+	validPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+	})
+	if err := ioutil.WriteFile(valid, validPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := ioutil.WriteFile(garbage, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if key, err := loadKeys([]string{valid}); err != nil || key == nil {
+		t.Errorf("expected valid key to load, got %v", err)
+	}
+	if key, err := loadKeys([]string{valid, valid}); err != nil || key == nil {
+		t.Errorf("expected valid keys to load, got %v", err)
+	}
+	if _, err := loadKeys([]string{garbage}); err == nil {
+		t.Error("expected an error for a garbage key")
+	}
+	if _, err := loadKeys([]string{valid, garbage}); err == nil {
+		t.Error("expected an error for a garbage second key")
+	}
+	if _, err := loadKeys([]string{filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
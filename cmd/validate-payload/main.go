@@ -0,0 +1,63 @@
+// validate-payload reports how the gateway would handle a captured webhook
+// delivery, without contacting Kubernetes or GitHub.
+//
+// Usage:
+//
+//	validate-payload -event push -body payload.json -secret s3cr3t -signature sha1=...
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/brigadecore/brigade-github-app/pkg/webhook"
+)
+
+func main() {
+	eventType := flag.String("event", "", "value of the X-GitHub-Event header")
+	bodyFile := flag.String("body", "", "path to a file containing the request body")
+	secret := flag.String("secret", "", "shared secret the delivery should be signed with")
+	signature := flag.String("signature", "", "value of the X-Hub-Signature header")
+	emitted := flag.String("events", "*", "events emitted by the gateway, separated by commas")
+	prefix := flag.String("event-prefix", "", "prefix the gateway adds to emitted event types")
+	flag.Parse()
+
+	if *eventType == "" || *bodyFile == "" {
+		fmt.Println("Error: -event and -body are required")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	body, err := ioutil.ReadFile(*bodyFile)
+	if err != nil {
+		fmt.Printf("Error: could not read body: %s\n", err)
+		os.Exit(1)
+	}
+
+	res, err := webhook.Inspect(
+		*eventType,
+		body,
+		*signature,
+		*secret,
+		webhook.GithubOpts{EmittedEvents: strings.Split(*emitted, ","), EventPrefix: *prefix},
+	)
+
+	fmt.Printf("signature valid: %t\n", res.SignatureValid)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(2)
+	}
+	fmt.Printf("parsed event:    %s\n", res.Event)
+	fmt.Printf("repo:            %s\n", res.Repo)
+	fmt.Printf("commit:          %s\n", res.Revision.Commit)
+	fmt.Printf("ref:             %s\n", res.Revision.Ref)
+	fmt.Printf("action:          %s\n", res.Action)
+	fmt.Printf("builds:          %s\n", strings.Join(res.Builds, ", "))
+
+	if !res.SignatureValid {
+		os.Exit(3)
+	}
+}
@@ -12,4 +12,5 @@ require (
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	gopkg.in/gin-gonic/gin.v1 v1.1.5-0.20170702092826-d459835d2b07
 	k8s.io/api v0.18.2
+	k8s.io/apimachinery v0.18.2
 )
@@ -0,0 +1,128 @@
+package check
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-github/v32/github"
+)
+
+// MaxAnnotations is the number of annotations GitHub accepts per request.
+const MaxAnnotations = 50
+
+// MediaType is the Accept header of checks API requests to GitHub Enterprise
+// Server. GitHub Enterprise Server before 2.22 only serves the checks API as a
+// preview, which needs "application/vnd.github.antiope-preview+json". Requests
+// to github.com always use the client's default media type.
+var MediaType = "application/vnd.github.v3+json"
+
+// CreateRun creates a check run on the given repository and returns it as
+// GitHub reports it.
+//
+// GitHub only accepts MaxAnnotations annotations at a time, so the run is
+// created with the first of them and the rest are added by updating the run as
+// many times as needed.
+func CreateRun(ctx context.Context, client *github.Client, owner, repo string, run Run) (*github.CheckRun, error) {
+	chunks := chunkAnnotations(run.Output.Annotations, MaxAnnotations)
+	if len(chunks) > 0 {
+		run.Output.Annotations = chunks[0]
+	}
+	created := &github.CheckRun{}
+	u := fmt.Sprintf("repos/%s/%s/check-runs", owner, repo)
+	if err := send(ctx, client, "POST", u, run, created); err != nil {
+		return nil, err
+	}
+	if len(chunks) < 2 {
+		return created, nil
+	}
+	u = fmt.Sprintf("repos/%s/%s/check-runs/%d", owner, repo, created.GetID())
+	return addAnnotations(ctx, client, u, run.Output, chunks[1:])
+}
+
+// UpdateRun updates the check run with the given ID, e.g. to complete a run
+// that was created in progress, and returns it as GitHub reports it. run is
+// the desired state of the run, including the required fields of its output.
+// Completed runs must have a conclusion.
+//
+// As with CreateRun, annotations are sent MaxAnnotations at a time.
+func UpdateRun(ctx context.Context, client *github.Client, owner, repo string, id int64, run Run) (*github.CheckRun, error) {
+	if id == 0 {
+		return nil, errors.New("check run ID is required")
+	}
+	if (run.Status == "completed" || run.CompletedAt != "") && run.Conclusion == "" {
+		return nil, errors.New("a conclusion is required to complete a check run")
+	}
+	chunks := chunkAnnotations(run.Output.Annotations, MaxAnnotations)
+	if len(chunks) > 0 {
+		run.Output.Annotations = chunks[0]
+	}
+	updated := &github.CheckRun{}
+	u := fmt.Sprintf("repos/%s/%s/check-runs/%d", owner, repo, id)
+	if err := send(ctx, client, "PATCH", u, run, updated); err != nil {
+		return nil, err
+	}
+	if len(chunks) < 2 {
+		return updated, nil
+	}
+	return addAnnotations(ctx, client, u, run.Output, chunks[1:])
+}
+
+// addAnnotations adds each chunk of annotations to the check run at u in turn,
+// returning the run as of the last update.
+func addAnnotations(ctx context.Context, client *github.Client, u string, output Output, chunks [][]Annotation) (*github.CheckRun, error) {
+	updated := &github.CheckRun{}
+	for _, chunk := range chunks {
+		// Title and summary are required whenever output is
+		update := struct {
+			Output Output `json:"output"`
+		}{
+			Output: Output{
+				Title:       output.Title,
+				Summary:     output.Summary,
+				Annotations: chunk,
+			},
+		}
+		if err := send(ctx, client, "PATCH", u, update, updated); err != nil {
+			return nil, err
+		}
+	}
+	return updated, nil
+}
+
+// chunkAnnotations splits annotations into chunks of at most size.
+func chunkAnnotations(annotations []Annotation, size int) [][]Annotation {
+	var chunks [][]Annotation
+	for len(annotations) > size {
+		chunks = append(chunks, annotations[:size])
+		annotations = annotations[size:]
+	}
+	if len(annotations) > 0 {
+		chunks = append(chunks, annotations)
+	}
+	return chunks
+}
+
+// mediaType returns the Accept header to send with client, or the empty string
+// to keep the client's default.
+func mediaType(client *github.Client) string {
+	if client.BaseURL.Host == "api.github.com" {
+		return ""
+	}
+	return MediaType
+}
+
+// send makes a request to the checks API, decoding the response into v.
+func send(ctx context.Context, client *github.Client, method, u string, body, v interface{}) error {
+	req, err := client.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+
+	if accept := mediaType(client); accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	_, err = client.Do(ctx, req, v)
+	return err
+}
@@ -0,0 +1,178 @@
+package check
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-github/v32/github"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient returns a client for a GitHub Enterprise API served by
+// handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *github.Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	client, err := github.NewEnterpriseClient(srv.URL, srv.URL, nil)
+	require.NoError(t, err)
+	return client
+}
+
+func TestCreateRun(t *testing.T) {
+	is := assert.New(t)
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		is.Equal("POST", r.Method)
+		is.Equal("/api/v3/repos/brigadecore/brigade/check-runs", r.URL.Path)
+		is.Equal(MediaType, r.Header.Get("Accept"))
+		run := &Run{}
+		is.NoError(json.NewDecoder(r.Body).Decode(run))
+		is.Equal("mighty_readme", run.Name)
+		is.Equal("ce587453ced02b1526dfb4cb910479d431683101", run.HeadSHA)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id": 4, "name": %q, "head_sha": %q, "status": "in_progress"}`, run.Name, run.HeadSHA)
+	})
+
+	run := NewRun("mighty_readme", "master", "ce587453ced02b1526dfb4cb910479d431683101")
+	run.Status = "in_progress"
+	cr, err := CreateRun(context.Background(), client, "brigadecore", "brigade", *run)
+	require.NoError(t, err)
+	is.Equal(int64(4), cr.GetID())
+	is.Equal("mighty_readme", cr.GetName())
+	is.Equal("in_progress", cr.GetStatus())
+}
+
+func TestCreateRun_annotations(t *testing.T) {
+	var requests []string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Output Output `json:"output"`
+		}{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		requests = append(requests, fmt.Sprintf("%s %s %d", r.Method, r.URL.Path, len(body.Output.Annotations)))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id": 4, "output": {"annotations_count": %d}}`, len(requests)*MaxAnnotations)
+	})
+
+	run := Run{Output: Output{Annotations: make([]Annotation, 125)}}
+	cr, err := CreateRun(context.Background(), client, "brigadecore", "brigade", run)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"POST /api/v3/repos/brigadecore/brigade/check-runs 50",
+		"PATCH /api/v3/repos/brigadecore/brigade/check-runs/4 50",
+		"PATCH /api/v3/repos/brigadecore/brigade/check-runs/4 25",
+	}, requests)
+	// The run is returned as of the last update
+	assert.Equal(t, 150, cr.GetOutput().GetAnnotationsCount())
+}
+
+func TestCreateRun_error(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"message": "Validation Failed"}`))
+	})
+
+	_, err := CreateRun(context.Background(), client, "brigadecore", "brigade", Run{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Validation Failed")
+}
+
+func TestUpdateRun(t *testing.T) {
+	is := assert.New(t)
+	var requests int
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		is.Equal("PATCH", r.Method)
+		is.Equal("/api/v3/repos/brigadecore/brigade/check-runs/4", r.URL.Path)
+		is.Equal(MediaType, r.Header.Get("Accept"))
+		run := &Run{}
+		is.NoError(json.NewDecoder(r.Body).Decode(run))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id": 4, "status": %q, "conclusion": %q}`, run.Status, run.Conclusion)
+	})
+
+	run := Run{
+		Name:        "mighty_readme",
+		Status:      "completed",
+		Conclusion:  "success",
+		CompletedAt: "2018-05-04T01:14:52Z",
+		Output:      Output{Title: "Mighty Readme report", Summary: "All good"},
+	}
+	cr, err := UpdateRun(context.Background(), client, "brigadecore", "brigade", 4, run)
+	require.NoError(t, err)
+	is.Equal("completed", cr.GetStatus())
+	is.Equal("success", cr.GetConclusion())
+
+	tests := []struct {
+		name string
+		id   int64
+		run  Run
+	}{
+		{
+			name: "no ID",
+			run:  run,
+		},
+		{
+			name: "completed without conclusion",
+			id:   4,
+			run:  Run{Status: "completed"},
+		},
+		{
+			name: "completed at without conclusion",
+			id:   4,
+			run:  Run{CompletedAt: "2018-05-04T01:14:52Z"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := UpdateRun(context.Background(), client, "brigadecore", "brigade", tt.id, tt.run)
+			assert.Error(t, err)
+		})
+	}
+	is.Equal(1, requests, "invalid updates should not be sent")
+}
+
+func TestChunkAnnotations(t *testing.T) {
+	annotations := make([]Annotation, 125)
+	for i := range annotations {
+		annotations[i].StartLine = i
+	}
+
+	chunks := chunkAnnotations(annotations, MaxAnnotations)
+	var sizes []int
+	next := 0
+	for _, chunk := range chunks {
+		sizes = append(sizes, len(chunk))
+		for _, a := range chunk {
+			require.Equal(t, next, a.StartLine)
+			next++
+		}
+	}
+	assert.Equal(t, []int{50, 50, 25}, sizes)
+	assert.Empty(t, chunkAnnotations(nil, MaxAnnotations))
+}
+
+func TestMediaType(t *testing.T) {
+	defer func(m string) { MediaType = m }(MediaType)
+	MediaType = "application/vnd.github.antiope-preview+json"
+
+	enterprise, err := github.NewEnterpriseClient("https://github.example.com", "https://github.example.com", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "application/vnd.github.antiope-preview+json", mediaType(enterprise))
+	assert.Equal(t, "", mediaType(github.NewClient(nil)))
+
+	var accept string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": 4}`))
+	})
+	_, err = CreateRun(context.Background(), client, "brigadecore", "brigade", Run{})
+	require.NoError(t, err)
+	assert.Equal(t, "application/vnd.github.antiope-preview+json", accept)
+}
@@ -2,12 +2,62 @@ package github
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
 
 	"github.com/google/go-github/v32/github"
 	"golang.org/x/oauth2"
 )
 
+// DefaultTimeout bounds each request made by the clients this package
+// creates, unless WithTimeout says otherwise, so that an unresponsive GitHub
+// API can't block callers indefinitely.
+const DefaultTimeout = 30 * time.Second
+
+// ClientOption configures a client created by this package.
+type ClientOption func(*clientConfig)
+
+// clientConfig is what ClientOptions configure.
+type clientConfig struct {
+	timeout time.Duration
+	rootCAs *x509.CertPool
+}
+
+// WithTimeout bounds each request made by the client to timeout instead of
+// DefaultTimeout. Zero means no timeout.
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(c *clientConfig) {
+		c.timeout = timeout
+	}
+}
+
+// WithRootCAs makes the client verify the GitHub API's certificate with pool
+// instead of the system certificate pool, e.g. for a GitHub Enterprise
+// instance that uses an internal CA.
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(c *clientConfig) {
+		c.rootCAs = pool
+	}
+}
+
+// LoadCAFile returns a certificate pool of the PEM encoded certificates in the
+// given file, for WithRootCAs.
+func LoadCAFile(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
 // NewClientFromBearerToken returns a new github.Client for the given baseURL,
 // uploadURL and bearer token. If baseURL is the empty string, the client will
 // be for github.com. Otherwise, the client will be one for GitHub Enterprise.
@@ -15,6 +65,7 @@ func NewClientFromBearerToken(
 	baseURL string,
 	uploadURL string,
 	token string,
+	opts ...ClientOption,
 ) (*github.Client, error) {
 	return newClient(
 		baseURL,
@@ -24,6 +75,7 @@ func NewClientFromBearerToken(
 				AccessToken: token,
 			},
 		),
+		opts...,
 	)
 }
 
@@ -35,6 +87,7 @@ func NewClientFromInstallationToken(
 	baseURL string,
 	uploadURL string,
 	token string,
+	opts ...ClientOption,
 ) (*github.Client, error) {
 	return newClient(
 		baseURL,
@@ -45,31 +98,36 @@ func NewClientFromInstallationToken(
 				AccessToken: token,
 			},
 		),
+		opts...,
 	)
 }
 
-// NewClientFromKeyPEM returns a new github.Client for the given baseURL,
-// uploadURL, appID, and installationID. It uses the provided ASCII-armored x509
-// certificate key to sign a JSON web token that is then exchanged for an
+// NewClientFromAppKey returns a new github.Client for the given baseURL,
+// uploadURL, appID, and installationID. It uses the app's private key to sign a
+// JSON web token that is then exchanged for an
 // installation token that will ultimately be used by the returned client. If
 // baseURL is the empty string, the client will be for github.com. Otherwise,
-// the client will be one for GitHub Enterprise.
-func NewClientFromKeyPEM(
+// the client will be one for GitHub Enterprise. The token is minted with ctx.
+func NewClientFromAppKey(
+	ctx context.Context,
 	baseURL string,
 	uploadURL string,
 	appID int64,
 	installationID int64,
-	keyPEM []byte,
+	key *AppKey,
+	opts ...ClientOption,
 ) (*github.Client, error) {
 	installationToken, _, err := GetInstallationToken(
+		ctx,
 		baseURL,
 		uploadURL,
 		appID,
 		installationID,
-		keyPEM,
+		key,
+		opts...,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to negotiate an installation token: %s", err)
+		return nil, fmt.Errorf("Failed to negotiate an installation token: %w", err)
 	}
 	return newClient(
 		baseURL,
@@ -80,20 +138,53 @@ func NewClientFromKeyPEM(
 				AccessToken: installationToken,
 			},
 		),
+		opts...,
 	)
 }
 
 // newClient returns a new github.Client for the given baseURL, uploadURL and
-// oauth2.TokenSource. If baseURL is the empty string, the client will be for
-// github.com. Otherwise, the client will be one for GitHub Enterprise.
+// oauth2.TokenSource, configured by opts. If baseURL is the empty string, the
+// client will be for github.com. Otherwise, the client will be one for GitHub
+// Enterprise.
 func newClient(
 	baseURL,
 	uploadURL string,
 	tokenSource oauth2.TokenSource,
+	opts ...ClientOption,
 ) (*github.Client, error) {
-	httpClient := oauth2.NewClient(context.Background(), tokenSource)
+	config := clientConfig{timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	// Without a token source, oauth2 returns the client in the context as is,
+	// so it must be a client of our own rather than http.DefaultClient
+	base := &http.Client{}
+	if config.rootCAs != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: config.rootCAs}
+		base.Transport = transport
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, base)
+	httpClient := oauth2.NewClient(ctx, tokenSource)
+	httpClient.Timeout = config.timeout
 	if baseURL == "" {
 		return github.NewClient(httpClient), nil
 	}
 	return github.NewEnterpriseClient(baseURL, uploadURL, httpClient)
 }
+
+// HookRanges returns the IP ranges, in CIDR notation, that GitHub sends
+// webhooks from, as published by its meta API. The meta API needs no
+// authentication. If baseURL is the empty string, the ranges of github.com are
+// returned. Otherwise, those of the GitHub Enterprise instance are.
+func HookRanges(ctx context.Context, baseURL, uploadURL string, opts ...ClientOption) ([]string, error) {
+	client, err := newClient(baseURL, uploadURL, nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	meta, _, err := client.APIMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return meta.Hooks, nil
+}
@@ -1,7 +1,15 @@
 package github
 
 import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -25,3 +33,77 @@ func TestNewClientFromInstallationToken(t *testing.T) {
 	require.Equal(t, baseURL, ghc.BaseURL.String())
 	require.Equal(t, uploadURL, ghc.UploadURL.String())
 }
+
+func TestNewClientTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	// Release the handler before the server waits for it to return
+	defer close(done)
+
+	ghc, err := NewClientFromBearerToken(srv.URL+"/", srv.URL+"/", testToken, WithTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+	start := time.Now()
+	_, _, err = ghc.Repositories.Get(context.Background(), "brigadecore", "brigade")
+	require.Error(t, err)
+	require.True(t, time.Since(start) < 5*time.Second, "request was not cut short")
+}
+
+func TestLoadCAFile(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"brigade"}`))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "ca")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	get := func(opts ...ClientOption) error {
+		ghc, err := NewClientFromBearerToken(srv.URL+"/", srv.URL+"/", testToken, opts...)
+		require.NoError(t, err)
+		_, _, err = ghc.Repositories.Get(context.Background(), "brigadecore", "brigade")
+		return err
+	}
+
+	// The test server's certificate isn't trusted by the system pool
+	require.Error(t, get())
+
+	caFile := filepath.Join(dir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(caFile, certPEM, 0600))
+	pool, err := LoadCAFile(caFile)
+	require.NoError(t, err)
+	require.NoError(t, get(WithRootCAs(pool)))
+	// Other clients still use the system pool
+	require.Error(t, get())
+
+	badFile := filepath.Join(dir, "bad.pem")
+	require.NoError(t, ioutil.WriteFile(badFile, []byte("not a cert"), 0600))
+	_, err = LoadCAFile(badFile)
+	require.Error(t, err)
+	_, err = LoadCAFile(filepath.Join(dir, "missing.pem"))
+	require.Error(t, err)
+}
+
+func TestHookRanges(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v3/meta", r.URL.Path)
+		require.Empty(t, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"hooks":["192.30.252.0/22","2620:112:3000::/44"]}`))
+	}))
+	defer srv.Close()
+
+	timeout := http.DefaultClient.Timeout
+	ranges, err := HookRanges(context.Background(), srv.URL, srv.URL, WithTimeout(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.30.252.0/22", "2620:112:3000::/44"}, ranges)
+	// The meta API needs no token, but the client is still our own
+	require.Equal(t, timeout, http.DefaultClient.Timeout)
+}
@@ -2,53 +2,137 @@ package github
 
 import (
 	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/google/go-github/v32/github"
+
+	"github.com/brigadecore/brigade-github-app/pkg/retry"
 )
 
 // GetInstallationToken returns an installation token and its expiry time for
-// the given baseURL, uploadURL, appID, and installationID. It uses the provided
-// ASCII-armored x509 certificate key to sign a JSON web token that is then
-// exchanged for the installation token. If baseURL is the empty string, the
+// the given baseURL, uploadURL, appID, and installationID. It uses the app's
+// private key to sign a JSON web token that is then exchanged for the
+// installation token. If baseURL is the empty string, the
 // client used in this process will be one for github.com. Otherwise, the client
 // will be one for GitHub Enterprise.
+//
+// The exchange, and any retries of it, end once ctx is done.
 func GetInstallationToken(
+	ctx context.Context,
 	baseURL string,
 	uploadURL string,
 	appID int64,
 	installationID int64,
-	keyPEM []byte,
+	key *AppKey,
+	opts ...ClientOption,
 ) (string, time.Time, error) {
-	// Construct a JSON web token to use as the bearer token to create a new
-	// client that we can use to, in turn, create the installation token.
-	jsonWebToken, err := getSignedJSONWebToken(appID, keyPEM)
-	if err != nil {
-		return "", time.Time{}, err
+	return GetScopedInstallationToken(
+		ctx,
+		baseURL,
+		uploadURL,
+		appID,
+		installationID,
+		key,
+		nil,
+		opts...,
+	)
+}
+
+// GetScopedInstallationToken is like GetInstallationToken, but the token is
+// restricted to the given permissions. If permissions is nil, the token has
+// all of the installation's permissions.
+//
+// If GitHub rejects the key as unauthorized and it was parsed with others by
+// ParseAppKeys, the next key is tried.
+func GetScopedInstallationToken(
+	ctx context.Context,
+	baseURL string,
+	uploadURL string,
+	appID int64,
+	installationID int64,
+	key *AppKey,
+	permissions *github.InstallationPermissions,
+	opts ...ClientOption,
+) (string, time.Time, error) {
+	for i := 1; ; i++ {
+		token, expires, err := mintInstallationToken(ctx, baseURL, uploadURL, appID, installationID, key, permissions, opts...)
+		if err == nil || key.next == nil || !isUnauthorized(err) {
+			return token, expires, err
+		}
+		log.Printf("App key %d of app %d was rejected by GitHub, trying the next", i, appID)
+		key = key.next
 	}
-	githubClient, err := NewClientFromBearerToken(baseURL, uploadURL, jsonWebToken)
+}
+
+// isUnauthorized reports whether GitHub refused a request because its
+// credentials were invalid.
+func isUnauthorized(err error) bool {
+	var res *github.ErrorResponse
+	return errors.As(err, &res) && res.Response != nil && res.Response.StatusCode == http.StatusUnauthorized
+}
+
+// mintInstallationToken exchanges a JSON web token signed with key for an
+// installation token.
+func mintInstallationToken(
+	ctx context.Context,
+	baseURL string,
+	uploadURL string,
+	appID int64,
+	installationID int64,
+	key *AppKey,
+	permissions *github.InstallationPermissions,
+	opts ...ClientOption,
+) (string, time.Time, error) {
+	githubClient, err := NewAppClient(baseURL, uploadURL, appID, key, opts...)
 	if err != nil {
 		return "", time.Time{}, err
 	}
-	installationToken, _, err := githubClient.Apps.CreateInstallationToken(
-		context.Background(),
-		installationID,
-		&github.InstallationTokenOptions{},
-	)
+	var installationToken *github.InstallationToken
+	err = retry.Do(ctx, func() error {
+		var err error
+		installationToken, _, err = githubClient.Apps.CreateInstallationToken(
+			ctx,
+			installationID,
+			&github.InstallationTokenOptions{Permissions: permissions},
+		)
+		return err
+	})
 	if err != nil {
 		return "", time.Time{}, err
 	}
 	return installationToken.GetToken(), installationToken.GetExpiresAt(), nil
 }
 
-// getSignedJSONWebToken constructs, signs, and returns a JSON web token.
-func getSignedJSONWebToken(appID int64, keyPEM []byte) (string, error) {
-	key, err := jwt.ParseRSAPrivateKeyFromPEM(keyPEM)
+// NewAppClient returns a new github.Client for the given baseURL and
+// uploadURL that is authenticated as the app itself rather than one of its
+// installations, as required to create installation tokens or look up
+// installations. It uses the app's private key to sign the JSON web token it
+// authenticates with.
+func NewAppClient(
+	baseURL string,
+	uploadURL string,
+	appID int64,
+	key *AppKey,
+	opts ...ClientOption,
+) (*github.Client, error) {
+	jsonWebToken, err := getSignedJSONWebToken(appID, key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return NewClientFromBearerToken(baseURL, uploadURL, jsonWebToken, opts...)
+}
+
+// getSignedJSONWebToken constructs, signs, and returns a JSON web token.
+func getSignedJSONWebToken(appID int64, key *AppKey) (string, error) {
 	now := time.Now()
 	return jwt.NewWithClaims(
 		jwt.SigningMethodRS256,
@@ -57,5 +141,75 @@ func getSignedJSONWebToken(appID int64, keyPEM []byte) (string, error) {
 			ExpiresAt: now.Add(5 * time.Minute).Unix(),
 			Issuer:    strconv.FormatInt(appID, 10),
 		},
-	).SignedString(key)
+	).SignedString(key.key)
+}
+
+// AppKey is a GitHub App's private key, parsed and ready to sign the JSON web
+// tokens the app authenticates with.
+type AppKey struct {
+	key *rsa.PrivateKey
+	// next is the key to mint installation tokens with if GitHub rejects
+	// this one, while the app's key is rotated
+	next *AppKey
+}
+
+// ParseAppKey parses an ASCII-armored (PEM) private key for a GitHub App.
+func ParseAppKey(keyPEM []byte) (*AppKey, error) {
+	key, err := parseSigningKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &AppKey{key: key}, nil
+}
+
+// ParseAppKeys parses several ASCII-armored (PEM) private keys of the same
+// GitHub App, so that its key can be rotated without downtime. JSON web tokens
+// are signed with the first key, but installation tokens are minted with the
+// next whenever GitHub rejects a key as unauthorized.
+func ParseAppKeys(keyPEMs ...[]byte) (*AppKey, error) {
+	if len(keyPEMs) == 0 {
+		return nil, errors.New("no keys given")
+	}
+	var first, last *AppKey
+	for i, keyPEM := range keyPEMs {
+		key, err := ParseAppKey(keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i+1, err)
+		}
+		if first == nil {
+			first = key
+		} else {
+			last.next = key
+		}
+		last = key
+	}
+	return first, nil
+}
+
+// parseSigningKey parses an ASCII-armored RSA private key. GitHub only
+// accepts JSON web tokens signed with RS256, so other keys are rejected here
+// rather than by GitHub when the first token is minted.
+func parseSigningKey(keyPEM []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("key must be PEM encoded")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return nil, errors.New("unsupported ECDSA key: GitHub only accepts RSA app keys")
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T: GitHub only accepts RSA app keys", key)
+	}
+	return rsaKey, nil
 }
@@ -0,0 +1,319 @@
+package github
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brigadecore/brigade-github-app/pkg/retry"
+)
+
+func TestGetInstallationToken_retry(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	appKey, err := ParseAppKey(keyPEM)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		responses []int
+		timeout   time.Duration
+		expectErr bool
+		expected  []time.Duration
+	}{
+		{
+			name:      "rate limited",
+			responses: []int{http.StatusForbidden, http.StatusCreated},
+			expected:  []time.Duration{7 * time.Second},
+		},
+		{
+			name:      "server errors",
+			responses: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusCreated},
+			expected:  []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			// Waiting would take us past the deadline
+			name:      "deadline",
+			responses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			expectErr: true,
+			expected:  []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		{
+			// Waiting would take us past the caller's deadline
+			name:      "caller deadline",
+			responses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			timeout:   3 * time.Second,
+			expectErr: true,
+			expected:  []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:      "not found",
+			responses: []int{http.StatusNotFound},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "/api/v3/app/installations/777777/access_tokens", r.URL.Path)
+				status := tt.responses[requests]
+				requests++
+				w.Header().Set("Content-Type", "application/json")
+				if status == http.StatusForbidden {
+					w.Header().Set("Retry-After", "7")
+				}
+				w.WriteHeader(status)
+				if status == http.StatusCreated {
+					w.Write([]byte(`{"token":"v1.testtoken","expires_at":"2030-01-01T00:00:00Z"}`))
+					return
+				}
+				w.Write([]byte(`{"message":"try again"}`))
+			}))
+			defer srv.Close()
+
+			var slept []time.Duration
+			defer func(s func(context.Context, time.Duration) error) { retry.Sleep = s }(retry.Sleep)
+			retry.Sleep = func(ctx context.Context, d time.Duration) error {
+				slept = append(slept, d)
+				return nil
+			}
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			token, _, err := GetInstallationToken(ctx, srv.URL, srv.URL, 12345, 777777, appKey)
+			if tt.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "v1.testtoken", token)
+			}
+			require.Equal(t, tt.expected, slept)
+		})
+	}
+}
+
+func TestGetInstallationToken_cancelled(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	appKey, err := ParseAppKey(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}))
+	require.NoError(t, err)
+
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	// The caller gave up, e.g. because GitHub closed the webhook request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = GetInstallationToken(ctx, srv.URL, srv.URL, 12345, 777777, appKey)
+	require.True(t, errors.Is(err, context.Canceled), "expected the context's error, got %v", err)
+	require.Zero(t, requests)
+}
+
+func TestGetInstallationToken_keyRotation(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	encode := func(key *rsa.PrivateKey) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	}
+
+	tests := []struct {
+		name             string
+		keys             [][]byte
+		expectErr        bool
+		expectedRequests int
+	}{
+		{
+			name:             "current key",
+			keys:             [][]byte{encode(newKey), encode(oldKey)},
+			expectedRequests: 1,
+		},
+		{
+			name:             "first key rejected",
+			keys:             [][]byte{encode(oldKey), encode(newKey)},
+			expectedRequests: 2,
+		},
+		{
+			name:             "all keys rejected",
+			keys:             [][]byte{encode(oldKey), encode(oldKey)},
+			expectErr:        true,
+			expectedRequests: 2,
+		},
+		{
+			name:             "single key rejected",
+			keys:             [][]byte{encode(oldKey)},
+			expectErr:        true,
+			expectedRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int
+			// GitHub only knows the new key
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.Header().Set("Content-Type", "application/json")
+				signed := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+				if _, err := jwt.Parse(signed, func(*jwt.Token) (interface{}, error) {
+					return &newKey.PublicKey, nil
+				}); err != nil {
+					w.WriteHeader(http.StatusUnauthorized)
+					w.Write([]byte(`{"message":"A JSON web token could not be decoded"}`))
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"token":"v1.testtoken","expires_at":"2030-01-01T00:00:00Z"}`))
+			}))
+			defer srv.Close()
+
+			appKey, err := ParseAppKeys(tt.keys...)
+			require.NoError(t, err)
+			token, _, err := GetInstallationToken(context.Background(), srv.URL, srv.URL, 12345, 777777, appKey)
+			if tt.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "v1.testtoken", token)
+			}
+			require.Equal(t, tt.expectedRequests, requests)
+		})
+	}
+}
+
+func TestParseAppKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	_, err = ParseAppKeys()
+	require.Error(t, err)
+	_, err = ParseAppKeys(keyPEM, []byte("not a key"))
+	require.Error(t, err)
+	appKey, err := ParseAppKeys(keyPEM, keyPEM)
+	require.NoError(t, err)
+	require.NotNil(t, appKey.next)
+	require.Nil(t, appKey.next.next)
+}
+
+func TestGetSignedJSONWebToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		block     *pem.Block
+		verifyKey interface{}
+		expectAlg string
+	}{
+		{
+			name:      "rsa",
+			block:     &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+			verifyKey: &rsaKey.PublicKey,
+			expectAlg: "RS256",
+		},
+		{
+			// GitHub only accepts RS256
+			name:  "ecdsa",
+			block: &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER},
+		},
+		{
+			name:  "unsupported key type",
+			block: &pem.Block{Type: "PRIVATE KEY", Bytes: edDER},
+		},
+		{
+			name:  "garbage",
+			block: &pem.Block{Type: "RSA PRIVATE KEY", Bytes: []byte("garbage")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParseAppKey(pem.EncodeToMemory(tt.block))
+			if tt.expectAlg == "" {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			signed, err := getSignedJSONWebToken(42, key)
+			require.NoError(t, err)
+			token, err := jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+				return tt.verifyKey, nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, tt.expectAlg, token.Method.Alg())
+		})
+	}
+}
+
+func BenchmarkGetSignedJSONWebToken(b *testing.B) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(b, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+	})
+
+	// Parsing the key for every token, as was done before keys were parsed
+	// once at startup
+	b.Run("parse per token", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			key, err := ParseAppKey(keyPEM)
+			require.NoError(b, err)
+			_, err = getSignedJSONWebToken(42, key)
+			require.NoError(b, err)
+		}
+	})
+
+	b.Run("parsed once", func(b *testing.B) {
+		key, err := ParseAppKey(keyPEM)
+		require.NoError(b, err)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, err := getSignedJSONWebToken(42, key)
+			require.NoError(b, err)
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v32/github"
+)
+
+// SplitRepoName splits a repository's full name, such as "org/repo", into its
+// owner and name. Names may be prefixed with the GitHub host, as in
+// "github.com/org/repo" or "ghe.example.com/org/repo", optionally with a
+// scheme, and trailing slashes are tolerated.
+func SplitRepoName(repo string) (string, string, error) {
+	name := strings.TrimSuffix(strings.TrimRight(repo, "/"), ".git")
+	if i := strings.Index(name, "://"); i >= 0 {
+		name = name[i+len("://"):]
+	}
+	parts := strings.Split(name, "/")
+	// Owners can't contain dots, so a first part with one is a host
+	if len(parts) == 3 && strings.Contains(parts[0], ".") {
+		parts = parts[1:]
+	}
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[0], ".") {
+		return "", "", fmt.Errorf("invalid repo name %q: should be ORG/NAME", repo)
+	}
+	return parts[0], parts[1], nil
+}
+
+// CommentOnIssue posts a comment with the given body on an issue or pull
+// request of the given repository.
+func CommentOnIssue(
+	ctx context.Context,
+	client *github.Client,
+	repo string,
+	number int,
+	body string,
+) error {
+	owner, name, err := SplitRepoName(repo)
+	if err != nil {
+		return err
+	}
+	if _, _, err := client.Issues.CreateComment(
+		ctx,
+		owner,
+		name,
+		number,
+		&github.IssueComment{Body: github.String(body)},
+	); err != nil {
+		return fmt.Errorf("failed to comment on %s#%d: %s", repo, number, err)
+	}
+	return nil
+}
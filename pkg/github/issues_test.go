@@ -0,0 +1,73 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitRepoName(t *testing.T) {
+	tests := []struct {
+		repo  string
+		owner string
+		name  string
+		err   bool
+	}{
+		{repo: "brigadecore/brigade", owner: "brigadecore", name: "brigade"},
+		{repo: "brigadecore/brigade/", owner: "brigadecore", name: "brigade"},
+		{repo: "github.com/brigadecore/brigade", owner: "brigadecore", name: "brigade"},
+		{repo: "github.com/brigadecore/brigade.git", owner: "brigadecore", name: "brigade"},
+		{repo: "https://github.com/brigadecore/brigade", owner: "brigadecore", name: "brigade"},
+		{repo: "ghe.example.com/brigadecore/brigade", owner: "brigadecore", name: "brigade"},
+		{repo: "example/brigadecore/brigade", err: true},
+		{repo: "github.com/brigadecore", err: true},
+		{repo: "brigadecore//brigade", err: true},
+		{repo: "brigade", err: true},
+		{repo: "/brigade", err: true},
+		{repo: "brigadecore/brigade/pkg", err: true},
+		{repo: "", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.repo, func(t *testing.T) {
+			owner, name, err := SplitRepoName(tt.repo)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.owner, owner)
+			require.Equal(t, tt.name, name)
+		})
+	}
+}
+
+func TestCommentOnIssue(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "POST", r.Method)
+		require.Equal(t, "/api/v3/repos/brigadecore/brigade/issues/42/comments", r.URL.Path)
+		comment := struct {
+			Body string `json:"body"`
+		}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&comment))
+		body = comment.Body
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":1}`))
+	}))
+	defer srv.Close()
+
+	ghc, err := NewClientFromInstallationToken(srv.URL, srv.URL, testToken)
+	require.NoError(t, err)
+
+	err = CommentOnIssue(context.Background(), ghc, "github.com/brigadecore/brigade", 42, "Build failed")
+	require.NoError(t, err)
+	require.Equal(t, "Build failed", body)
+
+	err = CommentOnIssue(context.Background(), ghc, "brigade", 42, "Build failed")
+	require.Error(t, err)
+}
@@ -0,0 +1,108 @@
+package github
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/brigadecore/brigade-github-app/pkg/retry"
+)
+
+// TokenRefreshMargin is how long before it expires a cached installation
+// token is replaced. Tokens are handed on to builds, so they must remain valid
+// for a while after they are served.
+const TokenRefreshMargin = 30 * time.Minute
+
+// Installation identifies an installation of a GitHub App.
+type Installation struct {
+	AppID          int64
+	InstallationID int64
+}
+
+// TokenCache caches installation tokens, so that a token is only minted for
+// an installation when there is none or the cached one is about to expire. It
+// is safe for concurrent use.
+type TokenCache struct {
+	key    *AppKey
+	opts   []ClientOption
+	mu     sync.Mutex
+	tokens map[tokenKey]cachedToken
+}
+
+type tokenKey struct {
+	baseURL string
+	Installation
+}
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+// NewTokenCache returns an empty cache of tokens minted with the given app
+// key, by clients configured with opts.
+func NewTokenCache(key *AppKey, opts ...ClientOption) *TokenCache {
+	return &TokenCache{key: key, opts: opts, tokens: map[tokenKey]cachedToken{}}
+}
+
+// Token is like GetInstallationToken, but returns the cached token for the
+// installation unless it expires within TokenRefreshMargin.
+func (c *TokenCache) Token(
+	ctx context.Context,
+	baseURL string,
+	uploadURL string,
+	appID int64,
+	installationID int64,
+) (string, time.Time, error) {
+	k := tokenKey{baseURL: baseURL, Installation: Installation{appID, installationID}}
+	c.mu.Lock()
+	cached, ok := c.tokens[k]
+	c.mu.Unlock()
+	if ok && time.Until(cached.expires) > TokenRefreshMargin {
+		return cached.token, cached.expires, nil
+	}
+	return c.refresh(ctx, k, uploadURL)
+}
+
+// Prewarm mints tokens for the given installations so that the first events
+// from them don't wait for one, then refreshes each in the background before
+// it would be replaced, until ctx is done. Failures are logged and retried a
+// minute later.
+func (c *TokenCache) Prewarm(ctx context.Context, baseURL, uploadURL string, installations []Installation) {
+	for _, inst := range installations {
+		k := tokenKey{baseURL: baseURL, Installation: inst}
+		next := c.warm(ctx, k, uploadURL)
+		go func() {
+			for retry.Sleep(ctx, next) == nil {
+				next = c.warm(ctx, k, uploadURL)
+			}
+		}()
+	}
+}
+
+// warm refreshes the token for k, returning how long to wait before
+// refreshing it again.
+func (c *TokenCache) warm(ctx context.Context, k tokenKey, uploadURL string) time.Duration {
+	_, expires, err := c.refresh(ctx, k, uploadURL)
+	if err != nil {
+		log.Printf("Failed to prewarm a token for installation %d of app %d: %s", k.InstallationID, k.AppID, err)
+		return time.Minute
+	}
+	if next := time.Until(expires) - TokenRefreshMargin; next > time.Minute {
+		return next
+	}
+	return time.Minute
+}
+
+// refresh mints a token for k and caches it.
+func (c *TokenCache) refresh(ctx context.Context, k tokenKey, uploadURL string) (string, time.Time, error) {
+	token, expires, err := GetInstallationToken(ctx, k.baseURL, uploadURL, k.AppID, k.InstallationID, c.key, c.opts...)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	c.mu.Lock()
+	c.tokens[k] = cachedToken{token: token, expires: expires}
+	c.mu.Unlock()
+	return token, expires, nil
+}
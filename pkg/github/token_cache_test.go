@@ -0,0 +1,100 @@
+package github
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTokenServer returns the URL of a GitHub API that mints tokens for
+// installation 777777 expiring after lifetime, and a count of the tokens it
+// minted.
+func newTokenServer(t *testing.T, lifetime time.Duration) (string, *int) {
+	var mints int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v3/app/installations/777777/access_tokens", r.URL.Path)
+		mints++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token":"v1.token%d","expires_at":%q}`, mints, time.Now().Add(lifetime).Format(time.RFC3339))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, &mints
+}
+
+func newTestAppKey(t *testing.T) *AppKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	appKey, err := ParseAppKey(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}))
+	require.NoError(t, err)
+	return appKey
+}
+
+func TestTokenCache(t *testing.T) {
+	key := newTestAppKey(t)
+
+	tests := []struct {
+		name          string
+		lifetime      time.Duration
+		expected      []string
+		expectedMints int
+	}{
+		{
+			name:          "cached",
+			lifetime:      time.Hour,
+			expected:      []string{"v1.token1", "v1.token1", "v1.token1"},
+			expectedMints: 1,
+		},
+		{
+			// Builds would get a token that expires too soon
+			name:          "expiring",
+			lifetime:      10 * time.Minute,
+			expected:      []string{"v1.token1", "v1.token2", "v1.token3"},
+			expectedMints: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, mints := newTokenServer(t, tt.lifetime)
+			cache := NewTokenCache(key)
+			var tokens []string
+			for range tt.expected {
+				token, _, err := cache.Token(context.Background(), u, u, 12345, 777777)
+				require.NoError(t, err)
+				tokens = append(tokens, token)
+			}
+			assert.Equal(t, tt.expected, tokens)
+			assert.Equal(t, tt.expectedMints, *mints)
+		})
+	}
+}
+
+func TestTokenCache_Prewarm(t *testing.T) {
+	u, mints := newTokenServer(t, time.Hour)
+	cache := NewTokenCache(newTestAppKey(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache.Prewarm(ctx, u, u, []Installation{{AppID: 12345, InstallationID: 777777}})
+	require.Equal(t, 1, *mints)
+
+	token, expires, err := cache.Token(context.Background(), u, u, 12345, 777777)
+	require.NoError(t, err)
+	assert.Equal(t, "v1.token1", token)
+	assert.True(t, time.Until(expires) > TokenRefreshMargin)
+	assert.Equal(t, 1, *mints, "a prewarmed token should be served without minting another")
+}
@@ -0,0 +1,143 @@
+// Package retry retries operations against GitHub and Kubernetes that fail
+// because the service is throttling requests or is temporarily unavailable.
+package retry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Deadline bounds the total time Do spends on an operation, attempts included,
+// unless its context has an earlier deadline. GitHub gives up on a webhook
+// delivery after 10 seconds, so it is kept below that, and handlers share one
+// such deadline between all the operations of a delivery to leave time to
+// respond.
+var Deadline = 8 * time.Second
+
+// Sleep waits for d, or until ctx is done. It is replaced in tests.
+var Sleep = func(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ExhaustedError is returned by Do when an operation still fails with a
+// retryable error, but waiting to retry it would take past Deadline or the
+// deadline of its context.
+type ExhaustedError struct {
+	// Err is the last error the operation failed with
+	Err error
+	// RetryAfter is how long to wait before trying again
+	RetryAfter time.Duration
+}
+
+func (e *ExhaustedError) Error() string {
+	return fmt.Sprintf("giving up after retrying: %s", e.Err)
+}
+
+// Unwrap returns the last error the operation failed with.
+func (e *ExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+// Do calls fn until it succeeds, fails with an error that isn't retryable or
+// ctx is done. Between attempts, it waits for as long as the error asks, or
+// else backs off exponentially from a second. If waiting would take past
+// Deadline from now, or past the deadline of ctx, an ExhaustedError is
+// returned.
+func Do(ctx context.Context, fn func() error) error {
+	deadline := time.Now().Add(Deadline)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		retryable, delay := Classify(err)
+		if !retryable {
+			return err
+		}
+		if delay <= 0 {
+			delay = time.Second << uint(attempt)
+		}
+		if time.Until(deadline) < delay {
+			return &ExhaustedError{Err: err, RetryAfter: delay}
+		}
+		if err := Sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// Classify reports whether an operation that failed with err may succeed if
+// retried, and how long to wait before doing so if the error says.
+//
+// Rate limits, server errors and timeouts from GitHub and Kubernetes are
+// retryable. A 403 from GitHub is only retryable if it is a rate limit.
+func Classify(err error) (bool, time.Duration) {
+	switch e := err.(type) {
+	case *github.RateLimitError:
+		return true, time.Until(e.Rate.Reset.Time)
+	case *github.AbuseRateLimitError:
+		return true, e.GetRetryAfter()
+	case *github.ErrorResponse:
+		if e.Response == nil {
+			return false, 0
+		}
+		after := retryAfter(e.Response)
+		switch code := e.Response.StatusCode; {
+		case code == http.StatusForbidden:
+			// A 403 is only a rate limit if GitHub says when to come back
+			return after > 0, after
+		case code == http.StatusTooManyRequests, code >= http.StatusInternalServerError:
+			return true, after
+		}
+		return false, 0
+	}
+	if apierrors.IsTooManyRequests(err) || apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) || apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsInternalError(err) {
+		secs, _ := apierrors.SuggestsClientDelay(err)
+		return true, time.Duration(secs) * time.Second
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return true, 0
+	}
+	return false, 0
+}
+
+// IsThrottled reports whether err means the service is rate limiting us, as
+// opposed to being unavailable.
+func IsThrottled(err error) bool {
+	switch e := err.(type) {
+	case *github.RateLimitError, *github.AbuseRateLimitError:
+		return true
+	case *github.ErrorResponse:
+		return e.Response != nil && (e.Response.StatusCode == http.StatusTooManyRequests ||
+			e.Response.StatusCode == http.StatusForbidden && retryAfter(e.Response) > 0)
+	}
+	return apierrors.IsTooManyRequests(err)
+}
+
+// retryAfter returns the delay in the Retry-After header of res, if any.
+func retryAfter(res *http.Response) time.Duration {
+	secs, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
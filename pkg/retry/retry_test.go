@@ -0,0 +1,225 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func githubError(status int, retryAfter string) *github.ErrorResponse {
+	res := &http.Response{StatusCode: status, Header: http.Header{}}
+	if retryAfter != "" {
+		res.Header.Set("Retry-After", retryAfter)
+	}
+	return &github.ErrorResponse{Response: res, Message: http.StatusText(status)}
+}
+
+func TestClassify(t *testing.T) {
+	secrets := schema.GroupResource{Resource: "secrets"}
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+		after     time.Duration
+		throttled bool
+	}{
+		{
+			name:      "github rate limit",
+			err:       &github.RateLimitError{Rate: github.Rate{Reset: github.Timestamp{Time: time.Now().Add(time.Minute)}}},
+			retryable: true,
+			throttled: true,
+		},
+		{
+			name:      "github abuse rate limit",
+			err:       &github.AbuseRateLimitError{RetryAfter: durationPtr(7 * time.Second)},
+			retryable: true,
+			after:     7 * time.Second,
+			throttled: true,
+		},
+		{
+			name:      "github 403 with Retry-After",
+			err:       githubError(http.StatusForbidden, "7"),
+			retryable: true,
+			after:     7 * time.Second,
+			throttled: true,
+		},
+		{
+			name: "github 403",
+			err:  githubError(http.StatusForbidden, ""),
+		},
+		{
+			name:      "github 429",
+			err:       githubError(http.StatusTooManyRequests, "3"),
+			retryable: true,
+			after:     3 * time.Second,
+			throttled: true,
+		},
+		{
+			name:      "github 502",
+			err:       githubError(http.StatusBadGateway, ""),
+			retryable: true,
+		},
+		{
+			name: "github 404",
+			err:  githubError(http.StatusNotFound, ""),
+		},
+		{
+			name: "github 422",
+			err:  githubError(http.StatusUnprocessableEntity, ""),
+		},
+		{
+			name:      "kubernetes too many requests",
+			err:       apierrors.NewTooManyRequests("slow down", 5),
+			retryable: true,
+			after:     5 * time.Second,
+			throttled: true,
+		},
+		{
+			name:      "kubernetes server timeout",
+			err:       apierrors.NewServerTimeout(secrets, "create", 2),
+			retryable: true,
+			after:     2 * time.Second,
+		},
+		{
+			name:      "kubernetes unavailable",
+			err:       apierrors.NewServiceUnavailable("etcd is down"),
+			retryable: true,
+		},
+		{
+			name:      "kubernetes internal error",
+			err:       apierrors.NewInternalError(errors.New("boom")),
+			retryable: true,
+		},
+		{
+			name: "kubernetes not found",
+			err:  apierrors.NewNotFound(secrets, "brigade-1234"),
+		},
+		{
+			name: "kubernetes already exists",
+			err:  apierrors.NewAlreadyExists(secrets, "brigade-1234"),
+		},
+		{
+			name:      "network timeout",
+			err:       &net.OpError{Op: "dial", Err: timeoutError{}},
+			retryable: true,
+		},
+		{
+			name: "canceled",
+			err:  context.Canceled,
+		},
+		{
+			name: "other",
+			err:  errors.New("invalid key"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryable, after := Classify(tt.err)
+			require.Equal(t, tt.retryable, retryable)
+			if _, ok := tt.err.(*github.RateLimitError); ok {
+				// Waits until the reset
+				require.True(t, after > 50*time.Second, "expected to wait for the reset, got %s", after)
+			} else {
+				require.Equal(t, tt.after, after)
+			}
+			require.Equal(t, tt.throttled, IsThrottled(tt.err))
+		})
+	}
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestDo(t *testing.T) {
+	defer func(s func(context.Context, time.Duration) error) { Sleep = s }(Sleep)
+	var slept []time.Duration
+	Sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return ctx.Err()
+	}
+
+	tests := []struct {
+		name          string
+		errs          []error
+		expectErr     error
+		expectedSleep []time.Duration
+	}{
+		{
+			name: "success",
+		},
+		{
+			name:          "retried",
+			errs:          []error{githubError(http.StatusBadGateway, ""), githubError(http.StatusForbidden, "7")},
+			expectedSleep: []time.Duration{time.Second, 7 * time.Second},
+		},
+		{
+			name:      "not retryable",
+			errs:      []error{githubError(http.StatusNotFound, "")},
+			expectErr: githubError(http.StatusNotFound, ""),
+		},
+		{
+			// Waiting would take us past the deadline
+			name: "exhausted",
+			errs: []error{
+				githubError(http.StatusBadGateway, ""),
+				githubError(http.StatusBadGateway, ""),
+				githubError(http.StatusBadGateway, ""),
+				githubError(http.StatusServiceUnavailable, ""),
+			},
+			expectErr:     &ExhaustedError{Err: githubError(http.StatusServiceUnavailable, ""), RetryAfter: 8 * time.Second},
+			expectedSleep: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slept = nil
+			attempts := 0
+			err := Do(context.Background(), func() error {
+				attempts++
+				if attempts > len(tt.errs) {
+					return nil
+				}
+				return tt.errs[attempts-1]
+			})
+			require.Equal(t, tt.expectErr, err)
+			require.Equal(t, tt.expectedSleep, slept)
+		})
+	}
+
+	t.Run("slow attempts", func(t *testing.T) {
+		// The time spent on attempts counts against the deadline too
+		slept = nil
+		ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+		defer cancel()
+		err := Do(ctx, func() error {
+			time.Sleep(600 * time.Millisecond)
+			return githubError(http.StatusBadGateway, "")
+		})
+		require.Equal(t, &ExhaustedError{Err: githubError(http.StatusBadGateway, ""), RetryAfter: time.Second}, err)
+		require.Empty(t, slept)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := Do(ctx, func() error { return githubError(http.StatusBadGateway, "") })
+		require.Equal(t, context.Canceled, err)
+	})
+}
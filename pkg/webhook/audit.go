@@ -0,0 +1,71 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Authorization decisions recorded in the audit log.
+const (
+	// AuditSignature is the validation of a delivery's webhook signature
+	AuditSignature = "signature"
+	// AuditAuthor is the check of a pull request or comment author's
+	// association against the allowed authors
+	AuditAuthor = "author"
+	// AuditToken is the minting of an installation token
+	AuditToken = "token"
+)
+
+// Outcomes of authorization decisions.
+const (
+	AuditAllowed = "allowed"
+	AuditDenied  = "denied"
+	// AuditFailed means the decision couldn't be made, e.g. because GitHub
+	// refused to mint a token
+	AuditFailed = "failed"
+)
+
+// AuditEntry is one line of the audit log. It never contains secrets such as
+// signatures or tokens.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Decision string    `json:"decision"`
+	Outcome  string    `json:"outcome"`
+	Repo     string    `json:"repo,omitempty"`
+	// Delivery is the GitHub delivery ID, where the decision is made for a
+	// delivery
+	Delivery string `json:"delivery,omitempty"`
+	// Installation is the app installation a token was minted for
+	Installation int64 `json:"installation,omitempty"`
+	// Reason says why the outcome was reached, e.g. the author association
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditLogger writes an AuditEntry per authorization decision as a line of
+// JSON, separately from the gateway's log. It is safe for concurrent use. A
+// nil *AuditLogger records nothing.
+type AuditLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewAuditLogger returns an AuditLogger writing to w.
+func NewAuditLogger(w io.Writer) *AuditLogger {
+	return &AuditLogger{enc: json.NewEncoder(w)}
+}
+
+// record writes entry, timestamped now.
+func (a *AuditLogger) record(entry AuditEntry) {
+	if a == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(entry); err != nil {
+		log.Printf("Failed to write audit log: %s", err)
+	}
+}
@@ -0,0 +1,124 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+func TestGithubHandler_auditLog(t *testing.T) {
+	srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+		"POST /app/installations/777777/access_tokens": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"token":"v1.secrettoken","expires_at":"2030-01-01T00:00:00Z"}`))
+		},
+	})
+
+	tests := []struct {
+		name        string
+		event       string
+		payloadFile string
+		secret      string
+		forkPolicy  ForkSecretPolicy
+		expected    []AuditEntry
+	}{
+		{
+			name:        "valid signature",
+			event:       "push",
+			payloadFile: "testdata/github-push-payload.json",
+			secret:      "asdf",
+			expected: []AuditEntry{
+				{Decision: AuditSignature, Outcome: AuditAllowed, Repo: "baxterthehacker/public-repo"},
+			},
+		},
+		{
+			name:        "invalid signature",
+			event:       "push",
+			payloadFile: "testdata/github-push-payload.json",
+			secret:      "wrong",
+			expected: []AuditEntry{
+				{Decision: AuditSignature, Outcome: AuditDenied, Repo: "baxterthehacker/public-repo", Reason: "signature does not match"},
+			},
+		},
+		{
+			name:        "disallowed author",
+			event:       "pull_request",
+			payloadFile: "testdata/github-pull_request-payload-failed-perms.json",
+			secret:      "asdf",
+			expected: []AuditEntry{
+				{Decision: AuditAuthor, Outcome: AuditDenied, Repo: "baxterthehacker/public-repo", Reason: "NONE"},
+			},
+		},
+		{
+			name:        "token",
+			event:       "check_run",
+			payloadFile: "testdata/github-check_run-pull_request-payload.json",
+			secret:      "asdf",
+			expected: []AuditEntry{
+				{Decision: AuditSignature, Outcome: AuditAllowed, Repo: "technosophos/-whale-eyes-"},
+				{Decision: AuditToken, Outcome: AuditAllowed, Repo: "baxterthehacker/public-repo", Installation: 777777},
+			},
+		},
+		{
+			name:        "token withheld from fork",
+			event:       "check_run",
+			payloadFile: "testdata/github-check_run-fork_pull_request-payload.json",
+			secret:      "asdf",
+			forkPolicy:  ForkSecretsNone,
+			expected: []AuditEntry{
+				{Decision: AuditSignature, Outcome: AuditAllowed, Repo: "technosophos/-whale-eyes-"},
+				{Decision: AuditToken, Outcome: AuditDenied, Repo: "baxterthehacker/public-repo", Installation: 777777, Reason: "fork secret policy is none"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			store := newTestStore()
+			store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+			s := newTestGithubHandler(store, t)
+			s.key = newTestKey(t)
+			s.opts.AppID = 12345
+			s.opts.ForkSecretPolicy = tt.forkPolicy
+			s.opts.AuditLog = NewAuditLogger(&buf)
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+			serveTestEvent(t, s, tt.event, tt.secret, payload)
+
+			if strings.Contains(buf.String(), "secrettoken") || strings.Contains(buf.String(), "sha1=") {
+				t.Fatalf("expected no secrets in the audit log, got %s", buf.String())
+			}
+			var entries []AuditEntry
+			dec := json.NewDecoder(&buf)
+			for dec.More() {
+				var entry AuditEntry
+				if err := dec.Decode(&entry); err != nil {
+					t.Fatalf("failed to decode audit log: %s", err)
+				}
+				if entry.Time.IsZero() {
+					t.Errorf("expected a timestamp on %+v", entry)
+				}
+				entries = append(entries, entry)
+			}
+			if len(entries) != len(tt.expected) {
+				t.Fatalf("expected %d audit entries, got %d: %+v", len(tt.expected), len(entries), entries)
+			}
+			for i, expected := range tt.expected {
+				expected.Time = entries[i].Time
+				if entries[i] != expected {
+					t.Errorf("expected entry %d to be %+v, got %+v", i, expected, entries[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,529 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-github/v32/github"
+	gin "gopkg.in/gin-gonic/gin.v1"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+
+	ghlib "github.com/brigadecore/brigade-github-app/pkg/github"
+	"github.com/brigadecore/brigade-github-app/pkg/webhook/webhooktest"
+)
+
+func TestGithubHandler_check(t *testing.T) {
+	tests := []struct {
+		name           string
+		event          string
+		payloadFile    string
+		appID          int
+		edit           func(interface{})
+		expectedBuilds []string
+		// expectedConclusion is the conclusion passed to the builds
+		expectedConclusion string
+	}{
+		{
+			name:           "check suite",
+			event:          "check_suite",
+			payloadFile:    "testdata/github-check_suite-payload.json",
+			appID:          12345,
+			expectedBuilds: []string{"check_suite", "check_suite:requested"},
+		},
+		{
+			name:               "completed check suite",
+			event:              "check_suite",
+			payloadFile:        "testdata/github-check_suite-completed-payload.json",
+			appID:              12345,
+			expectedBuilds:     []string{"check_suite", "check_suite:completed"},
+			expectedConclusion: "failure",
+		},
+		{
+			name:        "check suite for another app",
+			event:       "check_suite",
+			payloadFile: "testdata/github-check_suite-payload.json",
+			appID:       54321,
+		},
+		{
+			name:           "check run",
+			event:          "check_run",
+			payloadFile:    "testdata/github-check_run-payload.json",
+			appID:          12345,
+			expectedBuilds: []string{"check_run", "check_run:rerequested"},
+		},
+		{
+			// The app is taken from the check suite if the run doesn't name one
+			name:        "check run without app",
+			event:       "check_run",
+			payloadFile: "testdata/github-check_run-payload.json",
+			appID:       12345,
+			edit: func(e interface{}) {
+				e.(*github.CheckRunEvent).CheckRun.App = nil
+			},
+			expectedBuilds: []string{"check_run", "check_run:rerequested"},
+		},
+	}
+
+	srv := newTestGithubServer(t, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+			s := newTestGithubHandler(store, t)
+			s.key = newTestKey(t)
+			s.opts.AppID = tt.appID
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+			if tt.edit != nil {
+				event, err := github.ParseWebHook(tt.event, payload)
+				if err != nil {
+					t.Fatalf("failed to parse payload: %s", err)
+				}
+				tt.edit(event)
+				if payload, err = json.Marshal(event); err != nil {
+					t.Fatalf("failed to encode payload: %s", err)
+				}
+			}
+
+			w := serveTestEvent(t, s, tt.event, "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+
+			var builds []string
+			for _, b := range store.builds {
+				builds = append(builds, b.Type)
+			}
+			if !reflect.DeepEqual(builds, tt.expectedBuilds) {
+				t.Fatalf("expected builds %v, got %v", tt.expectedBuilds, builds)
+			}
+			for _, b := range store.builds {
+				res := &Payload{}
+				if err := json.Unmarshal(b.Payload, res); err != nil {
+					t.Fatalf("failed to decode payload: %s", err)
+				}
+				if res.Conclusion != tt.expectedConclusion {
+					t.Errorf("%s: expected conclusion %q, got %q", b.Type, tt.expectedConclusion, res.Conclusion)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckPullRequest(t *testing.T) {
+	tests := []struct {
+		event       string
+		payloadFile string
+		number      int
+		baseRef     string
+	}{
+		{"check_suite", "testdata/github-check_suite-payload.json", 0, ""},
+		{"check_run", "testdata/github-check_run-payload.json", 0, ""},
+		{"check_run", "testdata/github-check_run-pull_request-payload.json", 7, "master"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.payloadFile, func(t *testing.T) {
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+			event, err := github.ParseWebHook(tt.event, payload)
+			if err != nil {
+				t.Fatalf("failed to parse payload: %s", err)
+			}
+			number, baseRef := checkPullRequest(event)
+			if number != tt.number || baseRef != tt.baseRef {
+				t.Errorf("expected #%d against %q, got #%d against %q", tt.number, tt.baseRef, number, baseRef)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_routeParams(t *testing.T) {
+	tests := []struct {
+		name           string
+		app, inst      string
+		secret         string
+		expectedStatus int
+		expectedCode   ErrorCode
+		expectedBuilds int
+	}{
+		{
+			name:           "matching",
+			app:            "12345",
+			inst:           "777777",
+			expectedStatus: http.StatusOK,
+			expectedBuilds: 2,
+		},
+		{
+			name:           "other installation",
+			app:            "12345",
+			inst:           "888888",
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   CodeRouteMismatch,
+		},
+		{
+			name:           "other app",
+			app:            "54321",
+			inst:           "777777",
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   CodeRouteMismatch,
+		},
+		{
+			// Routes are only compared once the signature is validated
+			name:           "forged",
+			app:            "12345",
+			inst:           "888888",
+			secret:         "forged",
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   CodeSignatureInvalid,
+		},
+	}
+
+	srv := newTestGithubServer(t, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+			s := newTestGithubHandler(store, t)
+			s.key = newTestKey(t)
+			s.opts.AppID = 12345
+
+			payload, err := ioutil.ReadFile("testdata/github-check_suite-payload.json")
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			secret := tt.secret
+			if secret == "" {
+				secret = "asdf"
+			}
+			w := httptest.NewRecorder()
+			r, err := webhooktest.NewSignedRequest("check_suite", secret, payload)
+			if err != nil {
+				t.Fatalf("failed to create request: %s", err)
+			}
+			r.URL.Path = "/events/github/" + tt.app + "/" + tt.inst
+
+			router := gin.New()
+			router.POST("/events/github/:app/:inst", s.Handle)
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if len(store.builds) != tt.expectedBuilds {
+				t.Fatalf("expected %d builds, got %d", tt.expectedBuilds, len(store.builds))
+			}
+			if tt.expectedCode == "" {
+				return
+			}
+			var res struct {
+				Code ErrorCode
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("failed to decode response %q: %s", w.Body.String(), err)
+			}
+			if res.Code != tt.expectedCode {
+				t.Errorf("expected code %q, got %q", tt.expectedCode, res.Code)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_forkSecretPolicy(t *testing.T) {
+	tests := []struct {
+		policy        ForkSecretPolicy
+		payloadFile   string
+		expectedToken string
+	}{
+		{"", "testdata/github-check_run-fork_pull_request-payload.json", "v1.full"},
+		{ForkSecretsFull, "testdata/github-check_run-fork_pull_request-payload.json", "v1.full"},
+		{ForkSecretsLimited, "testdata/github-check_run-fork_pull_request-payload.json", "v1.limited"},
+		{ForkSecretsNone, "testdata/github-check_run-fork_pull_request-payload.json", ""},
+		// The policy doesn't apply to pull requests from the repo itself
+		{ForkSecretsNone, "testdata/github-check_run-pull_request-payload.json", "v1.full"},
+	}
+
+	// The token tells whether permissions were requested
+	srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+		"POST /app/installations/777777/access_tokens": func(w http.ResponseWriter, r *http.Request) {
+			opts := github.InstallationTokenOptions{}
+			if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+				t.Errorf("failed to decode token request: %s", err)
+			}
+			token := "v1.full"
+			if opts.Permissions != nil {
+				if opts.Permissions.GetContents() != "read" {
+					t.Errorf("expected read-only contents, got %q", opts.Permissions.GetContents())
+				}
+				token = "v1.limited"
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"token":"` + token + `","expires_at":"2030-01-01T00:00:00Z"}`))
+		},
+	})
+	for _, tt := range tests {
+		t.Run(string(tt.policy)+"/"+tt.payloadFile, func(t *testing.T) {
+			store := newTestStore()
+			store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+			s := newTestGithubHandler(store, t)
+			s.key = newTestKey(t)
+			s.opts.AppID = 12345
+			s.opts.ForkSecretPolicy = tt.policy
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, "check_run", "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) == 0 {
+				t.Fatal("expected builds to be created")
+			}
+			for _, b := range store.builds {
+				var pl Payload
+				if err := json.Unmarshal(b.Payload, &pl); err != nil {
+					t.Fatalf("failed to decode payload: %s", err)
+				}
+				if pl.Token != tt.expectedToken {
+					t.Errorf("%s: expected token %q, got %q", b.Type, tt.expectedToken, pl.Token)
+				}
+			}
+		})
+	}
+}
+
+func TestGithubHandler_prewarmedToken(t *testing.T) {
+	var mints int
+	srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+		"POST /app/installations/777777/access_tokens": func(w http.ResponseWriter, r *http.Request) {
+			mints++
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"token":"v1.prewarmed","expires_at":"2030-01-01T00:00:00Z"}`))
+		},
+	})
+	store := newTestStore()
+	store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+	s := newTestGithubHandler(store, t)
+	s.key = newTestKey(t)
+	s.opts.AppID = 12345
+	s.opts.TokenCache = ghlib.NewTokenCache(s.key)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.opts.TokenCache.Prewarm(ctx, srv.URL, srv.URL, []ghlib.Installation{{AppID: 12345, InstallationID: 777777}})
+	if mints != 1 {
+		t.Fatalf("expected the token to be minted once when prewarming, got %d", mints)
+	}
+
+	payload, err := ioutil.ReadFile("testdata/github-check_run-pull_request-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+	w := serveTestEvent(t, s, "check_run", "asdf", payload)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+	}
+	if mints != 1 {
+		t.Errorf("expected the prewarmed token to be served without minting, got %d mints", mints)
+	}
+	for _, b := range store.builds {
+		var pl Payload
+		if err := json.Unmarshal(b.Payload, &pl); err != nil {
+			t.Fatalf("failed to decode payload: %s", err)
+		}
+		if pl.Token != "v1.prewarmed" {
+			t.Errorf("%s: expected the prewarmed token, got %q", b.Type, pl.Token)
+		}
+	}
+}
+
+// fakeChecks records the check suites rerequested through it.
+type fakeChecks struct {
+	createStatus int
+	existing     []*github.CheckSuite
+	rerequested  []int64
+}
+
+func (f *fakeChecks) CreateCheckSuite(ctx context.Context, owner, repo string, opts github.CreateCheckSuiteOptions) (*github.CheckSuite, *github.Response, error) {
+	res := &github.Response{Response: &http.Response{StatusCode: f.createStatus}}
+	if f.createStatus != http.StatusCreated {
+		return nil, res, fmt.Errorf("status %d", f.createStatus)
+	}
+	return &github.CheckSuite{ID: github.Int64(5)}, res, nil
+}
+
+func (f *fakeChecks) ListCheckSuitesForRef(ctx context.Context, owner, repo, ref string, opts *github.ListCheckSuiteOptions) (*github.ListCheckSuiteResults, *github.Response, error) {
+	return &github.ListCheckSuiteResults{
+		Total:       github.Int(len(f.existing)),
+		CheckSuites: f.existing,
+	}, nil, nil
+}
+
+func (f *fakeChecks) ReRequestCheckSuite(ctx context.Context, owner, repo string, checkSuiteID int64) (*github.Response, error) {
+	f.rerequested = append(f.rerequested, checkSuiteID)
+	return nil, nil
+}
+
+func TestCreateOrRerequestCheckSuite(t *testing.T) {
+	tests := []struct {
+		name                string
+		client              *fakeChecks
+		expectErr           bool
+		expectedRerequested []int64
+	}{
+		{
+			name:                "created",
+			client:              &fakeChecks{createStatus: http.StatusCreated},
+			expectedRerequested: []int64{5},
+		},
+		{
+			name: "already exists",
+			client: &fakeChecks{
+				createStatus: http.StatusUnprocessableEntity,
+				existing:     []*github.CheckSuite{{ID: github.Int64(9)}, {ID: github.Int64(8)}},
+			},
+			expectedRerequested: []int64{9},
+		},
+		{
+			// Nothing to rerequest, but that isn't worth failing over
+			name:   "already exists but not listed",
+			client: &fakeChecks{createStatus: http.StatusUnprocessableEntity},
+		},
+		{
+			name:      "failed",
+			client:    &fakeChecks{createStatus: http.StatusInternalServerError},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := createOrRerequestCheckSuite(
+				context.Background(),
+				tt.client,
+				"baxterthehacker",
+				"public-repo",
+				"0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+				"refs/pull/1/head",
+				12345,
+			)
+			if tt.expectErr != (err != nil) {
+				t.Fatalf("expected error: %t, got %v", tt.expectErr, err)
+			}
+			if !reflect.DeepEqual(tt.client.rerequested, tt.expectedRerequested) {
+				t.Errorf("expected suites %v to be rerequested, got %v", tt.expectedRerequested, tt.client.rerequested)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_checkSuiteOnPR(t *testing.T) {
+	tests := []struct {
+		name             string
+		gatewaySetting   bool
+		projectSetting   interface{}
+		expectCheckSuite bool
+	}{
+		{"gateway enabled", true, nil, true},
+		{"gateway disabled", false, nil, false},
+		{"project disabled", true, "false", false},
+		{"project enabled", false, "true", true},
+		{"project invalid", true, "nope", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requested bool
+			srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+				"POST /repos/baxterthehacker/public-repo/check-suites": func(w http.ResponseWriter, r *http.Request) {
+					requested = true
+					w.WriteHeader(http.StatusCreated)
+					w.Write([]byte(`{"id":5}`))
+				},
+				"POST /repos/baxterthehacker/public-repo/check-suites/5/rerequest": func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusCreated)
+				},
+			})
+			store := newTestStore()
+			store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+			if tt.projectSetting != nil {
+				store.proj.Secrets = brigade.SecretsMap{checkSuiteOnPRSecret: tt.projectSetting}
+			}
+			s := newTestGithubHandler(store, t)
+			s.key = newTestKey(t)
+			s.opts.AppID = 12345
+			s.opts.CheckSuiteOnPR = tt.gatewaySetting
+
+			payload, err := ioutil.ReadFile("testdata/github-pull_request-payload.json")
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, "pull_request", "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			if requested != tt.expectCheckSuite {
+				t.Errorf("expected check suite to be requested: %t, got %t", tt.expectCheckSuite, requested)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_checkSuiteOnPRCancelled(t *testing.T) {
+	srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+		"POST /repos/baxterthehacker/public-repo/check-suites": func(w http.ResponseWriter, r *http.Request) {
+			t.Error("check suite requested after the client disconnected")
+		},
+	})
+	store := newTestStore()
+	store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+	s := newTestGithubHandler(store, t)
+	s.key = newTestKey(t)
+	s.opts.AppID = 12345
+	s.opts.CheckSuiteOnPR = true
+
+	payload, err := ioutil.ReadFile("testdata/github-pull_request-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	// The client has gone away before the check suite is requested
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	r, err := webhooktest.NewSignedRequest("pull_request", "asdf", payload)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	r = r.WithContext(ctx)
+	c, _ := gin.CreateTestContext(w)
+	c.Request = r
+
+	s.Handle(c)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d\n%s", http.StatusInternalServerError, w.Code, w.Body.String())
+	}
+	if len(store.builds) != 0 {
+		t.Errorf("expected no builds, got %d", len(store.builds))
+	}
+}
@@ -0,0 +1,91 @@
+package webhook
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/brigadecore/brigade/pkg/storage"
+	gin "gopkg.in/gin-gonic/gin.v1"
+
+	ghlib "github.com/brigadecore/brigade-github-app/pkg/github"
+)
+
+// checkSuiteRequest is the body of a request to NewCheckSuiteHandler.
+type checkSuiteRequest struct {
+	// SHA is the commit to check
+	SHA string `json:"sha"`
+	// Branch is the branch the commit is on, if any
+	Branch string `json:"branch"`
+}
+
+// NewCheckSuiteHandler creates a handler that requests a check suite run for
+// an arbitrary commit of the repository named by the :owner and :repo route
+// parameters, as if a pull request had been opened for it.
+//
+// The request body is a JSON object with the commit's "sha" and, optionally,
+// its "branch". Requests must carry opts.ChecksToken as a bearer token in the
+// Authorization header. If opts.ChecksToken is empty, every request is refused.
+func NewCheckSuiteHandler(s storage.Store, key *ghlib.AppKey, opts GithubOpts) gin.HandlerFunc {
+	gh := &githubHook{
+		store: s,
+		key:   key,
+		opts:  opts,
+	}
+	return gh.handleCheckSuiteRequest
+}
+
+func (s *githubHook) handleCheckSuiteRequest(c *gin.Context) {
+	owner, repo := c.Param("owner"), c.Param("repo")
+	c.Set(logRepoKey, owner+"/"+repo)
+	if !validBearerToken(c.Request.Header.Get("Authorization"), s.opts.ChecksToken) {
+		errorResponse(c, http.StatusUnauthorized, CodeChecksUnauthorized, "invalid checks token")
+		return
+	}
+
+	req := checkSuiteRequest{}
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil || req.SHA == "" {
+		errorResponse(c, http.StatusBadRequest, CodeInvalidPayload, "a commit sha is required")
+		return
+	}
+
+	proj, err := s.store.GetProject(owner + "/" + repo)
+	if err != nil {
+		errorResponse(c, http.StatusBadRequest, CodeProjectNotFound, "project not found")
+		return
+	}
+
+	client, err := ghlib.NewAppClient(proj.Github.BaseURL, proj.Github.UploadURL, int64(s.opts.AppID), s.key, s.opts.ClientOptions...)
+	if err != nil {
+		log.Printf("Failed to create an app client: %s", err)
+		errorResponse(c, http.StatusForbidden, CodeAuthFailed, ErrAuthFailed.Error())
+		return
+	}
+	ctx, cancel := apiContext(c)
+	defer cancel()
+	inst, _, err := client.Apps.FindRepositoryInstallation(ctx, owner, repo)
+	if err != nil {
+		log.Printf("Failed to find the app's installation on %s/%s: %s", owner, repo, err)
+		errorResponse(c, http.StatusForbidden, CodeAuthFailed, ErrAuthFailed.Error())
+		return
+	}
+
+	release, ok := s.limitInstallation(c, inst.GetID())
+	if !ok {
+		return
+	}
+	err = s.requestCheckSuite(ctx, proj, inst.GetID(), owner, repo, req.SHA, req.Branch)
+	release()
+	if err != nil {
+		if retryLaterResponse(c, err) {
+			return
+		}
+		if err == ErrAuthFailed {
+			errorResponse(c, http.StatusForbidden, CodeAuthFailed, err.Error())
+			return
+		}
+		errorResponse(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "Check suite requested"})
+}
@@ -0,0 +1,107 @@
+package webhook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
+
+func TestCheckSuiteHandler(t *testing.T) {
+	const sha = "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"
+	tests := []struct {
+		name              string
+		authorization     string
+		body              string
+		suiteExists       bool
+		expectedStatus    int
+		expectedRerequest string
+	}{
+		{
+			name:              "create",
+			authorization:     "Bearer check-me",
+			body:              `{"sha":"` + sha + `","branch":"master"}`,
+			expectedStatus:    http.StatusOK,
+			expectedRerequest: "5",
+		},
+		{
+			// An existing suite is rerequested instead
+			name:              "already exists",
+			authorization:     "Bearer check-me",
+			body:              `{"sha":"` + sha + `"}`,
+			suiteExists:       true,
+			expectedStatus:    http.StatusOK,
+			expectedRerequest: "9",
+		},
+		{
+			name:           "no sha",
+			authorization:  "Bearer check-me",
+			body:           `{"branch":"master"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "unauthorized",
+			authorization:  "Bearer guess",
+			body:           `{"sha":"` + sha + `"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rerequested string
+			srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+				"GET /repos/baxterthehacker/public-repo/installation": func(w http.ResponseWriter, r *http.Request) {
+					w.Write([]byte(`{"id":777777}`))
+				},
+				"POST /repos/baxterthehacker/public-repo/check-suites": func(w http.ResponseWriter, r *http.Request) {
+					if tt.suiteExists {
+						w.WriteHeader(http.StatusUnprocessableEntity)
+						w.Write([]byte(`{"message":"Validation Failed"}`))
+						return
+					}
+					w.WriteHeader(http.StatusCreated)
+					w.Write([]byte(`{"id":5}`))
+				},
+				"GET /repos/baxterthehacker/public-repo/commits/" + sha + "/check-suites": func(w http.ResponseWriter, r *http.Request) {
+					w.Write([]byte(`{"total_count":1,"check_suites":[{"id":9}]}`))
+				},
+				"POST /repos/baxterthehacker/public-repo/check-suites/5/rerequest": func(w http.ResponseWriter, r *http.Request) {
+					rerequested = "5"
+					w.WriteHeader(http.StatusCreated)
+				},
+				"POST /repos/baxterthehacker/public-repo/check-suites/9/rerequest": func(w http.ResponseWriter, r *http.Request) {
+					rerequested = "9"
+					w.WriteHeader(http.StatusCreated)
+				},
+			})
+			store := newTestStore()
+			store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+			h := NewCheckSuiteHandler(store, newTestKey(t), GithubOpts{
+				AppID:       12345,
+				ChecksToken: "check-me",
+			})
+
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "/checks/baxterthehacker/public-repo", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("failed to create request: %s", err)
+			}
+			r.Header.Add("Authorization", tt.authorization)
+
+			router := gin.New()
+			router.POST("/checks/:owner/:repo", h)
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if rerequested != tt.expectedRerequest {
+				t.Errorf("expected suite %q to be rerequested, got %q", tt.expectedRerequest, rerequested)
+			}
+		})
+	}
+}
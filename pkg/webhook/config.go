@@ -0,0 +1,82 @@
+package webhook
+
+import (
+	"net/http"
+
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
+
+// redacted replaces the value of secrets in the effective configuration.
+const redacted = "[redacted]"
+
+// effectiveConfig is the body of a response from NewConfigHandler. Secrets are
+// only reported as redacted if set, or empty if not.
+type effectiveConfig struct {
+	AppID               int      `json:"appID"`
+	CheckSuiteOnPR      bool     `json:"checkSuiteOnPR"`
+	EmittedEvents       []string `json:"emittedEvents"`
+	EventPrefix         string   `json:"eventPrefix"`
+	EmitWildcardActions bool     `json:"emitWildcardActions"`
+	NoActionEvents      bool     `json:"noActionEvents"`
+	AllowedAuthors      []string `json:"allowedAuthors"`
+	ForkSecretPolicy    string   `json:"forkSecretPolicy"`
+	ReportMode          string   `json:"reportMode"`
+	DefaultRef          string   `json:"defaultRef"`
+	RepoAllowlist       []string `json:"repoAllowlist"`
+	OrgAllowlist        []string `json:"orgAllowlist"`
+	TrustedNetworks     []string `json:"trustedNetworks"`
+	DefaultSharedSecret string   `json:"defaultSharedSecret"`
+	AppWebhookSecret    string   `json:"appWebhookSecret"`
+	ReplayToken         string   `json:"replayToken"`
+	ChecksToken         string   `json:"checksToken"`
+	DebugToken          string   `json:"debugToken"`
+}
+
+// NewConfigHandler creates a handler that returns the options the gateway
+// runs with, after flags, environment variables and defaults are resolved, so
+// that misconfiguration can be spotted. Secrets are redacted.
+//
+// Requests must carry opts.DebugToken as a bearer token in the Authorization
+// header. If opts.DebugToken is empty, every request is refused.
+func NewConfigHandler(authors []string, opts GithubOpts) gin.HandlerFunc {
+	networks := make([]string, len(opts.TrustedNetworks))
+	for i, n := range opts.TrustedNetworks {
+		networks[i] = n.String()
+	}
+	config := effectiveConfig{
+		AppID:               opts.AppID,
+		CheckSuiteOnPR:      opts.CheckSuiteOnPR,
+		EmittedEvents:       opts.EmittedEvents,
+		EventPrefix:         opts.EventPrefix,
+		EmitWildcardActions: opts.EmitWildcardActions,
+		NoActionEvents:      opts.NoActionEvents,
+		AllowedAuthors:      authors,
+		ForkSecretPolicy:    string(opts.ForkSecretPolicy),
+		ReportMode:          string(opts.ReportMode),
+		DefaultRef:          opts.DefaultRef,
+		RepoAllowlist:       opts.RepoAllowlist,
+		OrgAllowlist:        opts.OrgAllowlist,
+		TrustedNetworks:     networks,
+		DefaultSharedSecret: redact(opts.DefaultSharedSecret),
+		AppWebhookSecret:    redact(opts.AppWebhookSecret),
+		ReplayToken:         redact(opts.ReplayToken),
+		ChecksToken:         redact(opts.ChecksToken),
+		DebugToken:          redact(opts.DebugToken),
+	}
+	return func(c *gin.Context) {
+		if !validBearerToken(c.Request.Header.Get("Authorization"), opts.DebugToken) {
+			errorResponse(c, http.StatusUnauthorized, CodeDebugUnauthorized, "invalid debug token")
+			return
+		}
+		c.JSON(http.StatusOK, config)
+	}
+}
+
+// redact returns redacted for secrets that are set, so that it can be seen
+// whether they are, and an empty string otherwise.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
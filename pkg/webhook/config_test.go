@@ -0,0 +1,113 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
+
+func TestConfigHandler(t *testing.T) {
+	_, trusted, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := GithubOpts{
+		AppID:               12345,
+		CheckSuiteOnPR:      true,
+		EmittedEvents:       []string{"push", "pull_request:*"},
+		DefaultSharedSecret: "shared-secret",
+		AppWebhookSecret:    "app-secret",
+		ReplayToken:         "replay-secret",
+		DebugToken:          "debug-secret",
+		ForkSecretPolicy:    ForkSecretsLimited,
+		ReportMode:          ReportStatus,
+		TrustedNetworks:     []*net.IPNet{trusted},
+	}
+
+	tests := []struct {
+		name           string
+		token          string
+		authorization  string
+		expectedStatus int
+	}{
+		{
+			name:           "authorized",
+			token:          "debug-secret",
+			authorization:  "Bearer debug-secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "wrong token",
+			token:          "debug-secret",
+			authorization:  "Bearer guess",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "no token",
+			token:          "debug-secret",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "endpoint disabled",
+			authorization:  "Bearer ",
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts.DebugToken = tt.token
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("GET", "/debug/config", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.authorization != "" {
+				r.Header.Add("Authorization", tt.authorization)
+			}
+
+			router := gin.New()
+			router.GET("/debug/config", NewConfigHandler([]string{"OWNER", "MEMBER"}, opts))
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			for _, secret := range []string{"shared-secret", "app-secret", "replay-secret", "debug-secret"} {
+				if strings.Contains(w.Body.String(), secret) {
+					t.Errorf("expected %q to be redacted, got %s", secret, w.Body.String())
+				}
+			}
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var config effectiveConfig
+			if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+				t.Fatalf("failed to decode response: %s", err)
+			}
+			expected := effectiveConfig{
+				AppID:               12345,
+				CheckSuiteOnPR:      true,
+				EmittedEvents:       []string{"push", "pull_request:*"},
+				AllowedAuthors:      []string{"OWNER", "MEMBER"},
+				ForkSecretPolicy:    "limited",
+				ReportMode:          "status",
+				TrustedNetworks:     []string{"10.0.0.0/8"},
+				DefaultSharedSecret: redacted,
+				AppWebhookSecret:    redacted,
+				ReplayToken:         redacted,
+				DebugToken:          redacted,
+			}
+			if !reflect.DeepEqual(config, expected) {
+				t.Errorf("expected %+v, got %+v", expected, config)
+			}
+		})
+	}
+}
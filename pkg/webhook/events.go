@@ -0,0 +1,322 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-github/v32/github"
+)
+
+// KnownEvents are the event types the gateway emits builds for, as they may be
+// named in GithubOpts.EmittedEvents.
+var KnownEvents = []string{
+	"check_run",
+	"check_suite",
+	"commit_comment",
+	"create",
+	"delete",
+	"deployment",
+	"deployment_status",
+	"gollum",
+	"installation",
+	"installation_repositories",
+	"issue_comment",
+	"membership",
+	"package",
+	"pull_request",
+	"pull_request_review",
+	"pull_request_review_comment",
+	"push",
+	"release",
+	"sponsorship",
+	"star",
+	"status",
+	"team",
+	"watch",
+}
+
+// UnknownEvents returns the entries of events, in the form accepted by
+// GithubOpts.EmittedEvents, that can never match an emitted event. "*" and
+// eventType:action entries for known event types are accepted.
+func UnknownEvents(events []string) []string {
+	var unknown []string
+	for _, e := range events {
+		if e == "*" {
+			continue
+		}
+		if !isKnownEvent(strings.SplitN(e, ":", 2)[0]) {
+			unknown = append(unknown, e)
+		}
+	}
+	return unknown
+}
+
+func isKnownEvent(eventType string) bool {
+	for _, known := range KnownEvents {
+		if eventType == known {
+			return true
+		}
+	}
+	return false
+}
+
+// errUnknownEvent is returned by parseWebHook for event types that neither the
+// vendored go-github library nor this package know.
+var errUnknownEvent = errors.New("unknown event type")
+
+// eventNameRegex matches names that GitHub could give an event type, such as
+// security_advisory.
+var eventNameRegex = regexp.MustCompile(`^[a-z]+(_[a-z]+)*$`)
+
+// parseWebHook parses a webhook body into the event type named by eventType.
+//
+// Events that the vendored go-github library does not know about are parsed
+// into the local types defined in this file. Everything else is delegated to
+// github.ParseWebHook. Event types that are known to neither yield
+// errUnknownEvent.
+func parseWebHook(eventType string, body []byte) (interface{}, error) {
+	switch eventType {
+	case "package", "registry_package":
+		event := &PackageEvent{}
+		if err := json.Unmarshal(body, event); err != nil {
+			return nil, err
+		}
+		return event, nil
+	case "sponsorship":
+		event := &SponsorshipEvent{}
+		if err := json.Unmarshal(body, event); err != nil {
+			return nil, err
+		}
+		return event, nil
+	case "star":
+		event := &StarEvent{}
+		if err := json.Unmarshal(body, event); err != nil {
+			return nil, err
+		}
+		return event, nil
+	}
+	event, err := github.ParseWebHook(eventType, body)
+	// go-github doesn't export an error type for this
+	if err != nil && strings.HasPrefix(err.Error(), "unknown X-Github-Event") {
+		return nil, errUnknownEvent
+	}
+	return event, err
+}
+
+// parseUnknownEvent parses a webhook body of an event type that is unknown to
+// parseWebHook into an UnknownEvent, provided the type is named like a GitHub
+// event.
+func parseUnknownEvent(eventType string, body []byte) (*UnknownEvent, error) {
+	if !eventNameRegex.MatchString(eventType) {
+		return nil, errUnknownEvent
+	}
+	event := &UnknownEvent{}
+	if err := json.Unmarshal(body, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// PackageEvent is triggered when a package is published or updated.
+//
+// GitHub delivers this as either a `package` or a (legacy) `registry_package`
+// event. The two differ only in the name of the key holding the package.
+// go-github/v32 predates both, so only the fields we use are represented here.
+type PackageEvent struct {
+	Action          *string              `json:"action,omitempty"`
+	Package         *Package             `json:"package,omitempty"`
+	RegistryPackage *Package             `json:"registry_package,omitempty"`
+	Repo            *github.Repository   `json:"repository,omitempty"`
+	Sender          *github.User         `json:"sender,omitempty"`
+	Installation    *github.Installation `json:"installation,omitempty"`
+}
+
+// GetAction returns the Action field if it's non-nil, zero value otherwise.
+func (p *PackageEvent) GetAction() string {
+	if p == nil || p.Action == nil {
+		return ""
+	}
+	return *p.Action
+}
+
+// GetSender returns the Sender field.
+func (p *PackageEvent) GetSender() *github.User {
+	if p == nil {
+		return nil
+	}
+	return p.Sender
+}
+
+// GetInstallation returns the Installation field.
+func (p *PackageEvent) GetInstallation() *github.Installation {
+	if p == nil {
+		return nil
+	}
+	return p.Installation
+}
+
+// GetPackage returns the package regardless of which key it was delivered
+// under.
+func (p *PackageEvent) GetPackage() *Package {
+	if p == nil {
+		return nil
+	}
+	if p.Package != nil {
+		return p.Package
+	}
+	return p.RegistryPackage
+}
+
+// Package describes a package published to a GitHub package registry.
+type Package struct {
+	ID             *int64          `json:"id,omitempty"`
+	Name           *string         `json:"name,omitempty"`
+	PackageType    *string         `json:"package_type,omitempty"`
+	PackageVersion *PackageVersion `json:"package_version,omitempty"`
+}
+
+// GetPackageVersion returns the PackageVersion field.
+func (p *Package) GetPackageVersion() *PackageVersion {
+	if p == nil {
+		return nil
+	}
+	return p.PackageVersion
+}
+
+// PackageVersion describes a single published version of a package.
+type PackageVersion struct {
+	ID              *int64  `json:"id,omitempty"`
+	Version         *string `json:"version,omitempty"`
+	TargetCommitish *string `json:"target_commitish,omitempty"`
+	TargetOID       *string `json:"target_oid,omitempty"`
+}
+
+// GetTargetCommitish returns the TargetCommitish field if it's non-nil, zero
+// value otherwise.
+func (p *PackageVersion) GetTargetCommitish() string {
+	if p == nil || p.TargetCommitish == nil {
+		return ""
+	}
+	return *p.TargetCommitish
+}
+
+// GetTargetOID returns the TargetOID field if it's non-nil, zero value
+// otherwise.
+func (p *PackageVersion) GetTargetOID() string {
+	if p == nil || p.TargetOID == nil {
+		return ""
+	}
+	return *p.TargetOID
+}
+
+// SponsorshipEvent is triggered when a sponsorship of the account that the
+// webhook is configured for is created or changes.
+//
+// go-github/v32 predates it, so only the fields we use are represented here.
+type SponsorshipEvent struct {
+	Action      *string      `json:"action,omitempty"`
+	Sponsorship *Sponsorship `json:"sponsorship,omitempty"`
+	Sender      *github.User `json:"sender,omitempty"`
+}
+
+// Sponsorship is a GitHub Sponsors sponsorship.
+type Sponsorship struct {
+	Sponsorable  *github.User `json:"sponsorable,omitempty"`
+	Sponsor      *github.User `json:"sponsor,omitempty"`
+	PrivacyLevel *string      `json:"privacy_level,omitempty"`
+}
+
+// GetAction returns the Action field if it's non-nil, zero value otherwise.
+func (e *SponsorshipEvent) GetAction() string {
+	if e == nil || e.Action == nil {
+		return ""
+	}
+	return *e.Action
+}
+
+// GetSender returns the Sender field.
+func (e *SponsorshipEvent) GetSender() *github.User {
+	if e == nil {
+		return nil
+	}
+	return e.Sender
+}
+
+// StarEvent is triggered when a repository is starred or unstarred.
+//
+// go-github/v32's StarEvent lacks the webhook-only fields, so only the fields
+// we use are represented here.
+type StarEvent struct {
+	Action       *string              `json:"action,omitempty"`
+	StarredAt    *github.Timestamp    `json:"starred_at,omitempty"`
+	Repo         *github.Repository   `json:"repository,omitempty"`
+	Sender       *github.User         `json:"sender,omitempty"`
+	Installation *github.Installation `json:"installation,omitempty"`
+}
+
+// GetAction returns the Action field if it's non-nil, zero value otherwise.
+func (e *StarEvent) GetAction() string {
+	if e == nil || e.Action == nil {
+		return ""
+	}
+	return *e.Action
+}
+
+// GetRepo returns the Repo field.
+func (e *StarEvent) GetRepo() *github.Repository {
+	if e == nil {
+		return nil
+	}
+	return e.Repo
+}
+
+// GetSender returns the Sender field.
+func (e *StarEvent) GetSender() *github.User {
+	if e == nil {
+		return nil
+	}
+	return e.Sender
+}
+
+// GetInstallation returns the Installation field.
+func (e *StarEvent) GetInstallation() *github.Installation {
+	if e == nil {
+		return nil
+	}
+	return e.Installation
+}
+
+// UnknownEvent holds the fields common to all repository events, for event
+// types that are newer than the vendored go-github library. They are only
+// parsed when GithubOpts.ForwardUnknownEvents is set.
+type UnknownEvent struct {
+	Repo         *github.Repository   `json:"repository,omitempty"`
+	Sender       *github.User         `json:"sender,omitempty"`
+	Installation *github.Installation `json:"installation,omitempty"`
+}
+
+// GetRepo returns the Repo field.
+func (e *UnknownEvent) GetRepo() *github.Repository {
+	if e == nil {
+		return nil
+	}
+	return e.Repo
+}
+
+// GetSender returns the Sender field.
+func (e *UnknownEvent) GetSender() *github.User {
+	if e == nil {
+		return nil
+	}
+	return e.Sender
+}
+
+// GetInstallation returns the Installation field.
+func (e *UnknownEvent) GetInstallation() *github.Installation {
+	if e == nil {
+		return nil
+	}
+	return e.Installation
+}
@@ -0,0 +1,126 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestUnknownEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   []string
+		expected []string
+	}{
+		{"wildcard", []string{"*"}, nil},
+		{"known", []string{"push", "pull_request", "check_suite"}, nil},
+		{"with action", []string{"pull_request:opened", "check_run:*"}, nil},
+		{"typo", []string{"push", "pull-request", "pull-request:opened"}, []string{"pull-request", "pull-request:opened"}},
+		{"legacy name", []string{"registry_package"}, []string{"registry_package"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := UnknownEvents(tt.events); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_unknownEvents(t *testing.T) {
+	discussion, err := ioutil.ReadFile("testdata/github-discussion-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	tests := []struct {
+		name           string
+		event          string
+		payload        []byte
+		forward        bool
+		secret         string
+		expectedStatus int
+		expectedCode   ErrorCode
+		expectedTypes  []string
+	}{
+		{
+			name:           "rejected by default",
+			event:          "discussion",
+			payload:        discussion,
+			secret:         "asdf",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   CodeMalformedBody,
+		},
+		{
+			name:           "forwarded",
+			event:          "discussion",
+			payload:        discussion,
+			forward:        true,
+			secret:         "asdf",
+			expectedStatus: http.StatusOK,
+			expectedTypes:  []string{"discussion"},
+		},
+		{
+			name:           "forwarded with invalid signature",
+			event:          "discussion",
+			payload:        discussion,
+			forward:        true,
+			secret:         "wrong",
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   CodeSignatureInvalid,
+		},
+		{
+			name:           "not an event name",
+			event:          "Discussion-Event",
+			payload:        discussion,
+			forward:        true,
+			secret:         "asdf",
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   CodeMalformedBody,
+		},
+		{
+			name:           "no repository",
+			event:          "discussion",
+			payload:        []byte(`{"action":"created","sender":{"login":"baxterthehacker"}}`),
+			forward:        true,
+			secret:         "asdf",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.ForwardUnknownEvents = tt.forward
+
+			w := serveTestEvent(t, s, tt.event, tt.secret, tt.payload)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.expectedCode != "" {
+				var res struct{ Code ErrorCode }
+				if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+					t.Fatalf("failed to decode response: %s", err)
+				}
+				if res.Code != tt.expectedCode {
+					t.Errorf("expected code %s, got %s", tt.expectedCode, res.Code)
+				}
+			}
+
+			var types []string
+			for _, b := range store.builds {
+				types = append(types, b.Type)
+				if b.Revision.Ref != "refs/heads/main" {
+					t.Errorf("expected the default branch to be built, got %q", b.Revision.Ref)
+				}
+			}
+			if !reflect.DeepEqual(types, tt.expectedTypes) {
+				t.Errorf("expected builds %v, got %v", tt.expectedTypes, types)
+			}
+		})
+	}
+}
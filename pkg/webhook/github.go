@@ -1,16 +1,24 @@
 package webhook
 
 import (
+	"compress/gzip"
 	"context"
 	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/brigadecore/brigade/pkg/brigade"
 	"github.com/brigadecore/brigade/pkg/storage"
@@ -18,6 +26,7 @@ import (
 	gin "gopkg.in/gin-gonic/gin.v1"
 
 	ghlib "github.com/brigadecore/brigade-github-app/pkg/github"
+	"github.com/brigadecore/brigade-github-app/pkg/retry"
 )
 
 const hubSignatureHeader = "X-Hub-Signature"
@@ -27,9 +36,34 @@ const hubSignatureHeader = "X-Hub-Signature"
 // This is usually indicative of an auth failure between the client library and GitHub
 var ErrAuthFailed = errors.New("Auth Failed")
 
+// ErrorCode is a machine-readable identifier for the cause of an error
+// response. It is sent alongside the human-readable status.
+type ErrorCode string
+
+// Error codes sent in error responses.
+const (
+	CodeMalformedBody      ErrorCode = "MALFORMED_BODY"
+	CodeInvalidPayload     ErrorCode = "INVALID_PAYLOAD"
+	CodeProjectNotFound    ErrorCode = "PROJECT_NOT_FOUND"
+	CodeNoSecret           ErrorCode = "NO_SECRET"
+	CodeSignatureInvalid   ErrorCode = "SIGNATURE_INVALID"
+	CodeAuthFailed         ErrorCode = "AUTH_FAILED"
+	CodeEncodingFailed     ErrorCode = "ENCODING_FAILED"
+	CodeInternal           ErrorCode = "INTERNAL_ERROR"
+	CodeReplayUnauthorized ErrorCode = "REPLAY_UNAUTHORIZED"
+	CodeRouteMismatch      ErrorCode = "ROUTE_MISMATCH"
+	CodeChecksUnauthorized ErrorCode = "CHECKS_UNAUTHORIZED"
+	CodeTooManyRequests    ErrorCode = "TOO_MANY_REQUESTS"
+	CodeUnavailable        ErrorCode = "UNAVAILABLE"
+	CodeSourceForbidden    ErrorCode = "SOURCE_FORBIDDEN"
+	CodeDebugUnauthorized  ErrorCode = "DEBUG_UNAUTHORIZED"
+	CodeTimeout            ErrorCode = "TIMEOUT"
+)
+
 var (
 	branchRefRegex = regexp.MustCompile("refs/heads/(.+)")
 	tagRefRegex    = regexp.MustCompile("refs/tags/(.+)")
+	commitSHARegex = regexp.MustCompile("^[0-9a-f]{40}$")
 )
 
 type githubHook struct {
@@ -37,8 +71,17 @@ type githubHook struct {
 	updateIssueCommentEvent iceUpdater
 	opts                    GithubOpts
 	allowedAuthors          []string
-	// key is the x509 certificate key as ASCII-armored (PEM) data
-	key []byte
+	// key is the app's private key
+	key *ghlib.AppKey
+	// defaultBranches caches the default branch of each repo we've seen
+	defaultBranches *branchCache
+	// tagCommits caches the commit of each repo@tag we've resolved
+	tagCommits *branchCache
+	// topics caches the topics of each repo we've seen
+	topics *topicCache
+	// skipSignature disables webhook signature validation. It is only set for
+	// replayed deliveries, which are authenticated by NewReplayHandler.
+	skipSignature bool
 }
 
 // GithubOpts provides options for configuring a GitHub hook
@@ -47,19 +90,229 @@ type GithubOpts struct {
 	CheckSuiteOnPR      bool
 	AppID               int
 	DefaultSharedSecret string
-	EmittedEvents       []string
+	// AppWebhookSecret is the webhook secret configured on the GitHub App. It is
+	// the primary secret for app-scoped events (check suites, check runs and
+	// issue comments), with the project's shared secret as a fallback.
+	AppWebhookSecret string
+	EmittedEvents    []string
+	// EventPrefix is prepended to the type of every build, e.g. "gh:" to emit
+	// gh:push and gh:pull_request:opened, so that events from several gateways
+	// feeding one Brigade can be told apart. EmittedEvents entries may be
+	// given with or without it. EventAliases and ProviderMap are keyed by the
+	// unprefixed types.
+	EventPrefix string
+	// EventAliases maps event types to additional event types that are
+	// emitted, with the same payload and revision, whenever they are, such as
+	// "push" to "ci" and "deploy-preview". Keys may be unqualified (push) or
+	// qualified (pull_request:opened) types.
+	EventAliases map[string][]string
+	// EmitWildcardActions additionally emits eventType:* for events that have
+	// an action, so that scripts can handle every action of one event type
+	// without also handling other event types.
+	EmitWildcardActions bool
+	// NoActionEvents emits only the bare event type, e.g. pull_request, never
+	// eventType:action, eventType:* or the extra types of EventFilter. It
+	// takes precedence over EmitWildcardActions. Aliases of the bare type are
+	// still emitted.
+	NoActionEvents bool
+	// RepoTopics adds the GitHub topics of the event's repository to the
+	// payload of every build as "gateway.topics". When the delivery doesn't
+	// include them, they are looked up via the GitHub API as the app
+	// installation, and cached per repository.
+	RepoTopics bool
+	// EmitTopicEvents additionally emits eventType:topic for each of the
+	// repository's topics, e.g. push:team-payments, so that builds can be
+	// routed by topic. It implies RepoTopics.
+	EmitTopicEvents bool
+	// ForwardUnknownEvents emits the bare event type for events that are newer
+	// than the vendored go-github library, instead of rejecting them as
+	// malformed. Their signature is validated like any other, and the default
+	// branch is built. Events without a repository are skipped.
+	ForwardUnknownEvents bool
+	// PushHeadOnly reduces the commits of push payloads to the head commit,
+	// which is still the only one built, to keep payloads of large pushes
+	// small. head_commit is kept.
+	PushHeadOnly bool
+	// DefaultRef is used for events that carry no ref of their own when the
+	// repository's default branch cannot be determined. If empty,
+	// refs/heads/master is used.
+	DefaultRef string
+	// ProviderMap maps event types to the provider recorded on their builds.
+	// A qualified type (check_suite:requested) takes precedence over its
+	// unqualified form (check_suite). Unmapped events use "github".
+	ProviderMap map[string]string
+	// ForkSecretPolicy determines the installation token that builds of pull
+	// requests from forks receive. If empty, ForkSecretsFull is used.
+	ForkSecretPolicy ForkSecretPolicy
+	// ForkAllowLabel is a label maintainers can apply to a pull request from a
+	// fork to have it built even if its author's association isn't allowed.
+	// If empty, only the author association is considered.
+	ForkAllowLabel string
+	// SkipPRLabel is a label that suppresses all builds for a pull request
+	// carrying it, such as "wip". If empty, labels don't prevent builds.
+	SkipPRLabel string
+	// StatusContextAllow lists the contexts of status events that builds are
+	// scheduled for, as path.Match patterns. If empty, all contexts are allowed.
+	StatusContextAllow []string
+	// StatusContextDeny lists status event contexts that are skipped, as
+	// path.Match patterns. It takes precedence over StatusContextAllow, and
+	// should include the contexts of statuses reported by builds to avoid
+	// feedback loops.
+	StatusContextDeny []string
+	// DeploymentEnvironments lists the environments of deployment and
+	// deployment_status events that builds are scheduled for. If empty, all
+	// environments are allowed.
+	DeploymentEnvironments []string
+	// MaxEventAge is the age after which deliveries are skipped, to mitigate
+	// replays of captured deliveries. Only events that carry a timestamp can be
+	// checked. If zero, deliveries of any age are accepted.
+	MaxEventAge time.Duration
+	// BuildLogLevel is the log level set on every build, which the worker uses
+	// to decide how much of brigade.js's logging to print. If empty, the
+	// worker's default is used.
+	BuildLogLevel string
+	// RepoAllowlist lists the repositories the gateway builds, as path.Match
+	// patterns such as "brigadecore/*". Events for other repositories are
+	// skipped before their project is looked up. If empty, all repositories
+	// with a project are built.
+	RepoAllowlist []string
+	// OrgAllowlist lists the organizations or users whose repositories the
+	// gateway builds, as path.Match patterns matched against the owner of the
+	// repository. Events for other owners are skipped before their project is
+	// looked up. If empty, repositories of any owner are built.
+	OrgAllowlist []string
+	// MaxBodyLogBytes is how much of a delivery's body is logged when it can't
+	// be handled. Bodies may contain secrets, so if zero, they aren't logged.
+	MaxBodyLogBytes int
+	// OrgProject is the name of the Brigade project that events which are not
+	// tied to a repository, such as organization membership changes, are
+	// emitted to. If empty, such events are skipped.
+	OrgProject string
+	// InstallationProject is the name of the Brigade project that installation
+	// and installation_repositories events are emitted to, e.g. to provision
+	// projects for newly added repositories. If empty, such events are
+	// skipped.
+	InstallationProject string
+	// ReplayToken is the bearer token required by the replay endpoint. If
+	// empty, replays are refused.
+	ReplayToken string
+	// ChecksToken is the bearer token required by the on-demand check suite
+	// endpoint. If empty, requests to it are refused.
+	ChecksToken string
+	// DebugToken is the bearer token required by the effective configuration
+	// endpoint. If empty, requests to it are refused.
+	DebugToken string
+	// ReportMode determines what the gateway reports to GitHub about the builds
+	// it schedules. If empty, ReportNone is used.
+	ReportMode ReportMode
+	// BuildURL is the URL of a build in a Brigade UI, with "{id}" standing in
+	// for the build ID, such as "https://kashti.example.com/#!/build/{id}". It
+	// is linked from reported statuses. If empty, statuses have no link.
+	BuildURL string
+	// TrustedNetworks lists networks whose deliveries are accepted without a
+	// valid webhook signature, for deployments where the network path to the
+	// gateway is already trusted. Only the address of the connection is
+	// considered, not headers such as X-Forwarded-For. If empty, which is the
+	// default, every delivery must be signed.
+	TrustedNetworks []*net.IPNet
+	// EventFilter decides whether builds are scheduled for an event, and which
+	// additional event types to emit for it. If nil, PassThroughEventFilter is
+	// used.
+	EventFilter EventFilter
+	// InstallationLimiter caps concurrent GitHub API operations per app
+	// installation. It should be shared by all handlers. If nil, operations
+	// are not limited.
+	InstallationLimiter *InstallationLimiter
+	// PayloadEnricher may rewrite the payload of each build before it is
+	// stored, e.g. to add metadata parsed from the branch name. If nil, the
+	// payload is stored as is.
+	PayloadEnricher PayloadEnricher
+	// SecretResolver is asked for the shared secret of a repository before
+	// the project's SharedSecret and DefaultSharedSecret. If it has none, they
+	// are used as before. If nil, only they are used, the way
+	// StoreSecretResolver would resolve them.
+	SecretResolver SecretResolver
+	// WorkerImage, if set, is added to the payload of every build as
+	// "gateway.workerImage", for scripts that select images by gateway
+	// deployment. Brigade itself picks the worker image from the project.
+	WorkerImage string
+	// TokenCache, if set, caches the installation tokens the handler mints,
+	// except those restricted by ForkSecretPolicy. It should be shared by all
+	// handlers. If nil, a token is minted whenever one is needed.
+	TokenCache *ghlib.TokenCache
+	// ClientOptions configure the GitHub API clients the handler creates, e.g.
+	// with ghlib.WithTimeout. If empty, the defaults of ghlib are used. A
+	// TokenCache mints tokens with its own options.
+	ClientOptions []ghlib.ClientOption
+	// NamespaceStores, if set, decides the store that builds of each project
+	// are created in, by the project's namespace. If nil, all builds are
+	// created in the handler's store.
+	NamespaceStores *NamespaceStores
+	// AuditLog, if set, records every signature validation, author association
+	// check and installation token minted. If nil, decisions are not audited.
+	AuditLog *AuditLogger
+	// SourceRanges, if set, rejects deliveries from addresses outside GitHub's
+	// webhook ranges with 403, except replays and deliveries from
+	// TrustedNetworks. If nil, deliveries are accepted from any address.
+	SourceRanges *SourceRanges
+}
+
+// ForkSecretPolicy determines which installation token is passed to builds of
+// pull requests from forks, whose code may not be trusted with it.
+type ForkSecretPolicy string
+
+const (
+	// ForkSecretsFull passes the same token as for any other build.
+	ForkSecretsFull ForkSecretPolicy = "full"
+	// ForkSecretsLimited passes a token that can read the repository and
+	// report check runs, but not write anything else.
+	ForkSecretsLimited ForkSecretPolicy = "limited"
+	// ForkSecretsNone passes no token at all.
+	ForkSecretsNone ForkSecretPolicy = "none"
+)
+
+// limitedForkPermissions are the permissions of tokens passed to fork builds
+// under ForkSecretsLimited.
+var limitedForkPermissions = &github.InstallationPermissions{
+	Checks:       github.String("write"),
+	Contents:     github.String("read"),
+	Metadata:     github.String("read"),
+	PullRequests: github.String("read"),
+}
+
+// EventFilter decides whether builds should be scheduled for a GitHub event
+// and returns any event types to emit in addition to the eventType and
+// eventType:action types emitted by default. event is the parsed webhook
+// payload. Extra types are subject to GithubOpts.EmittedEvents like any other.
+//
+// This allows programs embedding the gateway to customize event routing.
+type EventFilter func(eventType, action string, event interface{}, proj *brigade.Project) (emit bool, extraTypes []string)
+
+// PassThroughEventFilter is an EventFilter that schedules builds for every
+// event and emits no extra event types.
+func PassThroughEventFilter(eventType, action string, event interface{}, proj *brigade.Project) (bool, []string) {
+	return true, nil
 }
 
-type iceUpdater func(c *gin.Context, s *githubHook, ice *github.IssueCommentEvent, rev brigade.Revision, proj *brigade.Project, body []byte) (brigade.Revision, []byte)
+// PayloadEnricher returns the payload to store for a build of the given event
+// type and revision. If it returns an error, the build is not created.
+//
+// This allows programs embedding the gateway to add their own data to builds.
+type PayloadEnricher func(eventType string, rev brigade.Revision, payload []byte) ([]byte, error)
+
+type iceUpdater func(c *gin.Context, s *githubHook, ice *github.IssueCommentEvent, rev brigade.Revision, proj *brigade.Project, body []byte) (brigade.Revision, []byte, bool)
 
 // NewGithubHookHandler creates a GitHub webhook handler.
-func NewGithubHookHandler(s storage.Store, authors []string, x509Key []byte, opts GithubOpts) gin.HandlerFunc {
+func NewGithubHookHandler(s storage.Store, authors []string, key *ghlib.AppKey, opts GithubOpts) gin.HandlerFunc {
 	gh := &githubHook{
 		store:                   s,
 		updateIssueCommentEvent: updateIssueCommentEvent,
 		allowedAuthors:          authors,
-		key:                     x509Key,
+		key:                     key,
 		opts:                    opts,
+		defaultBranches:         newBranchCache(),
+		tagCommits:              newBranchCache(),
+		topics:                  newTopicCache(),
 	}
 	return gh.Handle
 }
@@ -67,47 +320,87 @@ func NewGithubHookHandler(s storage.Store, authors []string, x509Key []byte, opt
 // Handle routes a webhook to its appropriate handler.
 //
 // It does this by sniffing the event from the header, and routing accordingly.
+//
+// The GitHub and Kubernetes calls made for the delivery, and their retries,
+// share a deadline of retry.Deadline, so that GitHub gets an answer before it
+// gives up on the delivery.
 func (s *githubHook) Handle(c *gin.Context) {
+	if s.opts.SourceRanges != nil && !s.skipSignature && !s.fromTrustedNetwork(c.Request) && !s.opts.SourceRanges.allows(c.Request) {
+		log.Printf("Rejecting delivery from %s, which is not a GitHub hook address", c.Request.RemoteAddr)
+		errorResponse(c, http.StatusForbidden, CodeSourceForbidden, "source address is not GitHub's")
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), retry.Deadline)
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
 	eventType := c.Request.Header.Get("X-GitHub-Event")
 	var body []byte
 	var err error
 	if c.Request.Body != nil {
 		defer c.Request.Body.Close()
-		if body, err = ioutil.ReadAll(c.Request.Body); err != nil {
+		if body, err = readBody(c.Request); err != nil {
 			log.Printf("Failed to read body: %s", err)
-			c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+			errorResponse(c, http.StatusBadRequest, CodeMalformedBody, "Malformed body")
 			return
 		}
 	}
 	var event interface{}
 	if len(body) > 1 {
-		event, err = github.ParseWebHook(eventType, body)
+		event, err = parseWebHook(eventType, body)
+		if err == errUnknownEvent && s.opts.ForwardUnknownEvents {
+			event, err = parseUnknownEvent(eventType, body)
+		}
 		if err != nil {
-			log.Printf("Failed to parse body: %s", err)
-			c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+			log.Printf("Failed to parse body of %q event: %s%s", eventType, err, s.loggedBody(body))
+			errorResponse(c, http.StatusBadRequest, CodeMalformedBody, "Malformed body")
 			return
 		}
 	}
+	if repo, _, _, err := extractRevision(eventType, event); err == nil {
+		c.Set(logRepoKey, repo)
+	}
 	switch eventType {
 	case "ping":
-		log.Print("Received ping from GitHub")
-		c.JSON(200, gin.H{"message": "OK"})
+		e, _ := event.(*github.PingEvent)
+		log.Printf("Received ping from GitHub for hook %d: %s", e.GetHookID(), e.GetZen())
+		res := gin.H{"message": "OK"}
+		if warnings := pingWarnings(e); len(warnings) > 0 {
+			for _, w := range warnings {
+				log.Printf("WARNING: %s", w)
+			}
+			res["warnings"] = warnings
+		}
+		c.JSON(200, res)
 		return
 	case "commit_comment",
-		"create",
+		"create", "delete",
 		"deployment", "deployment_status",
+		"gollum",
+		"installation", "installation_repositories",
+		"membership", "team",
 		"pull_request", "pull_request_review", "pull_request_review_comment",
 		"push",
 		"release",
+		"sponsorship",
+		"star", "watch",
 		"status":
 		s.handleEvent(c, eventType, event, body)
 		return
+	case "package", "registry_package":
+		// registry_package is the legacy name for the same event, so both are
+		// emitted as package.
+		s.handleEvent(c, "package", event, body)
+		return
 	// Added
 	case "check_suite", "check_run":
 		s.handleCheck(c, eventType, event, body)
 	case "issue_comment":
 		s.handleIssueComment(c, eventType, event, body)
 	default:
+		if _, ok := event.(*UnknownEvent); ok {
+			s.handleEvent(c, eventType, event, body)
+			return
+		}
 		// Issue #127: Don't return an error for unimplemented events.
 		log.Printf("Unsupported event %q", event)
 		c.JSON(200, gin.H{"message": "Ignored"})
@@ -125,101 +418,356 @@ func (s *githubHook) handleEvent(
 	event interface{},
 	body []byte,
 ) {
-	var repo string
-	var rev brigade.Revision
+	repo, rev, action, err := extractRevision(eventType, event)
+	if err != nil {
+		log.Printf("Failed to parse payload: %s", err)
+		errorResponse(c, http.StatusBadRequest, CodeInvalidPayload, "Received data is not valid JSON")
+		return
+	}
+
+	var extraTypes []string
 	// Used only for check suite
 	var pre *github.PullRequestEvent
-	var action string
-	var shortTitle, longTitle string
+	var appScoped bool
+	switch e := event.(type) {
+	case *github.PullRequestEvent:
+		baseChanged := pullRequestBaseChanged(body)
+		if !s.isAllowedPullRequest(e, baseChanged) {
+			c.JSON(http.StatusOK, gin.H{"status": "build skipped"})
+			return
+		}
+		if s.hasSkipLabel(e.PullRequest.Labels) {
+			c.JSON(http.StatusOK, gin.H{"status": "build skipped: pull request is labeled " + s.opts.SkipPRLabel})
+			return
+		}
+		if baseChanged {
+			extraTypes = append(extraTypes, "pull_request:base_changed")
+		}
+		pre = e
+	case *github.PushEvent:
+		// If this is a branch deletion, skip the build.
+		if e.GetDeleted() {
+			c.JSON(http.StatusOK, gin.H{"status": "build skipped on branch deletion"})
+			return
+		}
+	case *github.DeploymentEvent:
+		if !s.isAllowedEnvironment(e.Deployment.GetEnvironment()) {
+			c.JSON(http.StatusOK, gin.H{"status": "build skipped: deployment environment not allowed"})
+			return
+		}
+	case *github.DeploymentStatusEvent:
+		if !s.isAllowedEnvironment(e.Deployment.GetEnvironment()) {
+			c.JSON(http.StatusOK, gin.H{"status": "build skipped: deployment environment not allowed"})
+			return
+		}
+	case *github.StatusEvent:
+		if !s.isAllowedStatusContext(e.GetContext()) {
+			c.JSON(http.StatusOK, gin.H{"status": "build skipped: status context not allowed"})
+			return
+		}
+	case *github.MembershipEvent, *github.TeamEvent, *SponsorshipEvent:
+		// Organization and account events without a repository go to the org
+		// project, if there is one
+		if repo == "" {
+			if s.opts.OrgProject == "" {
+				c.JSON(http.StatusOK, gin.H{"status": "build skipped: no org project configured"})
+				return
+			}
+			repo = s.opts.OrgProject
+			rev.Ref = s.fallbackRef()
+		}
+	case *github.InstallationEvent, *github.InstallationRepositoriesEvent:
+		// Installations concern the app, not a repository, and are only
+		// signed with the app's secret
+		if s.opts.InstallationProject == "" {
+			c.JSON(http.StatusOK, gin.H{"status": "build skipped: no installation project configured"})
+			return
+		}
+		repo = s.opts.InstallationProject
+		rev.Ref = s.fallbackRef()
+		appScoped = true
+	case *UnknownEvent:
+		if repo == "" {
+			c.JSON(http.StatusOK, gin.H{"status": "build skipped: event has no repository"})
+			return
+		}
+	}
+	shortTitle, longTitle := getTitles(event)
+
+	proj, err := s.getValidatedProject(c, repo, body, appScoped)
+	if err != nil {
+		log.Printf("Project validation failed: %s", err)
+		return
+	}
+	if !s.acceptDelivery(c, repo, eventType, event) {
+		return
+	}
+
+	// The signature covers the original body, so it can only be trimmed now
+	if _, ok := event.(*github.PushEvent); ok && s.opts.PushHeadOnly {
+		if trimmed, err := trimPushCommits(body); err != nil {
+			log.Printf("Failed to trim the commits of a push to %s: %s", repo, err)
+		} else {
+			body = trimmed
+		}
+	}
+
+	// A deleted ref no longer exists, and wiki edits, stars, changes to a
+	// team's repository access and events we don't know have none, so build
+	// the default branch instead. Team events without a repository already
+	// build the org project's ref.
+	var refless repoEvent
+	switch e := event.(type) {
+	case *github.DeleteEvent, *github.GollumEvent, *StarEvent, *github.WatchEvent, *UnknownEvent:
+		refless = e.(repoEvent)
+	case *github.TeamEvent:
+		if e.Repo != nil {
+			refless = e
+		}
+	}
+	if refless != nil {
+		release, ok := s.limitInstallation(c, getInstallationID(event))
+		if !ok {
+			return
+		}
+		ctx, cancel := apiContext(c)
+		rev.Ref = s.defaultRef(ctx, refless.GetRepo(), getInstallationID(event), proj)
+		cancel()
+		release()
+	}
+
+	// Releases only name their tag, so look up its commit for builds that need
+	// one
+	if e, ok := event.(*github.ReleaseEvent); ok && rev.Commit == "" {
+		release, ok := s.limitInstallation(c, e.Installation.GetID())
+		if !ok {
+			return
+		}
+		ctx, cancel := apiContext(c)
+		rev.Commit = s.tagCommit(ctx, repo, e.Release.GetTagName(), e.Installation.GetID(), proj)
+		cancel()
+		release()
+	}
+
+	// If s.opts.CheckSuiteOnPR is set, AND the action is one that indicates code
+	// may have changed and needs to be checked, this will create a new check
+	// suite request.
+	if eventType == "pull_request" && s.checkSuiteOnPR(proj) &&
+		(action == "opened" || action == "synchronize" || action == "reopened") {
+		release, ok := s.limitInstallation(c, pre.Installation.GetID())
+		if !ok {
+			return
+		}
+		ctx, cancel := apiContext(c)
+		err := s.prToCheckSuite(ctx, pre, proj)
+		cancel()
+		release()
+		if err != nil {
+			if retryLaterResponse(c, err) {
+				return
+			}
+			if err == ErrAuthFailed {
+				errorResponse(c, http.StatusForbidden, CodeAuthFailed, err.Error())
+				return
+			}
+			errorResponse(c, http.StatusInternalServerError, CodeInternal, err.Error())
+			return
+		}
+		// TODO: do we return here (e.g. stop the PR hook) if we get to this point
+	}
 
+	builds, err := s.scheduleBuild(c.Request.Context(), eventType, action, event, shortTitle, longTitle, rev, body, proj, extraTypes...)
+	if err != nil {
+		if !retryLaterResponse(c, err) {
+			errorResponse(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		}
+		return
+	}
+
+	if s.opts.ReportMode == ReportStatus && len(builds) > 0 && (pre != nil || eventType == "push") {
+		instID := getInstallationID(event)
+		// The builds exist already, so rather than have GitHub redeliver the
+		// event, the status is skipped if the installation is too busy
+		if release, ok := s.opts.InstallationLimiter.acquire(c.Request.Context(), instID); ok {
+			ctx, cancel := apiContext(c)
+			if err := s.reportPending(ctx, repo, instID, rev.Commit, builds[0], proj); err != nil {
+				log.Printf("Failed to report pending status for %s@%s: %s", repo, rev.Commit, err)
+			}
+			cancel()
+			release()
+		} else {
+			log.Printf("Skipped pending status for %s@%s: too many concurrent requests for installation %d", repo, rev.Commit, instID)
+		}
+	}
+
+	completeResponse(c, builds)
+}
+
+// qualifyRef returns the fully qualified git ref for a branch or tag name,
+// given the ref_type of create and delete events. Other names are returned as
+// is.
+func qualifyRef(refType, name string) string {
+	if name == "" || strings.HasPrefix(name, "refs/") {
+		return name
+	}
+	switch refType {
+	case "branch":
+		return "refs/heads/" + name
+	case "tag":
+		return "refs/tags/" + name
+	}
+	return name
+}
+
+// pingWarnings reports settings of the webhook described by a ping that the
+// gateway can't work with: payloads that aren't JSON, disabled SSL
+// verification, and subscriptions to events that are never handled.
+func pingWarnings(e *github.PingEvent) []string {
+	hook := e.GetHook()
+	if hook == nil {
+		return nil
+	}
+	var warnings []string
+	if ct, ok := hook.Config["content_type"]; ok && fmt.Sprint(ct) != "json" {
+		warnings = append(warnings, fmt.Sprintf("webhook content type is %q, but the gateway expects \"json\"", ct))
+	}
+	if insecure, ok := hook.Config["insecure_ssl"]; ok && fmt.Sprint(insecure) != "0" {
+		warnings = append(warnings, "webhook has SSL verification disabled")
+	}
+	if unknown := UnknownEvents(hook.Events); len(unknown) > 0 {
+		warnings = append(warnings, fmt.Sprintf("webhook subscribes to events the gateway ignores: %s", strings.Join(unknown, ", ")))
+	}
+	return warnings
+}
+
+// repoEvent is implemented by events that belong to a repository.
+type repoEvent interface {
+	GetRepo() *github.Repository
+}
+
+// extractRevision determines the repository, revision and action of an event.
+//
+// For issue comments the revision is left empty, as it can only be determined
+// by fetching the corresponding pull request, if any.
+//
+// It has no side effects, so that it can be shared with tooling that inspects
+// payloads offline.
+func extractRevision(
+	eventType string,
+	event interface{},
+) (repo string, rev brigade.Revision, action string, err error) {
 	switch e := event.(type) {
+	case *github.CheckRunEvent:
+		action = e.GetAction()
+		repo = e.Repo.GetFullName()
+		rev.Commit = e.CheckRun.CheckSuite.GetHeadSHA()
+		rev.Ref = e.CheckRun.CheckSuite.GetHeadBranch()
+	case *github.CheckSuiteEvent:
+		action = e.GetAction()
+		repo = e.Repo.GetFullName()
+		rev.Commit = e.CheckSuite.GetHeadSHA()
+		rev.Ref = e.CheckSuite.GetHeadBranch()
 	case *github.CommitCommentEvent:
 		action = e.GetAction()
 		repo = e.Repo.GetFullName()
 		rev.Commit = e.Comment.GetCommitID()
 	case *github.CreateEvent:
-		// TODO: There are three ref_type values: tag, branch, and repo. Do we
-		// want to be opinionated about how we handle these?
+		// The ref_type (branch, tag or repository) qualifies the event the way
+		// an action would
+		action = e.GetRefType()
+		repo = e.Repo.GetFullName()
+		rev.Ref = qualifyRef(e.GetRefType(), e.GetRef())
+	case *github.DeleteEvent:
+		// The deleted ref can't be checked out, so the revision is left for the
+		// handler to fill in
+		action = e.GetRefType()
 		repo = e.Repo.GetFullName()
-		rev.Ref = e.GetRef()
 	case *github.DeploymentEvent:
 		repo = e.Repo.GetFullName()
 		rev.Commit = e.Deployment.GetSHA()
 		rev.Ref = e.Deployment.GetRef()
 	case *github.DeploymentStatusEvent:
+		// The state (success, failure, ...) is what scripts need to branch on
+		action = e.DeploymentStatus.GetState()
 		repo = e.Repo.GetFullName()
 		rev.Commit = e.Deployment.GetSHA()
 		rev.Ref = e.Deployment.GetRef()
-	case *github.PullRequestEvent:
-		if !s.isAllowedPullRequest(e) {
-			c.JSON(http.StatusOK, gin.H{"status": "build skipped"})
-			return
+	case *github.GollumEvent:
+		// Wiki edits aren't commits to the repository, so the revision is left
+		// for the handler to fill in
+		repo = e.Repo.GetFullName()
+	case *github.IssueCommentEvent:
+		action = e.GetAction()
+		repo = e.Repo.GetFullName()
+	case *github.InstallationEvent:
+		// Installations belong to the app, not a repository
+		action = e.GetAction()
+	case *github.InstallationRepositoriesEvent:
+		action = e.GetAction()
+	case *github.MembershipEvent:
+		// Memberships belong to an organization, not a repository
+		action = e.GetAction()
+	case *PackageEvent:
+		action = e.GetAction()
+		repo = e.Repo.GetFullName()
+		version := e.GetPackage().GetPackageVersion()
+		rev.Commit = version.GetTargetOID()
+		// The target is a branch name, unless it is a commit SHA already
+		// named by the target OID
+		if target := version.GetTargetCommitish(); !commitSHARegex.MatchString(target) {
+			rev.Ref = qualifyRef("branch", target)
 		}
-		pre = e
+	case *github.PullRequestEvent:
 		action = e.GetAction()
-		shortTitle, longTitle = getTitlesFromPR(pre.PullRequest)
 		repo = e.Repo.GetFullName()
 		rev.Commit = e.PullRequest.Head.GetSHA()
 		rev.Ref = fmt.Sprintf("refs/pull/%d/head", e.PullRequest.GetNumber())
 	case *github.PullRequestReviewEvent:
 		action = e.GetAction()
-		shortTitle, longTitle = getTitlesFromPR(e.PullRequest)
 		repo = e.Repo.GetFullName()
 		rev.Commit = e.PullRequest.Head.GetSHA()
 		rev.Ref = fmt.Sprintf("refs/pull/%d/head", e.PullRequest.GetNumber())
 	case *github.PullRequestReviewCommentEvent:
 		action = e.GetAction()
-		shortTitle, longTitle = getTitlesFromPR(e.PullRequest)
 		repo = e.Repo.GetFullName()
 		rev.Commit = e.PullRequest.Head.GetSHA()
 		rev.Ref = fmt.Sprintf("refs/pull/%d/head", e.PullRequest.GetNumber())
 	case *github.PushEvent:
-		// If this is a branch deletion, skip the build.
-		if e.GetDeleted() {
-			c.JSON(http.StatusOK, gin.H{"status": "build skipped on branch deletion"})
-			return
-		}
-		shortTitle, longTitle = getTitlesFromPushEvent(e)
 		repo = e.Repo.GetFullName()
 		rev.Commit = e.HeadCommit.GetID()
 		rev.Ref = e.GetRef()
 	case *github.ReleaseEvent:
 		action = e.GetAction()
 		repo = e.Repo.GetFullName()
-		rev.Ref = e.Release.GetTagName()
+		rev.Ref = qualifyRef("tag", e.Release.GetTagName())
+		// The target is usually a branch, which may have moved on since the
+		// release was made, so only a commit SHA is used
+		if target := e.Release.GetTargetCommitish(); commitSHARegex.MatchString(target) {
+			rev.Commit = target
+		}
 	case *github.StatusEvent:
 		repo = e.Repo.GetFullName()
 		rev.Commit = e.Commit.GetSHA()
+	case *SponsorshipEvent:
+		// Sponsorships belong to an account, not a repository
+		action = e.GetAction()
+	case *StarEvent:
+		action = e.GetAction()
+		repo = e.Repo.GetFullName()
+	case *github.TeamEvent:
+		// Only changes to a team's repository access carry a repository
+		action = e.GetAction()
+		repo = e.Repo.GetFullName()
+	case *github.WatchEvent:
+		action = e.GetAction()
+		repo = e.Repo.GetFullName()
+	case *UnknownEvent:
+		// Only the bare event type is emitted, as its actions aren't known
+		repo = e.Repo.GetFullName()
 	default:
-		log.Printf("Failed to parse payload")
-		c.JSON(http.StatusBadRequest, gin.H{"status": "Received data is not valid JSON"})
-		return
-	}
-
-	proj, err := s.getValidatedProject(c, repo, body)
-	if err != nil {
-		log.Printf("Project validation failed: %s", err)
-		return
-	}
-
-	// If s.opts.CheckSuiteOnPR is set, AND the action is one that indicates code
-	// may have changed and needs to be checked, this will create a new check
-	// suite request.
-	if eventType == "pull_request" && s.opts.CheckSuiteOnPR &&
-		(action == "opened" || action == "synchronize" || action == "reopened") {
-		if err := s.prToCheckSuite(c, pre, proj); err != nil {
-			if err == ErrAuthFailed {
-				c.JSON(http.StatusForbidden, gin.H{"status": err.Error()})
-			}
-			c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
-			return
-		}
-		// TODO: do we return here (e.g. stop the PR hook) if we get to this point
+		err = fmt.Errorf("unsupported payload for %q event: %T", eventType, event)
 	}
-
-	s.scheduleBuild(eventType, action, shortTitle, longTitle, rev, body, proj)
-
-	c.JSON(http.StatusOK, gin.H{"status": "Complete"})
+	return repo, rev, action, err
 }
 
 // handleCheck handles events from the GitHub Checks API
@@ -232,69 +780,72 @@ func (s *githubHook) handleCheck(
 	event interface{},
 	body []byte,
 ) {
-	var action string
-	var repo string
-	var rev brigade.Revision
+	// This can be check_suite:requested, check_suite:rerequested, and check_suite:completed
+	repo, rev, action, err := extractRevision(eventType, event)
+	if err != nil {
+		log.Printf("Failed to parse payload: %s", err)
+		errorResponse(c, http.StatusBadRequest, CodeInvalidPayload, "Received data is not valid JSON")
+		return
+	}
+
 	var res *Payload
 	switch e := event.(type) {
 	case *github.CheckSuiteEvent:
 		res = &Payload{
-			Body:   e,
-			AppID:  int(e.CheckSuite.App.GetID()),
-			InstID: int(e.Installation.GetID()),
+			AppID:  e.CheckSuite.App.GetID(),
+			InstID: e.Installation.GetID(),
 			Type:   "check_suite",
 		}
-
-		if res.AppID != s.opts.AppID {
-			log.Printf("This was destined for app %d, not us (%d)", res.AppID, s.opts.AppID)
-			return
+		if action == "completed" {
+			res.Conclusion = e.CheckSuite.GetConclusion()
 		}
-
-		// This can be check_suite:requested, check_suite:rerequested, and check_suite:completed
-		action = e.GetAction()
-		repo = e.Repo.GetFullName()
-		rev.Commit = e.CheckSuite.GetHeadSHA()
-		rev.Ref = e.CheckSuite.GetHeadBranch()
-
 	case *github.CheckRunEvent:
 		res = &Payload{
-			Body:   e,
-			AppID:  int(e.CheckRun.App.GetID()),
-			InstID: int(e.Installation.GetID()),
+			AppID:  e.CheckRun.App.GetID(),
+			InstID: e.Installation.GetID(),
 			Type:   "check_run",
 		}
 
 		if res.AppID == 0 {
-			res.AppID = int(e.CheckRun.CheckSuite.App.GetID())
+			res.AppID = e.CheckRun.CheckSuite.App.GetID()
 		}
-
-		if res.AppID != s.opts.AppID {
-			log.Printf("This was destined for app %d, not us (%d)", res.AppID, s.opts.AppID)
-			return
+		if action == "completed" {
+			res.Conclusion = e.CheckRun.GetConclusion()
 		}
+	}
+	res.Sender = getSender(event)
+	res.PRNumber, res.BaseRef = checkPullRequest(event)
 
-		action = e.GetAction()
-		repo = e.Repo.GetFullName()
-		rev.Commit = e.CheckRun.CheckSuite.GetHeadSHA()
-		rev.Ref = e.CheckRun.CheckSuite.GetHeadBranch()
+	if res.AppID != int64(s.opts.AppID) {
+		log.Printf("This was destined for app %d, not us (%d)", res.AppID, s.opts.AppID)
+		return
 	}
 
-	proj, err := s.getValidatedProject(c, repo, body)
+	proj, err := s.getValidatedProject(c, repo, body, true)
 	if err != nil {
 		log.Printf("Project validation failed: %s", err)
 		return
 	}
+	if app := c.Param("app"); app != "" && !matchesID(app, res.AppID) {
+		log.Printf("App %d does not match the route's %q", res.AppID, app)
+		errorResponse(c, http.StatusForbidden, CodeRouteMismatch, "app does not match route")
+		return
+	}
+	if !s.acceptDelivery(c, repo, eventType, event) {
+		return
+	}
 
-	tok, timeout, err := ghlib.GetInstallationToken(
-		proj.Github.BaseURL,
-		proj.Github.UploadURL,
-		int64(res.AppID),
-		int64(res.InstID),
-		s.key,
-	)
+	release, ok := s.limitInstallation(c, res.InstID)
+	if !ok {
+		return
+	}
+	tok, timeout, err := s.installationToken(c.Request.Context(), proj, res.AppID, res.InstID, checkFromFork(event))
+	release()
 	if err != nil {
 		log.Printf("Failed to negotiate a token: %s", err)
-		c.JSON(http.StatusForbidden, gin.H{"status": ErrAuthFailed})
+		if !retryLaterResponse(c, err) {
+			errorResponse(c, http.StatusForbidden, CodeAuthFailed, ErrAuthFailed.Error())
+		}
 		return
 	}
 	res.Token = tok
@@ -302,12 +853,19 @@ func (s *githubHook) handleCheck(
 
 	payload, err := marshalWithGithubPayload(res, body)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "JSON encoding error"})
+		log.Printf("Failed to encode payload: %s%s", err, s.loggedBody(body))
+		errorResponse(c, http.StatusInternalServerError, CodeEncodingFailed, "JSON encoding error")
+		return
 	}
 
-	s.scheduleBuild(eventType, action, "", "", rev, payload, proj)
-
-	c.JSON(http.StatusOK, gin.H{"status": "Complete"})
+	builds, err := s.scheduleBuild(c.Request.Context(), eventType, action, event, "", "", rev, payload, proj)
+	if err != nil {
+		if !retryLaterResponse(c, err) {
+			errorResponse(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		}
+		return
+	}
+	completeResponse(c, builds)
 }
 
 // handleIssueComment handles an "issue_comment" event type
@@ -325,28 +883,29 @@ func (s *githubHook) handleIssueComment(
 	event interface{},
 	body []byte,
 ) {
-	var action string
-	var repo string
-	var rev brigade.Revision
+	repo, rev, action, err := extractRevision(eventType, event)
+	if err != nil {
+		log.Printf("Failed to parse payload: %s", err)
+		errorResponse(c, http.StatusBadRequest, CodeInvalidPayload, "Received data is not supported or not valid JSON")
+		return
+	}
+	ice := event.(*github.IssueCommentEvent)
 	var payload []byte
-	var ice *github.IssueCommentEvent
 
-	switch e := event.(type) {
-	case *github.IssueCommentEvent:
-		ice = e
-		action = e.GetAction()
-		repo = e.Repo.GetFullName()
-	default:
-		log.Printf("Failed to parse payload")
-		c.JSON(http.StatusBadRequest, gin.H{"status": "Received data is not supported or not valid JSON"})
+	// The labels of the issue are those of the pull request
+	if ice.Issue.IsPullRequest() && s.hasSkipLabel(ice.Issue.Labels) {
+		c.JSON(http.StatusOK, gin.H{"status": "build skipped: pull request is labeled " + s.opts.SkipPRLabel})
 		return
 	}
 
-	proj, err := s.getValidatedProject(c, repo, body)
+	proj, err := s.getValidatedProject(c, repo, body, true)
 	if err != nil {
 		log.Printf("Project validation failed: %s", err)
 		return
 	}
+	if !s.acceptDelivery(c, repo, eventType, event) {
+		return
+	}
 
 	var shortTitle, longTitle string
 	if ice != nil {
@@ -360,24 +919,45 @@ func (s *githubHook) handleIssueComment(
 			if ice.Issue.IsPullRequest() {
 				// If author association of issue comment is not in allowed list, we return,
 				// as we don't wish to populate event with actionable data (for requesting check runs, etc.)
-				if assoc := ice.Comment.GetAuthorAssociation(); !s.isAllowedAuthor(assoc) {
+				if assoc := ice.Comment.GetAuthorAssociation(); !s.isAllowedAuthor(ice.Repo.GetFullName(), assoc) {
 					log.Printf("not fetching corresponding pull request as issue comment is from disallowed author %s", assoc)
 				} else {
-					rev, payload = s.updateIssueCommentEvent(c, s, ice, rev, proj, body)
+					release, ok := s.limitInstallation(c, ice.Installation.GetID())
+					if !ok {
+						return
+					}
+					rev, payload, ok = s.updateIssueCommentEvent(c, s, ice, rev, proj, body)
+					release()
+					if !ok {
+						return
+					}
 				}
 			}
 		}
 	}
 
 	// If rev ref still unset, as may be the case for an issue comment
-	// unrelated to any Pull Request, we set to master so builds can instantiate
+	// unrelated to any Pull Request, we set to the repo's default branch so
+	// builds can instantiate
 	if rev.Ref == "" {
-		rev.Ref = "refs/heads/master"
+		release, ok := s.limitInstallation(c, ice.Installation.GetID())
+		if !ok {
+			return
+		}
+		ctx, cancel := apiContext(c)
+		rev.Ref = s.defaultRef(ctx, ice.Repo, ice.Installation.GetID(), proj)
+		cancel()
+		release()
 	}
 
-	s.scheduleBuild(eventType, action, shortTitle, longTitle, rev, payload, proj)
-
-	c.JSON(http.StatusOK, gin.H{"status": "Complete"})
+	builds, err := s.scheduleBuild(c.Request.Context(), eventType, action, event, shortTitle, longTitle, rev, payload, proj)
+	if err != nil {
+		if !retryLaterResponse(c, err) {
+			errorResponse(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		}
+		return
+	}
+	completeResponse(c, builds)
 }
 
 // updateIssueCommentEvent updates a raw github.IssueCommentEvent with further context
@@ -385,28 +965,41 @@ func (s *githubHook) handleIssueComment(
 // For such events associated with Pull Requests, here we update with pertinent GitHub
 // App details (including authz token) such that consumers of the resulting Brigade
 // event have the power to request check suites or check runs on the said Pull Request.
-func updateIssueCommentEvent(c *gin.Context, s *githubHook, ice *github.IssueCommentEvent, rev brigade.Revision, proj *brigade.Project, body []byte) (brigade.Revision, []byte) {
+//
+// It returns false if it responded with an error, in which case no builds are
+// to be scheduled.
+func updateIssueCommentEvent(c *gin.Context, s *githubHook, ice *github.IssueCommentEvent, rev brigade.Revision, proj *brigade.Project, body []byte) (brigade.Revision, []byte, bool) {
 	appID := s.opts.AppID
 	instID := ice.Installation.GetID()
 
-	tok, timeout, err := ghlib.GetInstallationToken(
-		proj.Github.BaseURL,
-		proj.Github.UploadURL,
-		int64(appID),
-		instID,
-		s.key,
-	)
+	tok, timeout, err := s.installationToken(c.Request.Context(), proj, int64(appID), instID, false)
 	if err != nil {
 		log.Printf("Failed to negotiate a token: %s", err)
-		c.JSON(http.StatusForbidden, gin.H{"status": ErrAuthFailed})
-		return rev, body
+		if !retryLaterResponse(c, err) {
+			errorResponse(c, http.StatusForbidden, CodeAuthFailed, ErrAuthFailed.Error())
+		}
+		return rev, body, false
 	}
 
-	pullRequest, err := getPRFromIssueComment(c, s, tok, ice, proj)
+	ctx, cancel := apiContext(c)
+	defer cancel()
+	pullRequest, err := getPRFromIssueComment(ctx, s, tok, ice, proj)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError,
-			gin.H{"status": "failed to fetch pull request for corresponding issue comment"})
-		return rev, body
+		errorResponse(c, http.StatusInternalServerError, CodeInternal,
+			"failed to fetch pull request for corresponding issue comment")
+		return rev, body, false
+	}
+
+	// The token above was needed to look up the pull request. Builds of forks
+	// get whatever the policy allows instead.
+	if pullRequest.Head.Repo.GetFork() {
+		if tok, timeout, err = s.installationToken(c.Request.Context(), proj, int64(appID), instID, true); err != nil {
+			log.Printf("Failed to negotiate a token: %s", err)
+			if !retryLaterResponse(c, err) {
+				errorResponse(c, http.StatusForbidden, CodeAuthFailed, ErrAuthFailed.Error())
+			}
+			return rev, body, false
+		}
 	}
 
 	// Populate the brigade.Revision, as per usual
@@ -416,69 +1009,271 @@ func updateIssueCommentEvent(c *gin.Context, s *githubHook, ice *github.IssueCom
 	// Here we build/populate Brigade's webhook.Payload object
 	//
 	// Note we also add commit and branch data here, as neither is
-	// included in the github.IssueCommentEvent (here res.Body)
+	// included in the github.IssueCommentEvent (the body)
 	// The check run utility that requests check runs requires these values
 	// and does not have access to he brigade.Revision object above.
 	res := &Payload{
-		Body:         ice,
-		AppID:        appID,
-		InstID:       int(instID),
+		AppID:        int64(appID),
+		InstID:       instID,
 		Type:         "issue_comment",
 		Token:        tok,
 		TokenExpires: timeout,
 		Commit:       rev.Commit,
 		Branch:       rev.Ref,
+		Sender:       getSender(ice),
+		PRNumber:     pullRequest.GetNumber(),
+		BaseRef:      pullRequest.Base.GetRef(),
 	}
 
 	payload, err := marshalWithGithubPayload(res, body)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "JSON encoding error"})
+		log.Printf("Failed to encode payload: %s%s", err, s.loggedBody(body))
+		errorResponse(c, http.StatusInternalServerError, CodeEncodingFailed, "JSON encoding error")
+		return rev, body, false
 	}
 
-	return rev, payload
+	return rev, payload, true
 }
 
-// getValidatedProject retrieves a brigade Project using the provided repo name
-// and validates that the signature of the incoming webhook matches proj.SharedSecret
-func (s *githubHook) getValidatedProject(c *gin.Context, repo string, body []byte) (*brigade.Project, error) {
-	proj, err := s.store.GetProject(repo)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"status": "project not found"})
-		return nil, fmt.Errorf("project %q not found. no secret loaded. %s", repo, err)
+// readBody reads the body of a delivery, decompressing it if a proxy
+// compressed it with gzip on the way. GitHub signs the uncompressed body, so
+// that is what's returned for validating the signature and parsing.
+func readBody(r *http.Request) ([]byte, error) {
+	var body io.Reader = r.Body
+	if strings.EqualFold(strings.TrimSpace(r.Header.Get("Content-Encoding")), "gzip") {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
 	}
+	return ioutil.ReadAll(body)
+}
 
-	var sharedSecret = proj.SharedSecret
-	if sharedSecret == "" {
-		sharedSecret = s.opts.DefaultSharedSecret
+// loggedBody returns the part of body that may be logged, as a suffix for a
+// log message. Bodies are truncated to MaxBodyLogBytes, and not logged at all
+// if that's zero.
+func (s *githubHook) loggedBody(body []byte) string {
+	max := s.opts.MaxBodyLogBytes
+	if max <= 0 || len(body) == 0 {
+		return ""
 	}
-	if sharedSecret == "" {
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "No secret is configured for this repo."})
+	if len(body) > max {
+		return fmt.Sprintf(" (body: %q, %d more bytes truncated)", body[:max], len(body)-max)
+	}
+	return fmt.Sprintf(" (body: %q)", body)
+}
+
+// errorResponse responds with the given HTTP status, error code and
+// human-readable status message.
+func errorResponse(c *gin.Context, status int, code ErrorCode, msg string) {
+	c.JSON(status, gin.H{"status": msg, "code": code})
+}
+
+// retryLaterResponse responds with a Retry-After header if err is a
+// retry.ExhaustedError, meaning GitHub or Kubernetes is throttling us (429 Too
+// Many Requests) or unavailable (503 Service Unavailable). If the deadline of
+// the delivery passed, it responds with 503 and CodeTimeout, and if the
+// installation had no free slot, with 429. It returns false, without
+// responding, for other errors.
+func retryLaterResponse(c *gin.Context, err error) bool {
+	var exhausted *retry.ExhaustedError
+	if !errors.As(err, &exhausted) {
+		if err == errInstallationBusy {
+			errorResponse(c, http.StatusTooManyRequests, CodeTooManyRequests, err.Error())
+			return true
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			errorResponse(c, http.StatusServiceUnavailable, CodeTimeout, "request timed out")
+			return true
+		}
+		return false
+	}
+	status, code := http.StatusServiceUnavailable, CodeUnavailable
+	if retry.IsThrottled(exhausted.Err) {
+		status, code = http.StatusTooManyRequests, CodeTooManyRequests
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(exhausted.RetryAfter.Seconds()))))
+	errorResponse(c, status, code, err.Error())
+	return true
+}
+
+// completeResponse responds that the delivery was handled, with the IDs of the
+// builds created for it. buildID is the first of those, which is the build for
+// the raw event type unless that isn't emitted.
+func completeResponse(c *gin.Context, builds []*brigade.Build) {
+	res := gin.H{"status": "Complete"}
+	if len(builds) > 0 {
+		ids := make([]string, len(builds))
+		for i, b := range builds {
+			ids[i] = b.ID
+		}
+		res["buildID"] = ids[0]
+		res["buildIDs"] = ids
+	}
+	c.Set(buildsKey, len(builds))
+	c.JSON(http.StatusOK, res)
+}
+
+// getValidatedProject retrieves a brigade Project using the provided repo name
+// and validates that the signature of the incoming webhook matches one of the
+// secrets returned by secretsFor
+func (s *githubHook) getValidatedProject(c *gin.Context, repo string, body []byte, appScoped bool) (*brigade.Project, error) {
+	proj, err := s.store.GetProject(repo)
+	if err != nil {
+		errorResponse(c, http.StatusBadRequest, CodeProjectNotFound, "project not found")
+		return nil, fmt.Errorf("project %q not found. no secret loaded. %s", repo, err)
+	}
+
+	audit := func(outcome, reason string) {
+		s.opts.AuditLog.record(AuditEntry{
+			Decision: AuditSignature,
+			Outcome:  outcome,
+			Repo:     repo,
+			Delivery: c.Request.Header.Get("X-GitHub-Delivery"),
+			Reason:   reason,
+		})
+	}
+	if s.skipSignature {
+		audit(AuditAllowed, "replayed with the replay token")
+		return proj, nil
+	}
+	if s.fromTrustedNetwork(c.Request) {
+		log.Printf("Accepting unauthenticated delivery for %s from trusted network address %s", repo, c.Request.RemoteAddr)
+		audit(AuditAllowed, "trusted network address "+c.Request.RemoteAddr)
+		return proj, nil
+	}
+
+	secrets, err := s.secretsFor(repo, proj, appScoped)
+	if err != nil {
+		audit(AuditDenied, "secret could not be resolved")
+		errorResponse(c, http.StatusServiceUnavailable, CodeUnavailable, "could not resolve the secret for this repo")
+		return nil, fmt.Errorf("could not resolve the secret for %q: %s", repo, err)
+	}
+	if len(secrets) == 0 {
+		audit(AuditDenied, "no secret is configured")
+		errorResponse(c, http.StatusInternalServerError, CodeNoSecret, "No secret is configured for this repo.")
 		return nil, fmt.Errorf("no secret is configured for this repo")
 	}
 
 	signature := c.Request.Header.Get(hubSignatureHeader)
-	if err := validateSignature(signature, sharedSecret, body); err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"status": "malformed signature"})
+	if err := validateSignature(signature, secrets, body); err != nil {
+		audit(AuditDenied, "signature does not match")
+		errorResponse(c, http.StatusForbidden, CodeSignatureInvalid, "malformed signature")
 		return nil, fmt.Errorf("signature validation failed")
 	}
+	audit(AuditAllowed, "")
 	return proj, nil
 }
 
+// acceptDelivery decides whether a delivery that getValidatedProject has
+// authenticated is handled, responding if it isn't. It only runs once the
+// signature is validated, so that unsigned deliveries are refused rather than
+// skipped, and can't be used to probe which installations a route serves or
+// which repos and orgs are allowlisted.
+func (s *githubHook) acceptDelivery(c *gin.Context, repo, eventType string, event interface{}) bool {
+	if len(s.opts.RepoAllowlist) > 0 && !matchesAny(s.opts.RepoAllowlist, repo) {
+		log.Printf("Skipping %s event for %s: repo is not in the allowlist", eventType, repo)
+		c.JSON(http.StatusOK, gin.H{"status": "build skipped: repo not allowed"})
+		return false
+	}
+	if owner := strings.SplitN(repo, "/", 2)[0]; len(s.opts.OrgAllowlist) > 0 && !matchesAny(s.opts.OrgAllowlist, owner) {
+		log.Printf("Skipping %s event for %s: org is not in the allowlist", eventType, repo)
+		c.JSON(http.StatusOK, gin.H{"status": "build skipped: org not allowed"})
+		return false
+	}
+	// Deliveries to /events/github/:app/:inst must be for that installation
+	if inst := c.Param("inst"); inst != "" && !matchesID(inst, getInstallationID(event)) {
+		log.Printf("Installation %d does not match the route's %q", getInstallationID(event), inst)
+		errorResponse(c, http.StatusForbidden, CodeRouteMismatch, "installation does not match route")
+		return false
+	}
+	if s.isStale(event) {
+		log.Printf("Skipping %s event older than %s", eventType, s.opts.MaxEventAge)
+		c.JSON(http.StatusOK, gin.H{"status": "build skipped: event is too old"})
+		return false
+	}
+	return true
+}
+
+// fromTrustedNetwork returns whether the request was made from one of
+// GithubOpts.TrustedNetworks.
+func (s *githubHook) fromTrustedNetwork(r *http.Request) bool {
+	if len(s.opts.TrustedNetworks) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.opts.TrustedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// secretsFor returns the secrets a webhook for the given project may be signed
+// with, in order of preference.
+//
+// App-scoped events are expected to be signed with the GitHub App's webhook
+// secret. All events may be signed with the secret of the repo returned by
+// GithubOpts.SecretResolver or, if there is none, the project's shared secret
+// or, if the project has none either, the gateway's default shared secret.
+//
+// Each of these may be a comma-separated list, so that a new secret can be
+// rolled out while deliveries signed with the old one are still accepted.
+func (s *githubHook) secretsFor(repo string, proj *brigade.Project, appScoped bool) ([]string, error) {
+	var secrets []string
+	if appScoped {
+		secrets = append(secrets, splitSecrets(s.opts.AppWebhookSecret)...)
+	}
+	var sharedSecret string
+	if s.opts.SecretResolver != nil {
+		var err error
+		if sharedSecret, err = s.opts.SecretResolver.SecretFor(repo); err != nil {
+			return nil, err
+		}
+	}
+	if sharedSecret == "" {
+		sharedSecret = proj.SharedSecret
+	}
+	if sharedSecret == "" {
+		sharedSecret = s.opts.DefaultSharedSecret
+	}
+	return append(secrets, splitSecrets(sharedSecret)...), nil
+}
+
+// splitSecrets splits a comma-separated list of secrets, dropping empty
+// entries.
+func splitSecrets(list string) []string {
+	var secrets []string
+	for _, secret := range strings.Split(list, ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
 // marshalWithGithubPayload marshals a provided Payload after setting
 // Payload.Body to the provided GitHub payload body
+//
+// The body is embedded as-is rather than decoded and re-encoded, which would be
+// needlessly expensive for large payloads and would corrupt integers that
+// don't fit in a float64, such as large IDs.
 func marshalWithGithubPayload(res *Payload, body []byte) ([]byte, error) {
-	// Remarshal the body back into JSON
-	pl := map[string]interface{}{}
-	err := json.Unmarshal(body, &pl)
-	if err != nil {
-		log.Printf("Failed to re-parse body: %s", err)
-		return []byte{}, err
-	}
-	res.Body = pl
+	res.Body = json.RawMessage(body)
+	res.Version = PayloadVersion
 
 	payload, err := json.Marshal(res)
 	if err != nil {
-		log.Print(err)
 		return []byte{}, err
 	}
 
@@ -486,53 +1281,195 @@ func marshalWithGithubPayload(res *Payload, body []byte) ([]byte, error) {
 }
 
 // scheduleBuild schedules a Brigade build both for the raw eventType
-// and for each action of the event, when applicable
+// and for each action of the event, when applicable, as well as for any
+// extraTypes, unless the configured EventFilter suppresses them.
+//
+// Builds that can't be created are skipped. If Kubernetes is throttling or
+// unavailable for longer than retries allow, or ctx is done, no further
+// builds are tried, and the error is returned unless some builds were already
+// created. Those are returned instead, as having GitHub redeliver the event
+// would create them again. If the repository's topics are needed but the
+// installation has no free slot to look them up, errInstallationBusy is
+// returned before any build is created.
 func (s *githubHook) scheduleBuild(
+	ctx context.Context,
 	eventType string,
 	action string,
+	event interface{},
 	shortTitle string,
 	longTitle string,
 	rev brigade.Revision,
 	payload []byte,
 	proj *brigade.Project,
-) {
-	// Schedule a build using the raw eventType
-	s.build(eventType, shortTitle, longTitle, rev, payload, proj)
-	// For events that have an action, schedule a second build for eventType:action
+	extraTypes ...string,
+) ([]*brigade.Build, error) {
+	filter := s.opts.EventFilter
+	if filter == nil {
+		filter = PassThroughEventFilter
+	}
+	emit, filterTypes := filter(eventType, action, event, proj)
+	if !emit {
+		log.Printf("Builds for %q event suppressed by event filter", eventType)
+		return nil, nil
+	}
+	extraTypes = append(extraTypes, filterTypes...)
+	gw := s.gatewayFields(event)
+	gw.Labels = eventLabels(eventType, action, event)
+	if s.opts.RepoTopics || s.opts.EmitTopicEvents {
+		release, ok := s.opts.InstallationLimiter.acquire(ctx, getInstallationID(event))
+		if !ok {
+			return nil, errInstallationBusy
+		}
+		topicsCtx, cancel := context.WithTimeout(ctx, apiTimeout)
+		gw.Topics = s.repoTopics(topicsCtx, event, proj)
+		cancel()
+		release()
+		if s.opts.EmitTopicEvents {
+			extraTypes = append(extraTypes, topicTypes(eventType, action, gw.Topics)...)
+		}
+	}
+	if withGW, err := withGateway(payload, gw); err != nil {
+		log.Printf("Failed to add %+v to the %s payload: %s", gw, eventType, err)
+	} else {
+		payload = withGW
+	}
+	var builds []*brigade.Build
+	for _, buildType := range s.buildTypes(eventType, action, extraTypes...) {
+		buildPayload := payload
+		if s.opts.PayloadEnricher != nil {
+			var err error
+			if buildPayload, err = s.opts.PayloadEnricher(buildType, rev, payload); err != nil {
+				log.Printf("Failed to enrich %s payload: %s", buildType, err)
+				continue
+			}
+		}
+		b, err := s.build(ctx, buildType, shortTitle, longTitle, rev, buildPayload, proj)
+		if err != nil {
+			log.Printf("Failed to create %s build: %s", buildType, err)
+			var exhausted *retry.ExhaustedError
+			if errors.As(err, &exhausted) || ctx.Err() != nil {
+				if len(builds) == 0 {
+					return nil, err
+				}
+				return builds, nil
+			}
+			continue
+		}
+		builds = append(builds, b)
+	}
+	return builds, nil
+}
+
+// gatewayFields returns the Gateway fields of the payload of every build of
+// event, other than its labels and the repository's topics. Those are added by
+// scheduleBuild, since they depend on the action or may need to be looked up.
+func (s *githubHook) gatewayFields(event interface{}) *Gateway {
+	gw := &Gateway{PayloadVersion: PayloadVersion, WorkerImage: s.opts.WorkerImage}
+	if instID := getInstallationID(event); instID != 0 {
+		gw.InstallationID = instID
+		gw.AppID = int64(s.opts.AppID)
+	}
+	if e, ok := event.(*github.CommitCommentEvent); ok {
+		gw.CommentBody = e.Comment.GetBody()
+		// Only comments on a line of the commit's diff have a path and
+		// position
+		if path := e.Comment.GetPath(); path != "" {
+			gw.CommentPath = path
+			gw.CommentPosition = e.Comment.GetPosition()
+		}
+	}
+	return gw
+}
+
+// eventLabels returns the labels describing what triggered the builds of
+// event, so that builds can be queried by them: the raw GitHub event type, and
+// the action and repository if the event has them. brigade.Build has no labels
+// of its own, so they are added to the payload.
+func eventLabels(eventType, action string, event interface{}) map[string]string {
+	labels := map[string]string{"event": eventType}
 	if action != "" {
-		s.build(
-			fmt.Sprintf("%s:%s", eventType, action),
-			shortTitle,
-			longTitle,
-			rev,
-			payload,
-			proj,
-		)
+		labels["action"] = action
+	}
+	var repo string
+	switch e := event.(type) {
+	case *github.PushEvent:
+		// Push events have a repository type of their own
+		repo = e.GetRepo().GetFullName()
+	case repoEvent:
+		repo = e.GetRepo().GetFullName()
+	}
+	if repo != "" {
+		labels["repo"] = repo
+	}
+	return labels
+}
+
+// buildTypes returns the event types that Brigade builds are scheduled for:
+// the raw eventType, for events that have an action, eventType:action (and
+// eventType:* if EmitWildcardActions is set) and any extraTypes, unless
+// NoActionEvents is set. Types that the gateway is not configured to emit are
+// omitted. The EventAliases of the remaining types are added after them, and
+// all of them are prefixed with EventPrefix.
+func (s *githubHook) buildTypes(eventType, action string, extraTypes ...string) []string {
+	types := []string{eventType}
+	if s.opts.NoActionEvents {
+		action, extraTypes = "", nil
+	}
+	if action != "" {
+		types = append(types, fmt.Sprintf("%s:%s", eventType, action))
+		if s.opts.EmitWildcardActions {
+			types = append(types, eventType+":*")
+		}
+	}
+	types = append(types, extraTypes...)
+	emitted := make([]string, 0, len(types))
+	for _, t := range types {
+		if s.shouldEmit(t) {
+			emitted = append(emitted, t)
+		}
+	}
+	seen := make(map[string]bool, len(emitted))
+	for _, t := range emitted {
+		seen[t] = true
+	}
+	for _, t := range emitted {
+		for _, alias := range s.opts.EventAliases[t] {
+			if !seen[alias] {
+				seen[alias] = true
+				emitted = append(emitted, alias)
+			}
+		}
+	}
+	if s.opts.EventPrefix != "" {
+		for i, t := range emitted {
+			emitted[i] = s.opts.EventPrefix + t
+		}
 	}
+	return emitted
 }
 
 // getPRFromIssueComment fetches a pull request from a corresponding github.IssueCommentEvent
-func getPRFromIssueComment(c *gin.Context, s *githubHook, token string, ice *github.IssueCommentEvent, proj *brigade.Project) (*github.PullRequest, error) {
+func getPRFromIssueComment(ctx context.Context, s *githubHook, token string, ice *github.IssueCommentEvent, proj *brigade.Project) (*github.PullRequest, error) {
 	repo := ice.Repo.GetFullName()
 
 	client, err := ghlib.NewClientFromInstallationToken(
 		proj.Github.BaseURL,
 		proj.Github.UploadURL,
 		token,
+		s.opts.ClientOptions...,
 	)
 	if err != nil {
 		log.Printf("Failed to create a new installation token client: %s", err)
 		return nil, ErrAuthFailed
 	}
 
-	projectNames := strings.Split(repo, "/")
-	if len(projectNames) != 2 {
+	owner, pname, err := ghlib.SplitRepoName(repo)
+	if err != nil {
 		log.Printf("Repo %q is invalid. Should be github.com/ORG/NAME.", repo)
-		return nil, errors.New("invalid repo name")
+		return nil, err
 	}
-	owner, pname := projectNames[0], projectNames[1]
 
-	pullRequest, resp, err := client.PullRequests.Get(c, owner, pname, ice.Issue.GetNumber())
+	pullRequest, resp, err := client.PullRequests.Get(ctx, owner, pname, ice.Issue.GetNumber())
 	if err != nil {
 		log.Printf("Failed to get pull request: %s", err)
 		return nil, err
@@ -559,53 +1496,110 @@ func getPRFromIssueComment(c *gin.Context, s *githubHook, token string, ice *git
 // 		  not actually trigger a check_suite:requested webhook event
 //		- if failure, check to see if we already have a check suite object, and merely run the rerequest
 //		  on that check suite.
-func (s *githubHook) prToCheckSuite(c *gin.Context, pre *github.PullRequestEvent, proj *brigade.Project) error {
+func (s *githubHook) prToCheckSuite(ctx context.Context, pre *github.PullRequestEvent, proj *brigade.Project) error {
 	repo := pre.Repo.GetFullName()
-	ref := fmt.Sprintf("refs/pull/%d/head", pre.PullRequest.GetNumber())
-	sha := pre.PullRequest.Head.GetSHA()
+	owner, pname, err := ghlib.SplitRepoName(repo)
+	if err != nil {
+		log.Printf("Repo %q is invalid. Should be github.com/ORG/NAME.", repo)
+		return err
+	}
+	return s.requestCheckSuite(
+		ctx,
+		proj,
+		pre.Installation.GetID(),
+		owner,
+		pname,
+		pre.PullRequest.Head.GetSHA(),
+		fmt.Sprintf("refs/pull/%d/head", pre.PullRequest.GetNumber()),
+	)
+}
+
+// checkSuiteOnPRSecret is the project secret that overrides
+// GithubOpts.CheckSuiteOnPR for the project, e.g. for repos that don't use
+// the Checks API.
+const checkSuiteOnPRSecret = "GITHUB_CHECK_SUITE_ON_PR"
+
+// checkSuiteOnPR returns whether check suites should be requested for the
+// project's pull requests.
+func (s *githubHook) checkSuiteOnPR(proj *brigade.Project) bool {
+	if v, ok := proj.Secrets[checkSuiteOnPRSecret]; ok {
+		if b, err := strconv.ParseBool(fmt.Sprint(v)); err == nil {
+			return b
+		}
+		log.Printf("Ignoring invalid %s %q", checkSuiteOnPRSecret, v)
+	}
+	return s.opts.CheckSuiteOnPR
+}
+
+// requestCheckSuite creates a check suite for the given commit as the app
+// installation and rerequests it, so that a check_suite:rerequested webhook is
+// sent. If a suite already exists, the app's latest suite for the commit is
+// rerequested instead.
+func (s *githubHook) requestCheckSuite(ctx context.Context, proj *brigade.Project, instID int64, owner, pname, sha, ref string) error {
 	appID := s.opts.AppID
-	instID := pre.Installation.GetID()
 
-	client, err := ghlib.NewClientFromKeyPEM(
-		proj.Github.BaseURL,
-		proj.Github.UploadURL,
-		int64(appID),
-		instID,
-		s.key,
-	)
+	client, err := s.appClient(ctx, proj, int64(appID), instID)
 	if err != nil {
 		log.Printf("Failed to create a new installation token client: %s", err)
+		// Neither GitHub being unavailable nor the request ending is an
+		// authentication failure
+		var exhausted *retry.ExhaustedError
+		if errors.As(err, &exhausted) || ctx.Err() != nil {
+			return err
+		}
 		return ErrAuthFailed
 	}
 
-	projectNames := strings.Split(repo, "/")
-	if len(projectNames) != 2 {
-		log.Printf("Repo %q is invalid. Should be github.com/ORG/NAME.", repo)
-		return errors.New("invalid repo name")
-	}
-	owner, pname := projectNames[0], projectNames[1]
+	return createOrRerequestCheckSuite(ctx, client.Checks, owner, pname, sha, ref, appID)
+}
+
+// checksClient is the part of the GitHub checks API used to request check
+// suites. It is implemented by github.ChecksService.
+type checksClient interface {
+	CreateCheckSuite(ctx context.Context, owner, repo string, opts github.CreateCheckSuiteOptions) (*github.CheckSuite, *github.Response, error)
+	ListCheckSuitesForRef(ctx context.Context, owner, repo, ref string, opts *github.ListCheckSuiteOptions) (*github.ListCheckSuiteResults, *github.Response, error)
+	ReRequestCheckSuite(ctx context.Context, owner, repo string, checkSuiteID int64) (*github.Response, error)
+}
+
+// createOrRerequestCheckSuite creates a check suite for the given commit and
+// rerequests it, since merely creating a check suite does not trigger a
+// check_suite:requested webhook. If the suite already exists, the latest of
+// the app's suites for the commit is rerequested instead.
+func createOrRerequestCheckSuite(ctx context.Context, client checksClient, owner, repo, sha, ref string, appID int) error {
 	csOpts := github.CreateCheckSuiteOptions{
-		HeadSHA:    sha,
-		HeadBranch: &ref,
+		HeadSHA: sha,
 	}
-	log.Printf("requesting check suite run for %s/%s, SHA: %s", owner, pname, csOpts.HeadSHA)
-
-	cs, res, err := client.Checks.CreateCheckSuite(context.Background(), owner, pname, csOpts)
+	if ref != "" {
+		csOpts.HeadBranch = &ref
+	}
+	log.Printf("requesting check suite run for %s/%s, SHA: %s", owner, repo, csOpts.HeadSHA)
+
+	var cs *github.CheckSuite
+	var res *github.Response
+	err := retry.Do(ctx, func() error {
+		var err error
+		cs, res, err = client.CreateCheckSuite(ctx, owner, repo, csOpts)
+		return err
+	})
 	if err != nil {
 		log.Printf("Failed to create check suite: %s", err)
+		var exhausted *retry.ExhaustedError
+		if errors.As(err, &exhausted) {
+			return err
+		}
 
 		// 422 means the suite already exists.
-		if res.StatusCode != 422 {
+		if res == nil || res.StatusCode != http.StatusUnprocessableEntity {
 			return errors.New("could not create check suite")
 		}
 
 		log.Println("rerunning the last suite")
-		csl, _, err := client.Checks.ListCheckSuitesForRef(context.Background(), owner, pname, sha, &github.ListCheckSuiteOptions{
-			AppID: &s.opts.AppID,
+		csl, _, err := client.ListCheckSuitesForRef(ctx, owner, repo, sha, &github.ListCheckSuiteOptions{
+			AppID: &appID,
 		})
 		if err == nil && csl.GetTotal() > 0 {
 			log.Printf("Loading check suite %d", csl.CheckSuites[0].GetID())
-			_, err := client.Checks.ReRequestCheckSuite(context.Background(), owner, pname, csl.CheckSuites[0].GetID())
+			_, err := client.ReRequestCheckSuite(ctx, owner, repo, csl.CheckSuites[0].GetID())
 			if err != nil {
 				log.Printf("error rerunning suite: %s", err)
 			}
@@ -615,48 +1609,281 @@ func (s *githubHook) prToCheckSuite(c *gin.Context, pre *github.PullRequestEvent
 		return nil
 	}
 
-	log.Printf("Created check suite for %s with ID %d. Triggering :rerequested", ref, cs.GetID())
-	// It appears that merely creating the check suite does not trigger a check_suite:request.
-	// So we manually trigger a rerequest.
-	_, err = client.Checks.ReRequestCheckSuite(context.Background(), owner, pname, cs.GetID())
-	return err
+	log.Printf("Created check suite for %s with ID %d. Triggering :rerequested", sha, cs.GetID())
+	return retry.Do(ctx, func() error {
+		_, err := client.ReRequestCheckSuite(ctx, owner, repo, cs.GetID())
+		return err
+	})
+}
+
+// defaultRef returns the fully-qualified ref of the repo's default branch.
+//
+// The default branch is taken from the event payload when GitHub includes it,
+// and is otherwise looked up via the GitHub API as the app installation. Either
+// way it is cached per repo. If it cannot be determined, GithubOpts.DefaultRef
+// is returned.
+func (s *githubHook) defaultRef(ctx context.Context, repo *github.Repository, instID int64, proj *brigade.Project) string {
+	name := repo.GetFullName()
+	if branch := repo.GetDefaultBranch(); branch != "" {
+		s.defaultBranches.set(name, branch)
+		return "refs/heads/" + branch
+	}
+	if branch, ok := s.defaultBranches.get(name); ok {
+		return "refs/heads/" + branch
+	}
+	if branch, err := s.fetchDefaultBranch(ctx, name, instID, proj); err != nil {
+		log.Printf("Failed to determine default branch of %q: %s", name, err)
+	} else if branch != "" {
+		s.defaultBranches.set(name, branch)
+		return "refs/heads/" + branch
+	}
+	return s.fallbackRef()
+}
+
+// apiTimeout bounds the GitHub API calls made while handling a request.
+const apiTimeout = time.Minute
+
+// apiContext returns a context for GitHub API calls made while handling the
+// request, which is cancelled when the client disconnects or apiTimeout passes.
+func apiContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request.Context(), apiTimeout)
+}
+
+// fallbackRef returns the ref to build when there is no better alternative:
+// GithubOpts.DefaultRef if configured, refs/heads/master otherwise.
+func (s *githubHook) fallbackRef() string {
+	if s.opts.DefaultRef != "" {
+		return s.opts.DefaultRef
+	}
+	return "refs/heads/master"
+}
+
+// fetchDefaultBranch retrieves the name of the repo's default branch from
+// the GitHub API.
+func (s *githubHook) fetchDefaultBranch(ctx context.Context, repo string, instID int64, proj *brigade.Project) (string, error) {
+	if s.opts.AppID == 0 || instID == 0 {
+		return "", errors.New("no app installation to authenticate as")
+	}
+	owner, name, err := ghlib.SplitRepoName(repo)
+	if err != nil {
+		return "", err
+	}
+	client, err := s.appClient(ctx, proj, int64(s.opts.AppID), instID)
+	if err != nil {
+		return "", err
+	}
+	r, _, err := client.Repositories.Get(ctx, owner, name)
+	if err != nil {
+		return "", err
+	}
+	return r.GetDefaultBranch(), nil
+}
+
+// tagCommit returns the SHA of the commit the tag points to, looked up via the
+// GitHub API as the app installation and cached per repo and tag. If it cannot
+// be determined, an empty string is returned.
+func (s *githubHook) tagCommit(ctx context.Context, repo, tag string, instID int64, proj *brigade.Project) string {
+	key := repo + "@" + tag
+	if sha, ok := s.tagCommits.get(key); ok {
+		return sha
+	}
+	sha, err := s.fetchTagCommit(ctx, repo, tag, instID, proj)
+	if err != nil {
+		log.Printf("Failed to resolve tag %q of %q: %s", tag, repo, err)
+		return ""
+	}
+	s.tagCommits.set(key, sha)
+	return sha
+}
+
+// fetchTagCommit retrieves the SHA of the commit a tag points to from the
+// GitHub API, following annotated tags to their commit.
+func (s *githubHook) fetchTagCommit(ctx context.Context, repo, tag string, instID int64, proj *brigade.Project) (string, error) {
+	if s.opts.AppID == 0 || instID == 0 {
+		return "", errors.New("no app installation to authenticate as")
+	}
+	owner, name, err := ghlib.SplitRepoName(repo)
+	if err != nil {
+		return "", err
+	}
+	client, err := s.appClient(ctx, proj, int64(s.opts.AppID), instID)
+	if err != nil {
+		return "", err
+	}
+	ref, _, err := client.Git.GetRef(ctx, owner, name, "tags/"+tag)
+	if err != nil {
+		return "", err
+	}
+	obj := ref.GetObject()
+	if obj.GetType() == "tag" {
+		annotated, _, err := client.Git.GetTag(ctx, owner, name, obj.GetSHA())
+		if err != nil {
+			return "", err
+		}
+		obj = annotated.GetObject()
+	}
+	return obj.GetSHA(), nil
+}
+
+// branchCache is a concurrency-safe map of repo names to branch names, or
+// repo@tag keys to commits. A nil *branchCache caches nothing.
+type branchCache struct {
+	mu       sync.RWMutex
+	branches map[string]string
+}
+
+func newBranchCache() *branchCache {
+	return &branchCache{branches: map[string]string{}}
+}
+
+func (b *branchCache) get(repo string) (string, bool) {
+	if b == nil {
+		return "", false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	branch, ok := b.branches[repo]
+	return branch, ok
+}
+
+func (b *branchCache) set(repo, branch string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.branches[repo] = branch
 }
 
 // isAllowedPullRequest returns true if this particular pull request is allowed
-// to produce an event.
-func (s *githubHook) isAllowedPullRequest(e *github.PullRequestEvent) bool {
+// to produce an event. baseChanged indicates that the pull request was
+// retargeted to another base branch.
+func (s *githubHook) isAllowedPullRequest(e *github.PullRequestEvent, baseChanged bool) bool {
 
 	isFork := e.PullRequest.Head.Repo.GetFork()
 
 	// This applies the author association to forked PRs.
 	// PRs sent against origin will be accepted without a check.
 	// See https://developer.github.com/v4/reference/enum/commentauthorassociation/
-	if assoc := e.PullRequest.GetAuthorAssociation(); isFork && !s.isAllowedAuthor(assoc) {
+	// A maintainer may vouch for a PR from anyone by labeling it.
+	if assoc := e.PullRequest.GetAuthorAssociation(); isFork && !s.isAllowedAuthor(e.Repo.GetFullName(), assoc) && !s.hasForkAllowLabel(e.PullRequest) {
 		log.Printf("skipping pull request for disallowed author %s", assoc)
 		return false
 	}
 	switch e.GetAction() {
-	case "opened", "synchronize", "reopened", "labeled", "unlabeled", "closed":
+	case "opened", "synchronize", "reopened", "labeled", "unlabeled", "closed",
+		"auto_merge_enabled", "auto_merge_disabled", "converted_to_draft", "ready_for_review":
 		return true
+	case "edited":
+		// Retargeting changes what is being merged, so it's worth a build. Other
+		// edits (title, body) are not.
+		return baseChanged
 	}
 	log.Println("unsupported pull_request action:", e.GetAction())
 	return false
 }
 
+// isAllowedEnvironment checks the environment of a deployment against the
+// configured DeploymentEnvironments.
+func (s *githubHook) isAllowedEnvironment(env string) bool {
+	if len(s.opts.DeploymentEnvironments) == 0 {
+		return true
+	}
+	for _, e := range s.opts.DeploymentEnvironments {
+		if e == env {
+			return true
+		}
+	}
+	log.Printf("skipping deployment to environment %q", env)
+	return false
+}
+
+// isAllowedStatusContext checks the context of a status event against the
+// configured allow and deny lists.
+func (s *githubHook) isAllowedStatusContext(context string) bool {
+	if matchesAny(s.opts.StatusContextDeny, context) {
+		log.Printf("skipping status for denied context %q", context)
+		return false
+	}
+	if len(s.opts.StatusContextAllow) > 0 && !matchesAny(s.opts.StatusContextAllow, context) {
+		log.Printf("skipping status for context %q, which is not allowed", context)
+		return false
+	}
+	return true
+}
+
+// matchesAny returns true if name matches any of the given path.Match
+// patterns. Malformed patterns match nothing.
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasForkAllowLabel returns true if the pull request carries the configured
+// ForkAllowLabel.
+func (s *githubHook) hasForkAllowLabel(pr *github.PullRequest) bool {
+	return hasLabel(pr.Labels, s.opts.ForkAllowLabel)
+}
+
+// hasSkipLabel returns true if the labels include the configured SkipPRLabel.
+func (s *githubHook) hasSkipLabel(labels []*github.Label) bool {
+	return hasLabel(labels, s.opts.SkipPRLabel)
+}
+
+// hasLabel returns true if one of the labels is named name. An empty name
+// matches nothing.
+func hasLabel(labels []*github.Label, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, l := range labels {
+		if l.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// pullRequestBaseChanged returns true if the given pull_request payload
+// describes a change of the pull request's base branch.
+//
+// go-github/v32's EditChange predates changes.base, so the raw body is used.
+func pullRequestBaseChanged(body []byte) bool {
+	pl := struct {
+		Changes struct {
+			Base *json.RawMessage `json:"base"`
+		} `json:"changes"`
+	}{}
+	if err := json.Unmarshal(body, &pl); err != nil {
+		return false
+	}
+	return pl.Changes.Base != nil
+}
+
 // isAllowedAuthor checks to see if the provided author is in the list
-// of allowed authors configured on this gateway
-func (s *githubHook) isAllowedAuthor(author string) bool {
+// of allowed authors configured on this gateway. The decision is audited for
+// the given repo.
+func (s *githubHook) isAllowedAuthor(repo, author string) bool {
+	entry := AuditEntry{Decision: AuditAuthor, Outcome: AuditDenied, Repo: repo, Reason: author}
 	for _, a := range s.allowedAuthors {
 		if a == author {
-			return true
+			entry.Outcome = AuditAllowed
+			break
 		}
 	}
-	return false
+	s.opts.AuditLog.record(entry)
+	return entry.Outcome == AuditAllowed
 }
 
 func (s *githubHook) shouldEmit(eventType string) bool {
+	eventType = strings.TrimPrefix(eventType, s.opts.EventPrefix)
 	unqualifiedEventType := strings.Split(eventType, ":")[0]
 	for _, emitableEvent := range s.opts.EmittedEvents {
+		emitableEvent = strings.TrimPrefix(emitableEvent, s.opts.EventPrefix)
 		if eventType == emitableEvent || unqualifiedEventType == emitableEvent ||
 			emitableEvent == "*" {
 			return true
@@ -665,40 +1892,263 @@ func (s *githubHook) shouldEmit(eventType string) bool {
 	return false
 }
 
-// build creates a new brigade.Build using the info provided
+// build creates a new brigade.Build using the info provided, retrying while
+// Kubernetes is throttling or unavailable
 func (s *githubHook) build(
+	ctx context.Context,
 	eventType string,
 	shortTitle string,
 	longTitle string,
 	rev brigade.Revision,
 	payload []byte,
 	proj *brigade.Project,
-) error {
-	if !s.shouldEmit(eventType) {
-		return nil
-	}
+) (*brigade.Build, error) {
 	b := &brigade.Build{
 		ProjectID:  proj.ID,
 		Type:       eventType,
-		Provider:   "github",
+		Provider:   s.provider(eventType),
 		ShortTitle: shortTitle,
 		LongTitle:  longTitle,
 		Revision:   &rev,
 		Payload:    payload,
+		LogLevel:   s.opts.BuildLogLevel,
+	}
+	// Don't create builds for a request that has timed out
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	store := s.opts.NamespaceStores.storeFor(proj, s.store)
+	return b, retry.Do(ctx, func() error {
+		return store.CreateBuild(b)
+	})
+}
+
+// provider returns the provider to record on builds of the given event type.
+func (s *githubHook) provider(eventType string) string {
+	eventType = strings.TrimPrefix(eventType, s.opts.EventPrefix)
+	if p, ok := s.opts.ProviderMap[eventType]; ok {
+		return p
+	}
+	if p, ok := s.opts.ProviderMap[strings.Split(eventType, ":")[0]]; ok {
+		return p
+	}
+	return "github"
+}
+
+// validateSignature compares the salted digest in the header with our own computing of the body,
+// succeeding if it matches the digest for any of the given secrets.
+func validateSignature(signature string, secretKeys []string, payload []byte) error {
+	for _, secretKey := range secretKeys {
+		sum := SHA1HMAC([]byte(secretKey), payload)
+		if subtle.ConstantTimeCompare([]byte(sum), []byte(signature)) == 1 {
+			return nil
+		}
+	}
+	log.Printf("Signature (hub-signature) does not match any of %d secret(s)", len(secretKeys))
+	return errors.New("payload signature check failed")
+}
+
+// isStale returns true if the event is older than GithubOpts.MaxEventAge.
+//
+// Replayed deliveries are never stale, since replaying old deliveries is the
+// point of the replay endpoint.
+func (s *githubHook) isStale(event interface{}) bool {
+	if s.opts.MaxEventAge <= 0 || s.skipSignature {
+		return false
+	}
+	ts := eventTimestamp(event)
+	return !ts.IsZero() && time.Since(ts) > s.opts.MaxEventAge
+}
+
+// eventTimestamp returns the time the event happened at, or the zero time if
+// the event doesn't say. Actions on existing objects, such as rerequesting an
+// old check run, aren't dated by the object.
+func eventTimestamp(event interface{}) time.Time {
+	switch e := event.(type) {
+	case *github.CheckRunEvent:
+		switch e.GetAction() {
+		case "created":
+			return e.CheckRun.GetStartedAt().Time
+		case "completed":
+			return e.CheckRun.GetCompletedAt().Time
+		}
+	case *github.CommitCommentEvent:
+		return e.Comment.GetUpdatedAt()
+	case *github.DeploymentEvent:
+		return e.Deployment.GetUpdatedAt().Time
+	case *github.DeploymentStatusEvent:
+		return e.DeploymentStatus.GetUpdatedAt().Time
+	case *github.IssueCommentEvent:
+		return e.Comment.GetUpdatedAt()
+	case *github.PullRequestEvent:
+		return e.PullRequest.GetUpdatedAt()
+	case *github.PullRequestReviewEvent:
+		if e.GetAction() == "submitted" {
+			return e.Review.GetSubmittedAt()
+		}
+	case *github.PullRequestReviewCommentEvent:
+		return e.Comment.GetUpdatedAt()
+	case *github.PushEvent:
+		return e.Repo.GetPushedAt().Time
+	case *github.ReleaseEvent:
+		// A release's created_at is the date of its commit
+		switch e.GetAction() {
+		case "published", "released", "prereleased":
+			return e.Release.GetPublishedAt().Time
+		}
+	case *github.StatusEvent:
+		return e.GetUpdatedAt().Time
 	}
-	return s.store.CreateBuild(b)
+	return time.Time{}
 }
 
-// validateSignature compares the salted digest in the header with our own computing of the body.
-func validateSignature(signature, secretKey string, payload []byte) error {
-	sum := SHA1HMAC([]byte(secretKey), payload)
-	if subtle.ConstantTimeCompare([]byte(sum), []byte(signature)) != 1 {
-		log.Printf("Expected signature %q (sum), got %q (hub-signature)", sum, signature)
-		return errors.New("payload signature check failed")
+// installationToken returns an installation token for a build, as limited by
+// GithubOpts.ForkSecretPolicy if the build is for a fork.
+func (s *githubHook) installationToken(ctx context.Context, proj *brigade.Project, appID, instID int64, fork bool) (string, time.Time, error) {
+	entry := AuditEntry{Decision: AuditToken, Outcome: AuditAllowed, Repo: proj.Name, Installation: instID}
+	var permissions *github.InstallationPermissions
+	if fork {
+		switch s.opts.ForkSecretPolicy {
+		case ForkSecretsNone:
+			entry.Outcome, entry.Reason = AuditDenied, "fork secret policy is none"
+			s.opts.AuditLog.record(entry)
+			return "", time.Time{}, nil
+		case ForkSecretsLimited:
+			permissions = limitedForkPermissions
+			entry.Reason = "limited to fork permissions"
+		}
+	}
+	var tok string
+	var expires time.Time
+	var err error
+	if permissions == nil && s.opts.TokenCache != nil {
+		tok, expires, err = s.opts.TokenCache.Token(ctx, proj.Github.BaseURL, proj.Github.UploadURL, appID, instID)
+	} else {
+		tok, expires, err = ghlib.GetScopedInstallationToken(
+			ctx,
+			proj.Github.BaseURL,
+			proj.Github.UploadURL,
+			appID,
+			instID,
+			s.key,
+			permissions,
+			s.opts.ClientOptions...,
+		)
+	}
+	if err != nil {
+		entry.Outcome, entry.Reason = AuditFailed, err.Error()
+	}
+	s.opts.AuditLog.record(entry)
+	return tok, expires, err
+}
+
+// appClient returns a client for the project's GitHub that is authenticated
+// as the app installation.
+//
+// The token is audited as used by the gateway itself, rather than handed to a
+// build.
+func (s *githubHook) appClient(ctx context.Context, proj *brigade.Project, appID, instID int64) (*github.Client, error) {
+	entry := AuditEntry{Decision: AuditToken, Outcome: AuditAllowed, Repo: proj.Name, Installation: instID, Reason: "used by the gateway"}
+	var client *github.Client
+	var err error
+	if s.opts.TokenCache == nil {
+		client, err = ghlib.NewClientFromAppKey(ctx, proj.Github.BaseURL, proj.Github.UploadURL, appID, instID, s.key, s.opts.ClientOptions...)
+	} else {
+		var tok string
+		if tok, _, err = s.opts.TokenCache.Token(ctx, proj.Github.BaseURL, proj.Github.UploadURL, appID, instID); err != nil {
+			err = fmt.Errorf("Failed to negotiate an installation token: %w", err)
+		} else {
+			client, err = ghlib.NewClientFromInstallationToken(proj.Github.BaseURL, proj.Github.UploadURL, tok, s.opts.ClientOptions...)
+		}
+	}
+	if err != nil {
+		entry.Outcome, entry.Reason = AuditFailed, err.Error()
+	}
+	s.opts.AuditLog.record(entry)
+	return client, err
+}
+
+// checkFromFork returns true if the check suite or run is for a pull request
+// from another repository.
+func checkFromFork(event interface{}) bool {
+	for _, pr := range checkPullRequests(event) {
+		if pr.Head.Repo.GetID() != pr.Base.Repo.GetID() {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPullRequests returns the pull requests associated with a check suite or
+// run.
+func checkPullRequests(event interface{}) []*github.PullRequest {
+	switch e := event.(type) {
+	case *github.CheckSuiteEvent:
+		return e.CheckSuite.PullRequests
+	case *github.CheckRunEvent:
+		if len(e.CheckRun.PullRequests) > 0 {
+			return e.CheckRun.PullRequests
+		}
+		return e.CheckRun.CheckSuite.PullRequests
 	}
 	return nil
 }
 
+// checkPullRequest returns the number and base branch of the first pull
+// request associated with a check suite or run, if there is one.
+func checkPullRequest(event interface{}) (int, string) {
+	prs := checkPullRequests(event)
+	if len(prs) == 0 {
+		return 0, ""
+	}
+	return prs[0].GetNumber(), prs[0].Base.GetRef()
+}
+
+// getInstallationID returns the ID of the app installation the event was
+// delivered for, or 0 if it doesn't say.
+func getInstallationID(event interface{}) int64 {
+	if e, ok := event.(interface {
+		GetInstallation() *github.Installation
+	}); ok {
+		return e.GetInstallation().GetID()
+	}
+	return 0
+}
+
+// matchesID returns true if param, a route parameter, is the given ID.
+// Events that don't name an ID (id 0) match any parameter.
+func matchesID(param string, id int64) bool {
+	if id == 0 {
+		return true
+	}
+	return param == strconv.FormatInt(id, 10)
+}
+
+// getSender returns the login of the user who triggered the event, if the
+// event says.
+func getSender(event interface{}) string {
+	if e, ok := event.(interface{ GetSender() *github.User }); ok {
+		return e.GetSender().GetLogin()
+	}
+	return ""
+}
+
+// getTitles returns the short and long build titles for an event handled by
+// handleEvent, where it has any.
+func getTitles(event interface{}) (string, string) {
+	switch e := event.(type) {
+	case *github.PullRequestEvent:
+		return getTitlesFromPR(e.PullRequest)
+	case *github.PullRequestReviewEvent:
+		return getTitlesFromPR(e.PullRequest)
+	case *github.PullRequestReviewCommentEvent:
+		return getTitlesFromPR(e.PullRequest)
+	case *github.PushEvent:
+		return getTitlesFromPushEvent(e)
+	}
+	return "", ""
+}
+
 func getTitlesFromPushEvent(pe *github.PushEvent) (string, string) {
 	var shortTitle, longTitle string
 	if pe != nil && pe.Ref != nil {
@@ -2,23 +2,41 @@ package webhook
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-github/v32/github"
 	gin "gopkg.in/gin-gonic/gin.v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 
 	"github.com/brigadecore/brigade/pkg/brigade"
 	"github.com/brigadecore/brigade/pkg/storage"
+
+	"github.com/brigadecore/brigade-github-app/pkg/retry"
+	"github.com/brigadecore/brigade-github-app/pkg/webhook/webhooktest"
 )
 
 type testStore struct {
 	proj   *brigade.Project
 	builds []*brigade.Build
 	err    error
+	// buildErr, if set, fails every CreateBuild once buildErrAfter builds
+	// were created
+	buildErr      error
+	buildErrAfter int
+	// buildDelay slows down every CreateBuild
+	buildDelay time.Duration
 	storage.Store
 }
 
@@ -27,6 +45,13 @@ func (s *testStore) GetProject(name string) (*brigade.Project, error) {
 }
 
 func (s *testStore) CreateBuild(build *brigade.Build) error {
+	time.Sleep(s.buildDelay)
+	if s.buildErr != nil && len(s.builds) >= s.buildErrAfter {
+		return s.buildErr
+	}
+	if build.ID == "" {
+		build.ID = fmt.Sprintf("build-%d", len(s.builds)+1)
+	}
 	s.builds = append(s.builds, build)
 	return s.err
 }
@@ -44,17 +69,34 @@ func newTestGithubHandler(store storage.Store, t *testing.T) *githubHook {
 	return &githubHook{
 		store:          store,
 		allowedAuthors: []string{"OWNER"},
-		updateIssueCommentEvent: func(c *gin.Context, s *githubHook, ice *github.IssueCommentEvent, rev brigade.Revision, proj *brigade.Project, body []byte) (brigade.Revision, []byte) {
+		updateIssueCommentEvent: func(c *gin.Context, s *githubHook, ice *github.IssueCommentEvent, rev brigade.Revision, proj *brigade.Project, body []byte) (brigade.Revision, []byte, bool) {
 			revision := brigade.Revision{
 				Commit: "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
 				Ref:    "refs/pull/2/head",
 			}
-			return revision, []byte{}
+			return revision, []byte{}, true
 		},
 		opts: GithubOpts{
 			EmittedEvents: []string{"*"},
 		},
+		defaultBranches: newBranchCache(),
+	}
+}
+
+// serveTestEvent sends payload, signed with secret, to the handler as the
+// given event type and returns the recorded response.
+func serveTestEvent(t *testing.T, s *githubHook, event, secret string, payload []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r, err := webhooktest.NewSignedRequest(event, secret, payload)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
 	}
+
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = r
+
+	s.Handle(ctx)
+	return w
 }
 
 func TestGithubHandler(t *testing.T) {
@@ -75,9 +117,21 @@ func TestGithubHandler(t *testing.T) {
 		},
 		{
 			event:          "create",
-			ref:            "0.0.1",
+			ref:            "refs/tags/0.0.1",
 			payloadFile:    "testdata/github-create-payload.json",
-			expectedBuilds: []string{"create"},
+			expectedBuilds: []string{"create", "create:tag"},
+		},
+		{
+			event:          "create",
+			ref:            "refs/heads/feature/simple",
+			payloadFile:    "testdata/github-create-branch-payload.json",
+			expectedBuilds: []string{"create", "create:branch"},
+		},
+		{
+			event:          "delete",
+			ref:            "refs/heads/master",
+			payloadFile:    "testdata/github-delete-payload.json",
+			expectedBuilds: []string{"delete", "delete:branch"},
 		},
 		{
 			event:          "deployment",
@@ -91,7 +145,46 @@ func TestGithubHandler(t *testing.T) {
 			commit:         "9049f1265b7d61be4a8904a9a27120d2064dab3b",
 			ref:            "master",
 			payloadFile:    "testdata/github-deployment_status-payload.json",
-			expectedBuilds: []string{"deployment_status"},
+			expectedBuilds: []string{"deployment_status", "deployment_status:success"},
+		},
+		{
+			event:          "deployment_status",
+			commit:         "9049f1265b7d61be4a8904a9a27120d2064dab3b",
+			ref:            "master",
+			payloadFile:    "testdata/github-deployment_status-failure-payload.json",
+			expectedBuilds: []string{"deployment_status", "deployment_status:failure"},
+		},
+		{
+			event:          "gollum",
+			ref:            "refs/heads/master",
+			payloadFile:    "testdata/github-gollum-payload.json",
+			expectedBuilds: []string{"gollum"},
+		},
+		{
+			event:          "star",
+			ref:            "refs/heads/master",
+			payloadFile:    "testdata/github-star-payload.json",
+			expectedBuilds: []string{"star", "star:created"},
+		},
+		{
+			event:          "watch",
+			ref:            "refs/heads/master",
+			payloadFile:    "testdata/github-watch-payload.json",
+			expectedBuilds: []string{"watch", "watch:started"},
+		},
+		{
+			event:          "package",
+			commit:         "9049f1265b7d61be4a8904a9a27120d2064dab3b",
+			ref:            "refs/heads/master",
+			payloadFile:    "testdata/github-package-payload.json",
+			expectedBuilds: []string{"package", "package:published"},
+		},
+		{
+			event:          "registry_package",
+			commit:         "9049f1265b7d61be4a8904a9a27120d2064dab3b",
+			ref:            "refs/heads/master",
+			payloadFile:    "testdata/github-registry_package-payload.json",
+			expectedBuilds: []string{"package", "package:published"},
 		},
 		{
 			event:          "issue_comment",
@@ -100,6 +193,13 @@ func TestGithubHandler(t *testing.T) {
 			payloadFile:    "testdata/github-issue_comment-payload.json",
 			expectedBuilds: []string{"issue_comment", "issue_comment:created"},
 		},
+		{
+			event:          "issue_comment",
+			commit:         "",
+			ref:            "refs/heads/main",
+			payloadFile:    "testdata/github-issue_comment-main_default_branch-payload.json",
+			expectedBuilds: []string{"issue_comment", "issue_comment:created"},
+		},
 		{
 			event:          "issue_comment",
 			commit:         "",
@@ -142,6 +242,41 @@ func TestGithubHandler(t *testing.T) {
 			payloadFile:    "testdata/github-pull_request-labeled-payload.json",
 			expectedBuilds: []string{"pull_request", "pull_request:labeled"},
 		},
+		{
+			event:          "pull_request",
+			commit:         "ad0703ac08e80448764b34dc089d0f73a1242ae9",
+			ref:            "refs/pull/1/head",
+			payloadFile:    "testdata/github-pull_request-auto_merge_enabled-payload.json",
+			expectedBuilds: []string{"pull_request", "pull_request:auto_merge_enabled"},
+		},
+		{
+			event:          "pull_request",
+			commit:         "ad0703ac08e80448764b34dc089d0f73a1242ae9",
+			ref:            "refs/pull/1/head",
+			payloadFile:    "testdata/github-pull_request-auto_merge_disabled-payload.json",
+			expectedBuilds: []string{"pull_request", "pull_request:auto_merge_disabled"},
+		},
+		{
+			event:          "pull_request",
+			commit:         "ad0703ac08e80448764b34dc089d0f73a1242ae9",
+			ref:            "refs/pull/1/head",
+			payloadFile:    "testdata/github-pull_request-converted_to_draft-payload.json",
+			expectedBuilds: []string{"pull_request", "pull_request:converted_to_draft"},
+		},
+		{
+			event:          "pull_request",
+			commit:         "ad0703ac08e80448764b34dc089d0f73a1242ae9",
+			ref:            "refs/pull/1/head",
+			payloadFile:    "testdata/github-pull_request-ready_for_review-payload.json",
+			expectedBuilds: []string{"pull_request", "pull_request:ready_for_review"},
+		},
+		{
+			event:          "pull_request",
+			commit:         "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+			ref:            "refs/pull/1/head",
+			payloadFile:    "testdata/github-pull_request-base_changed-payload.json",
+			expectedBuilds: []string{"pull_request", "pull_request:edited", "pull_request:base_changed"},
+		},
 		{
 			event:          "pull_request_review",
 			commit:         "b7a1f9c27caa4e03c14a88feb56e2d4f7500aa63",
@@ -177,7 +312,7 @@ func TestGithubHandler(t *testing.T) {
 		},
 		{
 			event:          "release",
-			ref:            "0.0.1",
+			ref:            "refs/tags/0.0.1",
 			payloadFile:    "testdata/github-release-payload.json",
 			expectedBuilds: []string{"release", "release:published"},
 		},
@@ -193,18 +328,7 @@ func TestGithubHandler(t *testing.T) {
 				t.Fatalf("failed to read testdata: %s", err)
 			}
 
-			w := httptest.NewRecorder()
-			r, err := http.NewRequest("POST", "", bytes.NewReader(payload))
-			if err != nil {
-				t.Fatalf("failed to create request: %s", err)
-			}
-			r.Header.Add("X-GitHub-Event", tt.event)
-			r.Header.Add("X-Hub-Signature", SHA1HMAC([]byte("asdf"), payload))
-
-			ctx, _ := gin.CreateTestContext(w)
-			ctx.Request = r
-
-			s.Handle(ctx)
+			w := serveTestEvent(t, s, tt.event, "asdf", payload)
 
 			if w.Code != http.StatusOK {
 				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
@@ -253,102 +377,2431 @@ func TestGithubHandler(t *testing.T) {
 	}
 }
 
-func TestGithubHandler_ping(t *testing.T) {
-	store := newTestStore()
-	s := newTestGithubHandler(store, t)
+func TestExtractRevision(t *testing.T) {
+	tests := []struct {
+		event       string
+		payloadFile string
+		repo        string
+		commit      string
+		ref         string
+		action      string
+	}{
+		{
+			event:       "check_run",
+			payloadFile: "testdata/github-check_run-payload.json",
+			repo:        "technosophos/-whale-eyes-",
+			commit:      "c61cc68b5c2ec7d48d6d5e89d9e3d99182a4f817",
+			ref:         "test/check_suite",
+			action:      "rerequested",
+		},
+		{
+			event:       "check_suite",
+			payloadFile: "testdata/github-check_suite-payload.json",
+			repo:        "technosophos/-whale-eyes-",
+			commit:      "c61cc68b5c2ec7d48d6d5e89d9e3d99182a4f817",
+			ref:         "test/check_suite",
+			action:      "requested",
+		},
+		{
+			event:       "commit_comment",
+			payloadFile: "testdata/github-commit_comment-payload.json",
+			repo:        "baxterthehacker/public-repo",
+			commit:      "9049f1265b7d61be4a8904a9a27120d2064dab3b",
+			action:      "created",
+		},
+		{
+			event:       "create",
+			payloadFile: "testdata/github-create-payload.json",
+			repo:        "baxterthehacker/public-repo",
+			ref:         "refs/tags/0.0.1",
+			action:      "tag",
+		},
+		{
+			event:       "delete",
+			payloadFile: "testdata/github-delete-payload.json",
+			repo:        "baxterthehacker/public-repo",
+			action:      "branch",
+		},
+		{
+			event:       "deployment",
+			payloadFile: "testdata/github-deployment-payload.json",
+			repo:        "baxterthehacker/public-repo",
+			commit:      "9049f1265b7d61be4a8904a9a27120d2064dab3b",
+			ref:         "master",
+		},
+		{
+			event:       "deployment_status",
+			payloadFile: "testdata/github-deployment_status-payload.json",
+			repo:        "baxterthehacker/public-repo",
+			commit:      "9049f1265b7d61be4a8904a9a27120d2064dab3b",
+			ref:         "master",
+			action:      "success",
+		},
+		{
+			event:       "issue_comment",
+			payloadFile: "testdata/github-issue_comment-payload.json",
+			repo:        "Codertocat/Hello-World",
+			action:      "created",
+		},
+		{
+			event:       "membership",
+			payloadFile: "testdata/github-membership-payload.json",
+			action:      "added",
+		},
+		{
+			event:       "sponsorship",
+			payloadFile: "testdata/github-sponsorship-payload.json",
+			action:      "created",
+		},
+		{
+			event:       "package",
+			payloadFile: "testdata/github-package-payload.json",
+			repo:        "baxterthehacker/public-repo",
+			commit:      "9049f1265b7d61be4a8904a9a27120d2064dab3b",
+			ref:         "refs/heads/master",
+			action:      "published",
+		},
+		{
+			event:       "registry_package",
+			payloadFile: "testdata/github-registry_package-payload.json",
+			repo:        "baxterthehacker/public-repo",
+			commit:      "9049f1265b7d61be4a8904a9a27120d2064dab3b",
+			ref:         "refs/heads/master",
+			action:      "published",
+		},
+		{
+			event:       "pull_request",
+			payloadFile: "testdata/github-pull_request-payload.json",
+			repo:        "baxterthehacker/public-repo",
+			commit:      "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+			ref:         "refs/pull/1/head",
+			action:      "opened",
+		},
+		{
+			event:       "pull_request_review",
+			payloadFile: "testdata/github-pull_request_review-payload.json",
+			repo:        "baxterthehacker/public-repo",
+			commit:      "b7a1f9c27caa4e03c14a88feb56e2d4f7500aa63",
+			ref:         "refs/pull/8/head",
+			action:      "submitted",
+		},
+		{
+			event:       "pull_request_review_comment",
+			payloadFile: "testdata/github-pull_request_review_comment-payload.json",
+			repo:        "Codertocat/Hello-World",
+			commit:      "34c5c7793cb3b279e22454cb6750c80560547b3a",
+			ref:         "refs/pull/1/head",
+			action:      "created",
+		},
+		{
+			event:       "push",
+			payloadFile: "testdata/github-push-payload.json",
+			repo:        "baxterthehacker/public-repo",
+			commit:      "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+			ref:         "refs/heads/changes",
+		},
+		{
+			event:       "release",
+			payloadFile: "testdata/github-release-payload.json",
+			repo:        "baxterthehacker/public-repo",
+			ref:         "refs/tags/0.0.1",
+			action:      "published",
+		},
+		{
+			event:       "release",
+			payloadFile: "testdata/github-release-sha-payload.json",
+			repo:        "baxterthehacker/public-repo",
+			commit:      "9049f1265b7d61be4a8904a9a27120d2064dab3b",
+			ref:         "refs/tags/0.0.1",
+			action:      "published",
+		},
+		{
+			event:       "status",
+			payloadFile: "testdata/github-status-payload.json",
+			repo:        "baxterthehacker/public-repo",
+			commit:      "9049f1265b7d61be4a8904a9a27120d2064dab3b",
+		},
+		{
+			event:       "team",
+			payloadFile: "testdata/github-team-payload.json",
+			repo:        "baxterthehacker/public-repo",
+			action:      "added_to_repository",
+		},
+	}
 
-	w := httptest.NewRecorder()
-	r, err := http.NewRequest("POST", "", nil)
-	if err != nil {
-		t.Fatalf("failed to create request: %s", err)
+	for _, tt := range tests {
+		t.Run(tt.payloadFile, func(t *testing.T) {
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+			event, err := parseWebHook(tt.event, payload)
+			if err != nil {
+				t.Fatalf("failed to parse payload: %s", err)
+			}
+
+			repo, rev, action, err := extractRevision(tt.event, event)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if repo != tt.repo {
+				t.Errorf("expected repo %q, got %q", tt.repo, repo)
+			}
+			if rev.Commit != tt.commit {
+				t.Errorf("expected commit %q, got %q", tt.commit, rev.Commit)
+			}
+			if rev.Ref != tt.ref {
+				t.Errorf("expected ref %q, got %q", tt.ref, rev.Ref)
+			}
+			if action != tt.action {
+				t.Errorf("expected action %q, got %q", tt.action, action)
+			}
+		})
 	}
-	r.Header.Add("X-GitHub-Event", "ping")
+}
 
-	ctx, _ := gin.CreateTestContext(w)
-	ctx.Request = r
+func TestQualifyRef(t *testing.T) {
+	tests := []struct {
+		refType, name, expected string
+	}{
+		{"branch", "feature/simple", "refs/heads/feature/simple"},
+		{"tag", "0.0.1", "refs/tags/0.0.1"},
+		{"tag", "refs/tags/0.0.1", "refs/tags/0.0.1"},
+		{"repository", "", ""},
+		{"", "master", "master"},
+	}
+	for _, tt := range tests {
+		if got := qualifyRef(tt.refType, tt.name); got != tt.expected {
+			t.Errorf("qualifyRef(%q, %q): expected %q, got %q", tt.refType, tt.name, tt.expected, got)
+		}
+	}
+}
 
-	s.Handle(ctx)
+func TestExtractRevision_unsupported(t *testing.T) {
+	if _, _, _, err := extractRevision("funzone", struct{}{}); err == nil {
+		t.Fatal("expected an error for an unsupported event")
+	}
+}
 
-	if w.Code != http.StatusOK {
-		t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+func TestGithubHandler_defaultRef(t *testing.T) {
+	var lookups int
+	srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+		"GET /repos/baxterthehacker/public-repo": func(w http.ResponseWriter, r *http.Request) {
+			lookups++
+			w.Write([]byte(`{"full_name":"baxterthehacker/public-repo","default_branch":"main"}`))
+		},
+	})
+	proj := &brigade.Project{
+		Github: brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL},
+	}
+	repo := &github.Repository{FullName: github.String("baxterthehacker/public-repo")}
+
+	s := newTestGithubHandler(newTestStore(), t)
+	s.key = newTestKey(t)
+	s.opts.AppID = 1
+
+	for i := 0; i < 2; i++ {
+		if ref := s.defaultRef(context.Background(), repo, 2, proj); ref != "refs/heads/main" {
+			t.Fatalf("expected refs/heads/main, got %q", ref)
+		}
+	}
+	if lookups != 1 {
+		t.Fatalf("expected the default branch to be looked up once, got %d lookups", lookups)
+	}
+
+	// Without an installation to authenticate as, fall back to the configured ref
+	s.opts.DefaultRef = "refs/heads/trunk"
+	other := &github.Repository{FullName: github.String("baxterthehacker/other-repo")}
+	if ref := s.defaultRef(context.Background(), other, 0, proj); ref != "refs/heads/trunk" {
+		t.Fatalf("expected refs/heads/trunk, got %q", ref)
 	}
 }
 
-func TestGithubHandler_badevent(t *testing.T) {
-	store := newTestStore()
-	s := newTestGithubHandler(store, t)
+func TestFetchDefaultBranchCancelled(t *testing.T) {
+	srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+		"GET /repos/baxterthehacker/public-repo": func(w http.ResponseWriter, r *http.Request) {
+			t.Error("default branch looked up with a cancelled context")
+		},
+	})
+	proj := &brigade.Project{
+		Github: brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL},
+	}
+	s := newTestGithubHandler(newTestStore(), t)
+	s.key = newTestKey(t)
+	s.opts.AppID = 1
 
-	w := httptest.NewRecorder()
-	r, err := http.NewRequest("POST", "", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.fetchDefaultBranch(ctx, "baxterthehacker/public-repo", 2, proj); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestGithubHandler_trustedNetworks(t *testing.T) {
+	_, trusted, err := net.ParseCIDR("10.0.0.0/8")
 	if err != nil {
-		t.Fatalf("failed to create request: %s", err)
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		networks       []*net.IPNet
+		expectedStatus int
+	}{
+		{"trusted", "10.1.2.3:4567", []*net.IPNet{trusted}, http.StatusOK},
+		{"untrusted", "192.168.1.1:4567", []*net.IPNet{trusted}, http.StatusForbidden},
+		{"disabled", "10.1.2.3:4567", nil, http.StatusForbidden},
 	}
-	r.Header.Add("X-GitHub-Event", "funzone")
 
-	ctx, _ := gin.CreateTestContext(w)
-	ctx.Request = r
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
 
-	s.Handle(ctx)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.TrustedNetworks = tt.networks
 
-	if w.Code != http.StatusOK {
-		t.Fatalf("expected unsupported verb to return a 200, got %d", w.Code)
-	}
-	if !strings.Contains(w.Body.String(), "Ignored") {
-		t.Fatalf("unexpected body: %d\n%s", w.Code, w.Body.String())
+			w := httptest.NewRecorder()
+			r, err := webhooktest.NewSignedRequest("push", "wrong", payload)
+			if err != nil {
+				t.Fatalf("failed to create request: %s", err)
+			}
+			r.RemoteAddr = tt.remoteAddr
+			c, _ := gin.CreateTestContext(w)
+			c.Request = r
+
+			s.Handle(c)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.expectedStatus == http.StatusOK && len(store.builds) == 0 {
+				t.Error("expected builds to be created")
+			}
+		})
 	}
 }
 
-func TestGithubHandler_shouldEmit(t *testing.T) {
+func TestGithubHandler_releaseCommit(t *testing.T) {
 	tests := []struct {
-		event    string
-		pattern  string
-		expected bool
+		name           string
+		instID         int64
+		ref            string
+		expectedCommit string
 	}{
 		{
-			event:    "issue_comment",
-			pattern:  "*",
-			expected: true,
-		},
-		{
-			event:    "issue_comment:created",
-			pattern:  "*",
-			expected: true,
-		},
-		{
-			event:    "issue_comment",
-			pattern:  "issue_comment",
-			expected: true,
-		},
-		{
-			event:    "issue_comment",
-			pattern:  "issue_comment:created",
-			expected: false,
+			name:           "lightweight tag",
+			instID:         234,
+			ref:            `{"ref":"refs/tags/0.0.1","object":{"type":"commit","sha":"9049f1265b7d61be4a8904a9a27120d2064dab3b"}}`,
+			expectedCommit: "9049f1265b7d61be4a8904a9a27120d2064dab3b",
 		},
 		{
-			event:    "issue_comment:created",
-			pattern:  "issue_comment",
-			expected: true,
+			name:           "annotated tag",
+			instID:         234,
+			ref:            `{"ref":"refs/tags/0.0.1","object":{"type":"tag","sha":"c3d0be41ecbe669545ee3e94d31ed9a4bc91ee3c"}}`,
+			expectedCommit: "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
 		},
 		{
-			event:    "issue_comment:created",
-			pattern:  "issue_comment:created",
-			expected: true,
+			// Without an installation to authenticate as, the commit is left empty
+			name: "no installation",
 		},
 	}
 
-	for i := range tests {
-		tt := tests[i]
-		t.Run(tt.event+"/"+tt.pattern, func(t *testing.T) {
-			s := &githubHook{
-				opts: GithubOpts{
-					EmittedEvents: []string{tt.pattern},
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lookups int
+			srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+				"GET /repos/baxterthehacker/public-repo/git/ref/tags/0.0.1": func(w http.ResponseWriter, r *http.Request) {
+					lookups++
+					w.Write([]byte(tt.ref))
 				},
-			}
-
-			actual := s.shouldEmit(tt.event)
+				"GET /repos/baxterthehacker/public-repo/git/tags/c3d0be41ecbe669545ee3e94d31ed9a4bc91ee3c": func(w http.ResponseWriter, r *http.Request) {
+					w.Write([]byte(`{"tag":"0.0.1","object":{"type":"commit","sha":"0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"}}`))
+				},
+			})
+			store := newTestStore()
+			store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+			s := newTestGithubHandler(store, t)
+			s.key = newTestKey(t)
+			s.opts.AppID = 12345
+			s.tagCommits = newBranchCache()
 
-			if actual != tt.expected {
-				t.Fatalf("unexpected result: pattern=%s, event=%s, expected=%v, actual=%v", tt.pattern, tt.event, tt.expected, actual)
+			payload, err := ioutil.ReadFile("testdata/github-release-payload.json")
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+			event, err := github.ParseWebHook("release", payload)
+			if err != nil {
+				t.Fatalf("failed to parse payload: %s", err)
+			}
+			if tt.instID != 0 {
+				event.(*github.ReleaseEvent).Installation = &github.Installation{ID: github.Int64(tt.instID)}
+			}
+			if payload, err = json.Marshal(event); err != nil {
+				t.Fatalf("failed to encode payload: %s", err)
+			}
+
+			// The second delivery is served from the cache
+			for i := 0; i < 2; i++ {
+				w := serveTestEvent(t, s, "release", "asdf", payload)
+				if w.Code != http.StatusOK {
+					t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+				}
+			}
+			if len(store.builds) == 0 {
+				t.Fatal("expected builds to be created")
+			}
+			for _, b := range store.builds {
+				if b.Revision.Commit != tt.expectedCommit {
+					t.Errorf("%s: expected commit %q, got %q", b.Type, tt.expectedCommit, b.Revision.Commit)
+				}
+				if b.Revision.Ref != "refs/tags/0.0.1" {
+					t.Errorf("%s: expected ref refs/tags/0.0.1, got %q", b.Type, b.Revision.Ref)
+				}
+			}
+			if tt.instID != 0 && lookups != 1 {
+				t.Errorf("expected the tag to be looked up once, got %d lookups", lookups)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_appWebhookSecret(t *testing.T) {
+	tests := []struct {
+		event          string
+		payloadFile    string
+		secret         string
+		expectedStatus int
+	}{
+		{
+			// App-scoped events may be signed with the app's secret...
+			event:          "issue_comment",
+			payloadFile:    "testdata/github-issue_comment-payload.json",
+			secret:         "app-secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			// ...or the project's
+			event:          "issue_comment",
+			payloadFile:    "testdata/github-issue_comment-payload.json",
+			secret:         "asdf",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			// Repo-scoped events must be signed with the project's secret
+			event:          "push",
+			payloadFile:    "testdata/github-push-payload.json",
+			secret:         "app-secret",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			event:          "push",
+			payloadFile:    "testdata/github-push-payload.json",
+			secret:         "asdf",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.event+"/"+tt.secret, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.AppWebhookSecret = "app-secret"
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, tt.event, tt.secret, payload)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.expectedStatus != http.StatusOK && len(store.builds) > 0 {
+				t.Fatalf("expected no builds, got %d", len(store.builds))
+			}
+		})
+	}
+}
+
+func TestGetSender(t *testing.T) {
+	tests := []struct {
+		event       string
+		payloadFile string
+		sender      string
+	}{
+		{"push", "testdata/github-push-payload.json", "baxterthehacker"},
+		{"pull_request", "testdata/github-pull_request-payload.json", "baxterthehacker"},
+		{"check_suite", "testdata/github-check_suite-payload.json", "technosophos"},
+		{"package", "testdata/github-package-payload.json", "baxterthehacker"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+			event, err := parseWebHook(tt.event, payload)
+			if err != nil {
+				t.Fatalf("failed to parse payload: %s", err)
+			}
+			if sender := getSender(event); sender != tt.sender {
+				t.Errorf("expected sender %q, got %q", tt.sender, sender)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_checkSuiteSender(t *testing.T) {
+	srv := newTestGithubServer(t, nil)
+	store := newTestStore()
+	store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+	s := newTestGithubHandler(store, t)
+	s.key = newTestKey(t)
+	s.opts.AppID = 12345
+
+	payload, err := ioutil.ReadFile("testdata/github-check_suite-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	w := serveTestEvent(t, s, "check_suite", "asdf", payload)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) == 0 {
+		t.Fatal("expected builds to be created")
+	}
+	for _, b := range store.builds {
+		var pl Payload
+		if err := json.Unmarshal(b.Payload, &pl); err != nil {
+			t.Fatalf("failed to decode payload: %s", err)
+		}
+		if pl.Sender != "technosophos" {
+			t.Errorf("%s: expected sender %q, got %q", b.Type, "technosophos", pl.Sender)
+		}
+	}
+}
+
+func TestGithubHandler_providerMap(t *testing.T) {
+	srv := newTestGithubServer(t, nil)
+	tests := []struct {
+		event            string
+		payloadFile      string
+		expectedProvider string
+	}{
+		{
+			event:            "check_suite",
+			payloadFile:      "testdata/github-check_suite-payload.json",
+			expectedProvider: "github-checks",
+		},
+		{
+			event:            "push",
+			payloadFile:      "testdata/github-push-payload.json",
+			expectedProvider: "github",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			store := newTestStore()
+			store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+			s := newTestGithubHandler(store, t)
+			s.key = newTestKey(t)
+			s.opts.AppID = 12345
+			s.opts.ProviderMap = map[string]string{"check_suite": "github-checks"}
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, tt.event, "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) == 0 {
+				t.Fatal("expected builds to be created")
+			}
+			for _, b := range store.builds {
+				if b.Provider != tt.expectedProvider {
+					t.Errorf("%s: expected provider %q, got %q", b.Type, tt.expectedProvider, b.Provider)
+				}
+			}
+		})
+	}
+}
+
+func TestGithubHandler_emitWildcardActions(t *testing.T) {
+	tests := []struct {
+		name          string
+		enabled       bool
+		event         string
+		payloadFile   string
+		expectedTypes []string
+	}{
+		{
+			name:          "disabled",
+			event:         "pull_request",
+			payloadFile:   "testdata/github-pull_request-payload.json",
+			expectedTypes: []string{"pull_request", "pull_request:opened"},
+		},
+		{
+			name:          "enabled",
+			enabled:       true,
+			event:         "pull_request",
+			payloadFile:   "testdata/github-pull_request-payload.json",
+			expectedTypes: []string{"pull_request", "pull_request:opened", "pull_request:*"},
+		},
+		{
+			name:          "enabled without action",
+			enabled:       true,
+			event:         "push",
+			payloadFile:   "testdata/github-push-payload.json",
+			expectedTypes: []string{"push"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.EmitWildcardActions = tt.enabled
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, tt.event, "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			var types []string
+			for _, b := range store.builds {
+				types = append(types, b.Type)
+			}
+			if !reflect.DeepEqual(types, tt.expectedTypes) {
+				t.Errorf("expected builds %v, got %v", tt.expectedTypes, types)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_noActionEvents(t *testing.T) {
+	tests := []struct {
+		name          string
+		enabled       bool
+		wildcards     bool
+		payloadFile   string
+		expectedTypes []string
+	}{
+		{
+			name:          "off",
+			payloadFile:   "testdata/github-pull_request-base_changed-payload.json",
+			expectedTypes: []string{"pull_request", "pull_request:edited", "pull_request:base_changed"},
+		},
+		{
+			name:          "on",
+			enabled:       true,
+			payloadFile:   "testdata/github-pull_request-base_changed-payload.json",
+			expectedTypes: []string{"pull_request"},
+		},
+		{
+			name:          "on with wildcard actions",
+			enabled:       true,
+			wildcards:     true,
+			payloadFile:   "testdata/github-pull_request-payload.json",
+			expectedTypes: []string{"pull_request"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.NoActionEvents = tt.enabled
+			s.opts.EmitWildcardActions = tt.wildcards
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, "pull_request", "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			var types []string
+			for _, b := range store.builds {
+				types = append(types, b.Type)
+			}
+			if !reflect.DeepEqual(types, tt.expectedTypes) {
+				t.Errorf("expected builds %v, got %v", tt.expectedTypes, types)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_buildIDs(t *testing.T) {
+	tests := []struct {
+		event       string
+		payloadFile string
+		emitted     []string
+		expectedIDs []string
+	}{
+		{
+			event:       "push",
+			payloadFile: "testdata/github-push-payload.json",
+			emitted:     []string{"*"},
+			expectedIDs: []string{"build-1"},
+		},
+		{
+			event:       "pull_request",
+			payloadFile: "testdata/github-pull_request-payload.json",
+			emitted:     []string{"*"},
+			expectedIDs: []string{"build-1", "build-2"},
+		},
+		{
+			event:       "pull_request",
+			payloadFile: "testdata/github-pull_request-payload.json",
+			emitted:     []string{"push"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.EmittedEvents = tt.emitted
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, tt.event, "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			res := struct {
+				Status   string   `json:"status"`
+				BuildID  string   `json:"buildID"`
+				BuildIDs []string `json:"buildIDs"`
+			}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("failed to decode response: %s", err)
+			}
+			if res.Status != "Complete" {
+				t.Errorf("expected status Complete, got %q", res.Status)
+			}
+			if !reflect.DeepEqual(res.BuildIDs, tt.expectedIDs) {
+				t.Errorf("expected build IDs %v, got %v", tt.expectedIDs, res.BuildIDs)
+			}
+			if len(tt.expectedIDs) > 0 && res.BuildID != tt.expectedIDs[0] {
+				t.Errorf("expected build ID %q, got %q", tt.expectedIDs[0], res.BuildID)
+			}
+			if len(tt.expectedIDs) == 0 && res.BuildID != "" {
+				t.Errorf("expected no build ID, got %q", res.BuildID)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_eventAliases(t *testing.T) {
+	tests := []struct {
+		name           string
+		event          string
+		payloadFile    string
+		emitted        []string
+		expectedBuilds []string
+	}{
+		{
+			name:           "push",
+			event:          "push",
+			payloadFile:    "testdata/github-push-payload.json",
+			emitted:        []string{"*"},
+			expectedBuilds: []string{"push", "ci", "deploy-preview"},
+		},
+		{
+			name:           "qualified",
+			event:          "pull_request",
+			payloadFile:    "testdata/github-pull_request-payload.json",
+			emitted:        []string{"*"},
+			expectedBuilds: []string{"pull_request", "pull_request:opened", "ci"},
+		},
+		{
+			// Aliases of types that aren't emitted aren't emitted either
+			name:        "not emitted",
+			event:       "push",
+			payloadFile: "testdata/github-push-payload.json",
+			emitted:     []string{"pull_request"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.EmittedEvents = tt.emitted
+			s.opts.EventAliases = map[string][]string{
+				"push":                {"ci", "deploy-preview"},
+				"pull_request":        {"ci"},
+				"pull_request:opened": {"ci"},
+			}
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, tt.event, "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+
+			var builds []string
+			for _, b := range store.builds {
+				builds = append(builds, b.Type)
+				if !bytes.Equal(b.Payload, store.builds[0].Payload) || *b.Revision != *store.builds[0].Revision {
+					t.Errorf("%s: expected the same payload and revision as %s", b.Type, store.builds[0].Type)
+				}
+			}
+			if !reflect.DeepEqual(builds, tt.expectedBuilds) {
+				t.Fatalf("expected builds %v, got %v", tt.expectedBuilds, builds)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_buildLogLevel(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.opts.BuildLogLevel = "warn"
+
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	w := serveTestEvent(t, s, "push", "asdf", payload)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) == 0 {
+		t.Fatal("expected builds to be created")
+	}
+	for _, b := range store.builds {
+		if b.LogLevel != "warn" {
+			t.Errorf("%s: expected log level %q, got %q", b.Type, "warn", b.LogLevel)
+		}
+	}
+}
+
+func TestGithubHandler_forkAllowLabel(t *testing.T) {
+	tests := []struct {
+		payloadFile    string
+		expectedBuilds []string
+	}{
+		{
+			payloadFile:    "testdata/github-pull_request-fork_labeled-payload.json",
+			expectedBuilds: []string{"pull_request", "pull_request:opened"},
+		},
+		{
+			// Without the label, the author association still applies
+			payloadFile: "testdata/github-pull_request-payload-failed-perms.json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.payloadFile, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.ForkAllowLabel = "ok-to-test"
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, "pull_request", "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+
+			var builds []string
+			for _, b := range store.builds {
+				builds = append(builds, b.Type)
+			}
+			if !reflect.DeepEqual(builds, tt.expectedBuilds) {
+				t.Fatalf("expected builds %v, got %v", tt.expectedBuilds, builds)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_skipPRLabel(t *testing.T) {
+	tests := []struct {
+		name           string
+		event          string
+		payloadFile    string
+		labels         []string
+		expectedBuilds []string
+	}{
+		{
+			name:        "labeled pull request",
+			event:       "pull_request",
+			payloadFile: "testdata/github-pull_request-payload.json",
+			labels:      []string{"bug", "wip"},
+		},
+		{
+			name:           "unlabeled pull request",
+			event:          "pull_request",
+			payloadFile:    "testdata/github-pull_request-payload.json",
+			labels:         []string{"bug"},
+			expectedBuilds: []string{"pull_request", "pull_request:opened"},
+		},
+		{
+			name:        "comment on labeled pull request",
+			event:       "issue_comment",
+			payloadFile: "testdata/github-issue_comment_pull_request_author_allowed-payload.json",
+			labels:      []string{"wip"},
+		},
+		{
+			name:           "comment on unlabeled pull request",
+			event:          "issue_comment",
+			payloadFile:    "testdata/github-issue_comment_pull_request_author_allowed-payload.json",
+			expectedBuilds: []string{"issue_comment", "issue_comment:edited"},
+		},
+		{
+			// Only pull requests are skipped
+			name:           "comment on labeled issue",
+			event:          "issue_comment",
+			payloadFile:    "testdata/github-issue_comment-payload.json",
+			labels:         []string{"wip"},
+			expectedBuilds: []string{"issue_comment", "issue_comment:created"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.SkipPRLabel = "wip"
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+			event, err := github.ParseWebHook(tt.event, payload)
+			if err != nil {
+				t.Fatalf("failed to parse payload: %s", err)
+			}
+			var labels []*github.Label
+			for _, l := range tt.labels {
+				labels = append(labels, &github.Label{Name: github.String(l)})
+			}
+			switch e := event.(type) {
+			case *github.PullRequestEvent:
+				e.PullRequest.Labels = labels
+			case *github.IssueCommentEvent:
+				e.Issue.Labels = labels
+			}
+			if payload, err = json.Marshal(event); err != nil {
+				t.Fatalf("failed to encode payload: %s", err)
+			}
+
+			w := serveTestEvent(t, s, tt.event, "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+
+			var builds []string
+			for _, b := range store.builds {
+				builds = append(builds, b.Type)
+			}
+			if !reflect.DeepEqual(builds, tt.expectedBuilds) {
+				t.Fatalf("expected builds %v, got %v", tt.expectedBuilds, builds)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_maxEventAge(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name           string
+		event          string
+		payloadFile    string
+		old, fresh     string
+		secret         string
+		expectedStatus int
+		expectedBuilds int
+	}{
+		{
+			name:        "old push",
+			event:       "push",
+			payloadFile: "testdata/github-push-payload.json",
+		},
+		{
+			// Age is only checked once the signature is validated
+			name:           "old forged push",
+			event:          "push",
+			payloadFile:    "testdata/github-push-payload.json",
+			secret:         "forged",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "fresh push",
+			event:          "push",
+			payloadFile:    "testdata/github-push-payload.json",
+			old:            `"pushed_at": 1430869217`,
+			fresh:          fmt.Sprintf(`"pushed_at": %d`, now.Unix()),
+			expectedBuilds: 1,
+		},
+		{
+			name:        "old pull request",
+			event:       "pull_request",
+			payloadFile: "testdata/github-pull_request-payload.json",
+		},
+		{
+			name:           "fresh pull request",
+			event:          "pull_request",
+			payloadFile:    "testdata/github-pull_request-payload.json",
+			old:            `"updated_at": "2015-05-05T23:40:27Z"`,
+			fresh:          fmt.Sprintf(`"updated_at": %q`, now.Format(time.RFC3339)),
+			expectedBuilds: 2,
+		},
+		{
+			name:        "old release",
+			event:       "release",
+			payloadFile: "testdata/github-release-payload.json",
+		},
+		{
+			// The release's created_at is the date of its commit
+			name:           "release of an old commit",
+			event:          "release",
+			payloadFile:    "testdata/github-release-payload.json",
+			old:            `"published_at": "2015-05-05T23:40:38Z"`,
+			fresh:          fmt.Sprintf(`"published_at": %q`, now.Format(time.RFC3339)),
+			expectedBuilds: 2,
+		},
+		{
+			name:        "old completed check run",
+			event:       "check_run",
+			payloadFile: "testdata/github-check_run-payload.json",
+			old:         `"action": "rerequested"`,
+			fresh:       `"action": "completed"`,
+		},
+		{
+			name:           "rerequested old check run",
+			event:          "check_run",
+			payloadFile:    "testdata/github-check_run-payload.json",
+			expectedBuilds: 2,
+		},
+		{
+			name:        "old review",
+			event:       "pull_request_review",
+			payloadFile: "testdata/github-pull_request_review-payload.json",
+		},
+		{
+			name:           "dismissed old review",
+			event:          "pull_request_review",
+			payloadFile:    "testdata/github-pull_request_review-payload.json",
+			old:            `"action": "submitted"`,
+			fresh:          `"action": "dismissed"`,
+			expectedBuilds: 2,
+		},
+	}
+
+	srv := newTestGithubServer(t, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+			s := newTestGithubHandler(store, t)
+			s.key = newTestKey(t)
+			s.opts.AppID = 12345
+			s.opts.MaxEventAge = time.Hour
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+			if tt.old != "" {
+				payload = bytes.Replace(payload, []byte(tt.old), []byte(tt.fresh), 1)
+			}
+
+			secret, status := tt.secret, tt.expectedStatus
+			if secret == "" {
+				secret = "asdf"
+			}
+			if status == 0 {
+				status = http.StatusOK
+			}
+			w := serveTestEvent(t, s, tt.event, secret, payload)
+			if w.Code != status {
+				t.Fatalf("expected status %d, got %d\n%s", status, w.Code, w.Body.String())
+			}
+			if len(store.builds) != tt.expectedBuilds {
+				t.Fatalf("expected %d builds, got %d\n%s", tt.expectedBuilds, len(store.builds), w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGithubHandler_statusContext(t *testing.T) {
+	tests := []struct {
+		name           string
+		allow, deny    []string
+		expectedBuilds int
+	}{
+		{
+			name:           "no filters",
+			expectedBuilds: 1,
+		},
+		{
+			name:           "allowed",
+			allow:          []string{"ci/*", "default"},
+			deny:           []string{"brigade*"},
+			expectedBuilds: 1,
+		},
+		{
+			name:  "not allowed",
+			allow: []string{"ci/*"},
+		},
+		{
+			name: "denied",
+			deny: []string{"brigade*", "def*"},
+		},
+		{
+			// Denying takes precedence over allowing
+			name:  "allowed and denied",
+			allow: []string{"default"},
+			deny:  []string{"default"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.EmittedEvents = []string{"status"}
+			s.opts.StatusContextAllow = tt.allow
+			s.opts.StatusContextDeny = tt.deny
+
+			payload, err := ioutil.ReadFile("testdata/github-status-payload.json")
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, "status", "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) != tt.expectedBuilds {
+				t.Fatalf("expected %d builds, got %d", tt.expectedBuilds, len(store.builds))
+			}
+		})
+	}
+}
+
+func TestGithubHandler_deploymentEnvironments(t *testing.T) {
+	tests := []struct {
+		event          string
+		payloadFile    string
+		environments   []string
+		expectedBuilds int
+	}{
+		{
+			event:          "deployment",
+			payloadFile:    "testdata/github-deployment-payload.json",
+			expectedBuilds: 1,
+		},
+		{
+			event:          "deployment",
+			payloadFile:    "testdata/github-deployment-payload.json",
+			environments:   []string{"production", "staging"},
+			expectedBuilds: 1,
+		},
+		{
+			event:        "deployment",
+			payloadFile:  "testdata/github-deployment-payload.json",
+			environments: []string{"staging"},
+		},
+		{
+			event:          "deployment_status",
+			payloadFile:    "testdata/github-deployment_status-payload.json",
+			environments:   []string{"production", "staging"},
+			expectedBuilds: 2,
+		},
+		{
+			event:        "deployment_status",
+			payloadFile:  "testdata/github-deployment_status-payload.json",
+			environments: []string{"staging"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%v", tt.event, tt.environments), func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.EmittedEvents = []string{tt.event}
+			s.opts.DeploymentEnvironments = tt.environments
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, tt.event, "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) != tt.expectedBuilds {
+				t.Fatalf("expected %d builds, got %d", tt.expectedBuilds, len(store.builds))
+			}
+		})
+	}
+}
+
+func TestGithubHandler_errorCodes(t *testing.T) {
+	srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+		"POST /app/installations/777777/access_tokens": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message":"Bad credentials"}`))
+		},
+	})
+	tests := []struct {
+		name           string
+		event          string
+		payloadFile    string
+		secret         string
+		storeErr       error
+		expectedStatus int
+		expectedCode   ErrorCode
+	}{
+		{
+			name:           "signature invalid",
+			event:          "push",
+			payloadFile:    "testdata/github-push-payload.json",
+			secret:         "wrong",
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   CodeSignatureInvalid,
+		},
+		{
+			name:           "project not found",
+			event:          "push",
+			payloadFile:    "testdata/github-push-payload.json",
+			secret:         "asdf",
+			storeErr:       fmt.Errorf("not found"),
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   CodeProjectNotFound,
+		},
+		{
+			name:           "auth failed",
+			event:          "check_suite",
+			payloadFile:    "testdata/github-check_suite-payload.json",
+			secret:         "asdf",
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   CodeAuthFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			store.err = tt.storeErr
+			store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+			s := newTestGithubHandler(store, t)
+			s.key = newTestKey(t)
+			s.opts.AppID = 12345
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, tt.event, tt.secret, payload)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			res := struct {
+				Status string    `json:"status"`
+				Code   ErrorCode `json:"code"`
+			}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("failed to decode response: %s", err)
+			}
+			if res.Code != tt.expectedCode {
+				t.Errorf("expected code %q, got %q", tt.expectedCode, res.Code)
+			}
+			if res.Status == "" {
+				t.Error("expected a status message")
+			}
+		})
+	}
+}
+
+func TestGithubHandler_repoAllowlist(t *testing.T) {
+	tests := []struct {
+		allowlist      []string
+		secret         string
+		expectedCode   int
+		expectedBuilds int
+	}{
+		{nil, "asdf", http.StatusOK, 1},
+		{[]string{"baxterthehacker/public-repo"}, "asdf", http.StatusOK, 1},
+		{[]string{"brigadecore/*", "baxterthehacker/*"}, "asdf", http.StatusOK, 1},
+		{[]string{"brigadecore/*"}, "asdf", http.StatusOK, 0},
+		{[]string{"baxterthehacker"}, "asdf", http.StatusOK, 0},
+		// Unsigned deliveries are refused whether or not the repo is allowed
+		{[]string{"baxterthehacker/public-repo"}, "forged", http.StatusForbidden, 0},
+		{[]string{"brigadecore/*"}, "forged", http.StatusForbidden, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.allowlist, tt.secret), func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.EmittedEvents = []string{"push"}
+			s.opts.RepoAllowlist = tt.allowlist
+
+			payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, "push", tt.secret, payload)
+			if w.Code != tt.expectedCode {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedCode, w.Code, w.Body.String())
+			}
+			if len(store.builds) != tt.expectedBuilds {
+				t.Fatalf("expected %d builds, got %d", tt.expectedBuilds, len(store.builds))
+			}
+		})
+	}
+}
+
+func TestGithubHandler_orgAllowlist(t *testing.T) {
+	tests := []struct {
+		allowlist      []string
+		secret         string
+		expectedCode   int
+		expectedBuilds int
+	}{
+		{nil, "asdf", http.StatusOK, 1},
+		{[]string{"baxterthehacker"}, "asdf", http.StatusOK, 1},
+		{[]string{"brigadecore", "baxter*"}, "asdf", http.StatusOK, 1},
+		{[]string{"brigadecore"}, "asdf", http.StatusOK, 0},
+		{[]string{"baxterthehacker/public-repo"}, "asdf", http.StatusOK, 0},
+		// Unsigned deliveries are refused whether or not the org is allowed
+		{[]string{"baxterthehacker"}, "forged", http.StatusForbidden, 0},
+		{[]string{"brigadecore"}, "forged", http.StatusForbidden, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.allowlist, tt.secret), func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.EmittedEvents = []string{"push"}
+			s.opts.OrgAllowlist = tt.allowlist
+
+			payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, "push", tt.secret, payload)
+			if w.Code != tt.expectedCode {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedCode, w.Code, w.Body.String())
+			}
+			if len(store.builds) != tt.expectedBuilds {
+				t.Fatalf("expected %d builds, got %d", tt.expectedBuilds, len(store.builds))
+			}
+		})
+	}
+}
+
+func TestValidateSignature(t *testing.T) {
+	payload := []byte(`{"zen":"Keep it logically awesome."}`)
+	secrets := []string{"new-secret", "old-secret"}
+
+	if err := validateSignature(SHA1HMAC([]byte("old-secret"), payload), secrets, payload); err != nil {
+		t.Errorf("expected signature from the old secret to be accepted: %s", err)
+	}
+	if err := validateSignature(SHA1HMAC([]byte("new-secret"), payload), secrets, payload); err != nil {
+		t.Errorf("expected signature from the new secret to be accepted: %s", err)
+	}
+	if err := validateSignature(SHA1HMAC([]byte("bogus"), payload), secrets, payload); err == nil {
+		t.Error("expected signature from an unknown secret to be rejected")
+	}
+}
+
+func TestGithubHandler_gzip(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(payload)
+	gz.Close()
+
+	tests := []struct {
+		name           string
+		body           []byte
+		encoding       string
+		signed         []byte
+		expectedStatus int
+		expectedBuilds int
+	}{
+		{
+			name:           "uncompressed",
+			body:           payload,
+			signed:         payload,
+			expectedStatus: http.StatusOK,
+			expectedBuilds: 1,
+		},
+		{
+			name:           "compressed",
+			body:           compressed.Bytes(),
+			encoding:       "gzip",
+			signed:         payload,
+			expectedStatus: http.StatusOK,
+			expectedBuilds: 1,
+		},
+		{
+			// GitHub signs the uncompressed body
+			name:           "signed compressed",
+			body:           compressed.Bytes(),
+			encoding:       "gzip",
+			signed:         compressed.Bytes(),
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "not gzip",
+			body:           payload,
+			encoding:       "gzip",
+			signed:         payload,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+
+			r, err := webhooktest.NewSignedRequest("push", "asdf", tt.body)
+			if err != nil {
+				t.Fatalf("failed to create request: %s", err)
+			}
+			r.Header.Set("X-Hub-Signature", webhooktest.Signature("asdf", tt.signed))
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = r
+			s.Handle(ctx)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if len(store.builds) != tt.expectedBuilds {
+				t.Fatalf("expected %d builds, got %d", tt.expectedBuilds, len(store.builds))
+			}
+		})
+	}
+}
+
+func TestGithubHandler_rotatedSecret(t *testing.T) {
+	store := newTestStore()
+	store.proj.SharedSecret = "new-secret, old-secret"
+	s := newTestGithubHandler(store, t)
+
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	w := serveTestEvent(t, s, "push", "old-secret", payload)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) != 1 {
+		t.Fatalf("expected 1 build, got %d", len(store.builds))
+	}
+}
+
+func TestGithubHandler_eventFilter(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-pull_request-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	tests := []struct {
+		name           string
+		filter         EventFilter
+		expectedBuilds []string
+	}{
+		{
+			name:           "pass through",
+			filter:         PassThroughEventFilter,
+			expectedBuilds: []string{"pull_request", "pull_request:opened"},
+		},
+		{
+			name: "suppress",
+			filter: func(eventType, action string, event interface{}, proj *brigade.Project) (bool, []string) {
+				return eventType != "pull_request", nil
+			},
+		},
+		{
+			name: "extra types",
+			filter: func(eventType, action string, event interface{}, proj *brigade.Project) (bool, []string) {
+				pre, ok := event.(*github.PullRequestEvent)
+				if !ok {
+					t.Fatalf("expected a *github.PullRequestEvent, got %T", event)
+				}
+				return true, []string{fmt.Sprintf("pr-%d", pre.GetNumber())}
+			},
+			expectedBuilds: []string{"pull_request", "pull_request:opened", "pr-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.EventFilter = tt.filter
+
+			w := serveTestEvent(t, s, "pull_request", "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+
+			var builds []string
+			for _, b := range store.builds {
+				builds = append(builds, b.Type)
+			}
+			if !reflect.DeepEqual(builds, tt.expectedBuilds) {
+				t.Fatalf("expected builds %v, got %v", tt.expectedBuilds, builds)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_payloadEnricher(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	tests := []struct {
+		name           string
+		enricher       PayloadEnricher
+		expectedTicket string
+		expectedBuilds int
+	}{
+		{
+			name:           "none",
+			expectedBuilds: 1,
+		},
+		{
+			name: "inject field",
+			enricher: func(eventType string, rev brigade.Revision, payload []byte) ([]byte, error) {
+				data := map[string]interface{}{}
+				if err := json.Unmarshal(payload, &data); err != nil {
+					return nil, err
+				}
+				data["ticket"] = strings.TrimPrefix(rev.Ref, "refs/heads/")
+				return json.Marshal(data)
+			},
+			expectedTicket: "changes",
+			expectedBuilds: 1,
+		},
+		{
+			name: "error",
+			enricher: func(eventType string, rev brigade.Revision, payload []byte) ([]byte, error) {
+				return nil, fmt.Errorf("no ticket")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.PayloadEnricher = tt.enricher
+
+			w := serveTestEvent(t, s, "push", "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) != tt.expectedBuilds {
+				t.Fatalf("expected %d builds, got %d", tt.expectedBuilds, len(store.builds))
+			}
+			for _, b := range store.builds {
+				data := struct {
+					Ticket string `json:"ticket"`
+				}{}
+				if err := json.Unmarshal(b.Payload, &data); err != nil {
+					t.Fatalf("failed to decode payload: %s", err)
+				}
+				if data.Ticket != tt.expectedTicket {
+					t.Errorf("expected ticket %q, got %q", tt.expectedTicket, data.Ticket)
+				}
+			}
+		})
+	}
+}
+
+func TestMarshalWithGithubPayload(t *testing.T) {
+	// 2^53 + 1 is the smallest integer that a float64 can't represent
+	body := []byte(`{"action":"requested","check_suite":{"id":9007199254740993}}`)
+
+	payload, err := marshalWithGithubPayload(&Payload{Type: "check_suite"}, body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Contains(payload, body) {
+		t.Fatalf("expected body to be embedded verbatim, got %s", payload)
+	}
+}
+
+func TestMarshalWithGithubPayload_invalid(t *testing.T) {
+	if _, err := marshalWithGithubPayload(&Payload{}, []byte("{")); err == nil {
+		t.Fatal("expected an error for an invalid body")
+	}
+}
+
+func TestGithubHandler_orgEvents(t *testing.T) {
+	tests := []struct {
+		event          string
+		payloadFile    string
+		orgProject     string
+		ref            string
+		expectedBuilds []string
+	}{
+		{
+			event:          "membership",
+			payloadFile:    "testdata/github-membership-payload.json",
+			orgProject:     "baxterandthehackers/org",
+			ref:            "refs/heads/master",
+			expectedBuilds: []string{"membership", "membership:added"},
+		},
+		{
+			// Without an org project, repo-less events are skipped
+			event:       "membership",
+			payloadFile: "testdata/github-membership-payload.json",
+		},
+		{
+			event:          "sponsorship",
+			payloadFile:    "testdata/github-sponsorship-payload.json",
+			orgProject:     "baxterandthehackers/org",
+			ref:            "refs/heads/master",
+			expectedBuilds: []string{"sponsorship", "sponsorship:created"},
+		},
+		{
+			event:       "sponsorship",
+			payloadFile: "testdata/github-sponsorship-payload.json",
+		},
+		{
+			// Team events with a repository are emitted to its project, for its
+			// default branch
+			event:          "team",
+			payloadFile:    "testdata/github-team-payload.json",
+			ref:            "refs/heads/master",
+			expectedBuilds: []string{"team", "team:added_to_repository"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.payloadFile+"/"+tt.orgProject, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.OrgProject = tt.orgProject
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, tt.event, "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+
+			var builds []string
+			for _, b := range store.builds {
+				builds = append(builds, b.Type)
+				if b.Revision.Ref != tt.ref {
+					t.Errorf("expected ref %q, got %q", tt.ref, b.Revision.Ref)
+				}
+			}
+			if !reflect.DeepEqual(builds, tt.expectedBuilds) {
+				t.Fatalf("expected builds %v, got %v", tt.expectedBuilds, builds)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_installationEvents(t *testing.T) {
+	tests := []struct {
+		event               string
+		payloadFile         string
+		installationProject string
+		expectedBuilds      []string
+	}{
+		{
+			event:               "installation",
+			payloadFile:         "testdata/github-installation-payload.json",
+			installationProject: "octocat/provisioner",
+			expectedBuilds:      []string{"installation", "installation:created"},
+		},
+		{
+			event:               "installation_repositories",
+			payloadFile:         "testdata/github-installation_repositories-payload.json",
+			installationProject: "octocat/provisioner",
+			expectedBuilds:      []string{"installation_repositories", "installation_repositories:added"},
+		},
+		{
+			// Without an installation project, they are skipped
+			event:       "installation",
+			payloadFile: "testdata/github-installation-payload.json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.payloadFile+"/"+tt.installationProject, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.InstallationProject = tt.installationProject
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, tt.event, "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+
+			var builds []string
+			for _, b := range store.builds {
+				builds = append(builds, b.Type)
+				if b.Revision.Ref != "refs/heads/master" {
+					t.Errorf("expected the fallback ref, got %q", b.Revision.Ref)
+				}
+			}
+			if !reflect.DeepEqual(builds, tt.expectedBuilds) {
+				t.Fatalf("expected builds %v, got %v", tt.expectedBuilds, builds)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_ping(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	r.Header.Add("X-GitHub-Event", "ping")
+
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = r
+
+	s.Handle(ctx)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+	}
+}
+
+func TestGithubHandler_badevent(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	r.Header.Add("X-GitHub-Event", "funzone")
+
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = r
+
+	s.Handle(ctx)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected unsupported verb to return a 200, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "Ignored") {
+		t.Fatalf("unexpected body: %d\n%s", w.Code, w.Body.String())
+	}
+}
+
+func TestGithubHandler_shouldEmit(t *testing.T) {
+	tests := []struct {
+		event    string
+		pattern  string
+		expected bool
+	}{
+		{
+			event:    "issue_comment",
+			pattern:  "*",
+			expected: true,
+		},
+		{
+			event:    "issue_comment:created",
+			pattern:  "*",
+			expected: true,
+		},
+		{
+			event:    "issue_comment",
+			pattern:  "issue_comment",
+			expected: true,
+		},
+		{
+			event:    "issue_comment",
+			pattern:  "issue_comment:created",
+			expected: false,
+		},
+		{
+			event:    "issue_comment:created",
+			pattern:  "issue_comment",
+			expected: true,
+		},
+		{
+			event:    "issue_comment:created",
+			pattern:  "issue_comment:created",
+			expected: true,
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.event+"/"+tt.pattern, func(t *testing.T) {
+			s := &githubHook{
+				opts: GithubOpts{
+					EmittedEvents: []string{tt.pattern},
+				},
+			}
+
+			actual := s.shouldEmit(tt.event)
+
+			if actual != tt.expected {
+				t.Fatalf("unexpected result: pattern=%s, event=%s, expected=%v, actual=%v", tt.pattern, tt.event, tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_pingWarnings(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-ping-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		config   map[string]interface{}
+		events   []string
+		expected []string
+	}{
+		{
+			name: "misconfigured",
+			expected: []string{
+				`webhook content type is "form", but the gateway expects "json"`,
+				"webhook has SSL verification disabled",
+				"webhook subscribes to events the gateway ignores: fork",
+			},
+		},
+		{
+			name:   "configured",
+			config: map[string]interface{}{"content_type": "json", "insecure_ssl": "0"},
+			events: []string{"pull_request", "push"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := payload
+			if tt.config != nil {
+				event, err := github.ParseWebHook("ping", payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				e := event.(*github.PingEvent)
+				e.Hook.Config = tt.config
+				e.Hook.Events = tt.events
+				if payload, err = json.Marshal(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s := newTestGithubHandler(newTestStore(), t)
+			w := serveTestEvent(t, s, "ping", "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			var res struct {
+				Warnings []string `json:"warnings"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.expected, res.Warnings) {
+				t.Errorf("expected warnings %q, got %q", tt.expected, res.Warnings)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_workerImage(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	for _, image := range []string{"", "brigadecore/brigade-worker:v1.4.0"} {
+		t.Run(image, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.WorkerImage = image
+
+			w := serveTestEvent(t, s, "push", "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) != 1 {
+				t.Fatalf("expected 1 build, got %d", len(store.builds))
+			}
+			var data struct {
+				Gateway struct {
+					WorkerImage *string `json:"workerImage"`
+				} `json:"gateway"`
+				Ref string `json:"ref"`
+			}
+			if err := json.Unmarshal(store.builds[0].Payload, &data); err != nil {
+				t.Fatal(err)
+			}
+			if data.Ref != "refs/heads/changes" {
+				t.Errorf("expected the GitHub payload to be kept, got ref %q", data.Ref)
+			}
+			if image == "" {
+				if data.Gateway.WorkerImage != nil {
+					t.Errorf("expected no worker image, got %q", *data.Gateway.WorkerImage)
+				}
+			} else if data.Gateway.WorkerImage == nil || *data.Gateway.WorkerImage != image {
+				t.Errorf("expected worker image %q, got %v", image, data.Gateway.WorkerImage)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_installationIDInPayload(t *testing.T) {
+	pushPayload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+	event, err := github.ParseWebHook("push", pushPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event.(*github.PushEvent).Installation = &github.Installation{ID: github.Int64(123)}
+	if pushPayload, err = json.Marshal(event); err != nil {
+		t.Fatal(err)
+	}
+	prPayload, err := ioutil.ReadFile("testdata/github-pull_request-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	tests := []struct {
+		event      string
+		payload    []byte
+		expectedID int64
+	}{
+		{event: "push", payload: pushPayload, expectedID: 123},
+		{event: "pull_request", payload: prPayload, expectedID: 234},
+	}
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.AppID = 42
+
+			w := serveTestEvent(t, s, tt.event, "asdf", tt.payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) == 0 {
+				t.Fatal("expected builds")
+			}
+			for _, b := range store.builds {
+				var data struct {
+					Gateway Gateway `json:"gateway"`
+				}
+				if err := json.Unmarshal(b.Payload, &data); err != nil {
+					t.Fatal(err)
+				}
+				if data.Gateway.InstallationID != tt.expectedID || data.Gateway.AppID != 42 {
+					t.Errorf("%s build: expected app 42 and installation %d, got %+v", b.Type, tt.expectedID, data.Gateway)
+				}
+			}
+		})
+	}
+}
+
+func TestGithubHandler_payloadVersion(t *testing.T) {
+	srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+		"POST /app/installations/777777/access_tokens": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"token":"v1.token","expires_at":"2030-01-01T00:00:00Z"}`))
+		},
+	})
+	tests := []struct {
+		event       string
+		payloadFile string
+	}{
+		{"push", "testdata/github-push-payload.json"},
+		{"pull_request", "testdata/github-pull_request-payload.json"},
+		{"check_suite", "testdata/github-check_suite-payload.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			store := newTestStore()
+			store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+			s := newTestGithubHandler(store, t)
+			s.key = newTestKey(t)
+			s.opts.AppID = 12345
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+			w := serveTestEvent(t, s, tt.event, "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) == 0 {
+				t.Fatal("expected builds")
+			}
+			for _, b := range store.builds {
+				var data struct {
+					Gateway struct {
+						Version *int `json:"payloadVersion"`
+					} `json:"gateway"`
+				}
+				if err := json.Unmarshal(b.Payload, &data); err != nil {
+					t.Fatal(err)
+				}
+				if v := data.Gateway.Version; v == nil || *v != PayloadVersion {
+					t.Errorf("%s build: expected payload version %d, got %v", b.Type, PayloadVersion, v)
+				}
+			}
+		})
+	}
+}
+
+func TestGithubHandler_buildLabels(t *testing.T) {
+	tests := []struct {
+		event       string
+		payloadFile string
+		orgProject  string
+		expected    map[string]string
+	}{
+		{
+			event:       "push",
+			payloadFile: "testdata/github-push-payload.json",
+			expected:    map[string]string{"event": "push", "repo": "baxterthehacker/public-repo"},
+		},
+		{
+			event:       "pull_request",
+			payloadFile: "testdata/github-pull_request-payload.json",
+			expected:    map[string]string{"event": "pull_request", "action": "opened", "repo": "baxterthehacker/public-repo"},
+		},
+		{
+			event:       "release",
+			payloadFile: "testdata/github-release-payload.json",
+			expected:    map[string]string{"event": "release", "action": "published", "repo": "baxterthehacker/public-repo"},
+		},
+		{
+			// Sponsorships have no repository
+			event:       "sponsorship",
+			payloadFile: "testdata/github-sponsorship-payload.json",
+			orgProject:  "baxterandthehackers/org",
+			expected:    map[string]string{"event": "sponsorship", "action": "created"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.OrgProject = tt.orgProject
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+			w := serveTestEvent(t, s, tt.event, "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) == 0 {
+				t.Fatal("expected builds")
+			}
+			// Builds for the action share the labels of the raw event
+			for _, b := range store.builds {
+				var data struct {
+					Gateway Gateway `json:"gateway"`
+				}
+				if err := json.Unmarshal(b.Payload, &data); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(data.Gateway.Labels, tt.expected) {
+					t.Errorf("%s build: expected labels %v, got %v", b.Type, tt.expected, data.Gateway.Labels)
+				}
+			}
+		})
+	}
+}
+
+func TestGithubHandler_commitComment(t *testing.T) {
+	tests := []struct {
+		name             string
+		payloadFile      string
+		expectedBody     string
+		expectedPath     *string
+		expectedPosition *int
+	}{
+		{
+			name:             "line comment",
+			payloadFile:      "testdata/github-commit_comment-line-payload.json",
+			expectedBody:     "This should check the error :point_down:",
+			expectedPath:     github.String("pkg/webhook/github.go"),
+			expectedPosition: github.Int(4),
+		},
+		{
+			name:         "commit comment",
+			payloadFile:  "testdata/github-commit_comment-payload.json",
+			expectedBody: "This is a really good change! :+1:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+			w := serveTestEvent(t, s, "commit_comment", "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) == 0 {
+				t.Fatal("expected builds")
+			}
+			for _, b := range store.builds {
+				if b.Revision.Commit != "9049f1265b7d61be4a8904a9a27120d2064dab3b" {
+					t.Errorf("%s build: unexpected commit %q", b.Type, b.Revision.Commit)
+				}
+				var data struct {
+					Gateway struct {
+						Body     string  `json:"commentBody"`
+						Path     *string `json:"commentPath"`
+						Position *int    `json:"commentPosition"`
+					} `json:"gateway"`
+				}
+				if err := json.Unmarshal(b.Payload, &data); err != nil {
+					t.Fatal(err)
+				}
+				if data.Gateway.Body != tt.expectedBody {
+					t.Errorf("%s build: expected comment body %q, got %q", b.Type, tt.expectedBody, data.Gateway.Body)
+				}
+				if !reflect.DeepEqual(data.Gateway.Path, tt.expectedPath) {
+					t.Errorf("%s build: expected comment path %v, got %v", b.Type, tt.expectedPath, data.Gateway.Path)
+				}
+				if !reflect.DeepEqual(data.Gateway.Position, tt.expectedPosition) {
+					t.Errorf("%s build: expected comment position %v, got %v", b.Type, tt.expectedPosition, data.Gateway.Position)
+				}
+			}
+		})
+	}
+}
+
+func TestGithubHandler_pushHeadOnly(t *testing.T) {
+	const head = "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"
+	tests := []struct {
+		name            string
+		headOnly        bool
+		expectedCommits []string
+	}{
+		{
+			name:            "all commits",
+			expectedCommits: []string{"1b0e9f4d9c5ac1c7d37c6c0df03e1b14e4a0d3f1", "7a3c2e8b1f5d4c9e0a6b2d8f3e1c5a7b9d0e2f4c", head},
+		},
+		{
+			name:            "head only",
+			headOnly:        true,
+			expectedCommits: []string{head},
+		},
+	}
+
+	payload, err := ioutil.ReadFile("testdata/github-push-multiple-commits-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.EmittedEvents = []string{"push"}
+			s.opts.PushHeadOnly = tt.headOnly
+
+			w := serveTestEvent(t, s, "push", "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) != 1 {
+				t.Fatalf("expected one build, got %d", len(store.builds))
+			}
+			b := store.builds[0]
+			if b.Revision.Commit != head {
+				t.Errorf("expected the head commit to be built, got %q", b.Revision.Commit)
+			}
+			var event github.PushEvent
+			if err := json.Unmarshal(b.Payload, &event); err != nil {
+				t.Fatal(err)
+			}
+			var commits []string
+			for _, c := range event.Commits {
+				commits = append(commits, c.GetID())
+			}
+			if !reflect.DeepEqual(commits, tt.expectedCommits) {
+				t.Errorf("expected commits %v, got %v", tt.expectedCommits, commits)
+			}
+			if event.HeadCommit.GetID() != head {
+				t.Errorf("expected head_commit to be kept, got %q", event.HeadCommit.GetID())
+			}
+		})
+	}
+}
+
+func TestGithubHandler_eventPrefix(t *testing.T) {
+	tests := []struct {
+		name              string
+		event             string
+		payloadFile       string
+		emitted           []string
+		expectedBuilds    []string
+		expectedProviders []string
+	}{
+		{
+			name:              "all",
+			event:             "pull_request",
+			payloadFile:       "testdata/github-pull_request-payload.json",
+			emitted:           []string{"*"},
+			expectedBuilds:    []string{"gh:pull_request", "gh:pull_request:opened", "gh:ci"},
+			expectedProviders: []string{"github-pr", "github-pr", "github"},
+		},
+		{
+			name:              "prefixed filter",
+			event:             "pull_request",
+			payloadFile:       "testdata/github-pull_request-payload.json",
+			emitted:           []string{"gh:pull_request:opened"},
+			expectedBuilds:    []string{"gh:pull_request:opened", "gh:ci"},
+			expectedProviders: []string{"github-pr", "github"},
+		},
+		{
+			name:              "unprefixed filter",
+			event:             "push",
+			payloadFile:       "testdata/github-push-payload.json",
+			emitted:           []string{"push"},
+			expectedBuilds:    []string{"gh:push"},
+			expectedProviders: []string{"github"},
+		},
+		{
+			name:        "filtered out",
+			event:       "push",
+			payloadFile: "testdata/github-push-payload.json",
+			emitted:     []string{"gh:pull_request"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.EventPrefix = "gh:"
+			s.opts.EmittedEvents = tt.emitted
+			s.opts.EventAliases = map[string][]string{"pull_request:opened": {"ci"}}
+			s.opts.ProviderMap = map[string]string{"pull_request": "github-pr"}
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, tt.event, "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+
+			var builds, providers []string
+			for _, b := range store.builds {
+				builds = append(builds, b.Type)
+				providers = append(providers, b.Provider)
+			}
+			if !reflect.DeepEqual(builds, tt.expectedBuilds) {
+				t.Fatalf("expected builds %v, got %v", tt.expectedBuilds, builds)
+			}
+			if !reflect.DeepEqual(providers, tt.expectedProviders) {
+				t.Fatalf("expected providers %v, got %v", tt.expectedProviders, providers)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_deliveryDeadline(t *testing.T) {
+	defer func(d time.Duration) { retry.Deadline = d }(retry.Deadline)
+	retry.Deadline = 100 * time.Millisecond
+
+	store := newTestStore()
+	store.buildDelay = 60 * time.Millisecond
+	s := newTestGithubHandler(store, t)
+	s.opts.EventAliases = map[string][]string{"push": {"ci", "deploy-preview"}}
+
+	// Each build is created in time, but the delivery's deadline passes before
+	// the last one
+	w := serveTestEvent(t, s, "push", "asdf", mustReadFile(t, "testdata/github-push-payload.json"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d\n%s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if len(store.builds) != 2 {
+		t.Errorf("expected 2 builds, got %d", len(store.builds))
+	}
+}
+
+func TestGithubHandler_issueCommentTokenRetries(t *testing.T) {
+	defer func(s func(context.Context, time.Duration) error) { retry.Sleep = s }(retry.Sleep)
+	retry.Sleep = func(ctx context.Context, d time.Duration) error { return nil }
+
+	srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+		"POST /app/installations/234/access_tokens": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"message":"try again"}`))
+		},
+	})
+	store := newTestStore()
+	store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+	s := newTestGithubHandler(store, t)
+	s.key = newTestKey(t)
+	s.opts.AppID = 12345
+	s.updateIssueCommentEvent = updateIssueCommentEvent
+
+	event, err := github.ParseWebHook("issue_comment", mustReadFile(t, "testdata/github-issue_comment_pull_request_author_allowed-payload.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	event.(*github.IssueCommentEvent).Installation = &github.Installation{ID: github.Int64(234)}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serveTestEvent(t, s, "issue_comment", "asdf", payload)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d\n%s", http.StatusServiceUnavailable, w.Code, w.Body.String())
+	}
+	// Nothing is scheduled, nor responded, after the error
+	var res struct{ Code ErrorCode }
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("expected a single response, got %q: %s", w.Body.String(), err)
+	}
+	if res.Code != CodeUnavailable {
+		t.Errorf("expected code %q, got %q", CodeUnavailable, res.Code)
+	}
+	if len(store.builds) != 0 {
+		t.Errorf("expected no builds, got %d", len(store.builds))
+	}
+}
+
+func TestGithubHandler_buildRetries(t *testing.T) {
+	defer func(s func(context.Context, time.Duration) error) { retry.Sleep = s }(retry.Sleep)
+	retry.Sleep = func(ctx context.Context, d time.Duration) error { return nil }
+
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	tests := []struct {
+		name               string
+		err                error
+		created            int
+		expectedStatus     int
+		expectedRetryAfter string
+	}{
+		{
+			name:               "throttled",
+			err:                apierrors.NewTooManyRequests("slow down", 40),
+			expectedStatus:     http.StatusTooManyRequests,
+			expectedRetryAfter: "40",
+		},
+		{
+			name:               "unavailable",
+			err:                apierrors.NewServiceUnavailable("etcd is down"),
+			expectedStatus:     http.StatusServiceUnavailable,
+			expectedRetryAfter: "8",
+		},
+		{
+			// Redelivering the event would create the push build again
+			name:           "unavailable after a build",
+			err:            apierrors.NewServiceUnavailable("etcd is down"),
+			created:        1,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			// Other errors only skip the build
+			name:           "invalid",
+			err:            apierrors.NewBadRequest("invalid build"),
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			store.buildErr = tt.err
+			store.buildErrAfter = tt.created
+			s := newTestGithubHandler(store, t)
+			s.opts.EventAliases = map[string][]string{"push": {"ci"}}
+
+			w := serveTestEvent(t, s, "push", "asdf", payload)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if len(store.builds) != tt.created {
+				t.Errorf("expected %d builds, got %d", tt.created, len(store.builds))
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.expectedRetryAfter {
+				t.Errorf("expected Retry-After %q, got %q", tt.expectedRetryAfter, got)
 			}
 		})
 	}
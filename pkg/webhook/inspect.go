@@ -0,0 +1,60 @@
+package webhook
+
+import (
+	"fmt"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+// Inspection describes how the gateway would handle a webhook delivery.
+type Inspection struct {
+	// SignatureValid is true if the delivery's signature matches the secret
+	SignatureValid bool
+	// Event is the name of the Go type the payload was parsed into
+	Event string
+	// Repo is the full name of the repository the event belongs to
+	Repo string
+	// Revision is the revision a build would be scheduled for
+	Revision brigade.Revision
+	// Action is the event's action, if it has one
+	Action string
+	// Builds lists the event types Brigade builds would be created for
+	Builds []string
+}
+
+// Inspect reports how the gateway would handle the given delivery, without
+// contacting Kubernetes or GitHub.
+//
+// eventType is the value of the X-GitHub-Event header and signature that of
+// the X-Hub-Signature header. The signature is checked against secret, which
+// may be a comma-separated list, and opts determines which builds would be
+// emitted.
+func Inspect(
+	eventType string,
+	body []byte,
+	signature string,
+	secret string,
+	opts GithubOpts,
+) (*Inspection, error) {
+	res := &Inspection{
+		SignatureValid: validateSignature(signature, splitSecrets(secret), body) == nil,
+	}
+
+	event, err := parseWebHook(eventType, body)
+	if err != nil {
+		return res, fmt.Errorf("failed to parse body: %s", err)
+	}
+	res.Event = fmt.Sprintf("%T", event)
+
+	// Mirror the renaming done by Handle
+	if eventType == "registry_package" {
+		eventType = "package"
+	}
+	if res.Repo, res.Revision, res.Action, err = extractRevision(eventType, event); err != nil {
+		return res, err
+	}
+
+	s := &githubHook{opts: opts}
+	res.Builds = s.buildTypes(eventType, res.Action)
+	return res, nil
+}
@@ -0,0 +1,50 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-pull_request-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+	signature := SHA1HMAC([]byte("asdf"), payload)
+	opts := GithubOpts{EmittedEvents: []string{"pull_request:opened"}}
+
+	res, err := Inspect("pull_request", payload, signature, "asdf", opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !res.SignatureValid {
+		t.Error("expected signature to be valid")
+	}
+	if res.Event != "*github.PullRequestEvent" {
+		t.Errorf("unexpected parsed event %q", res.Event)
+	}
+	if res.Repo != "baxterthehacker/public-repo" {
+		t.Errorf("unexpected repo %q", res.Repo)
+	}
+	if res.Revision.Ref != "refs/pull/1/head" {
+		t.Errorf("unexpected ref %q", res.Revision.Ref)
+	}
+	if expected := []string{"pull_request:opened"}; !reflect.DeepEqual(res.Builds, expected) {
+		t.Errorf("expected builds %v, got %v", expected, res.Builds)
+	}
+
+	res, err = Inspect("pull_request", payload, signature, "wrong", opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if res.SignatureValid {
+		t.Error("expected signature to be invalid")
+	}
+}
+
+func TestInspect_malformed(t *testing.T) {
+	if _, err := Inspect("push", []byte("{"), "", "asdf", GithubOpts{}); err == nil {
+		t.Fatal("expected an error for a malformed body")
+	}
+}
@@ -0,0 +1,75 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
+
+// InstallationLimiter caps the number of concurrent GitHub API operations,
+// such as minting tokens and requesting check suites, for each app
+// installation, to stay clear of GitHub's secondary rate limits. A nil
+// *InstallationLimiter doesn't limit anything.
+type InstallationLimiter struct {
+	max int
+	// wait is how long an operation may queue for a free slot
+	wait time.Duration
+
+	mu    sync.Mutex
+	slots map[int64]chan struct{}
+}
+
+// errInstallationBusy is returned by operations that didn't get a slot for
+// their installation in time.
+var errInstallationBusy = errors.New("too many concurrent requests for this installation")
+
+// NewInstallationLimiter returns an InstallationLimiter that allows max
+// concurrent operations per installation.
+func NewInstallationLimiter(max int) *InstallationLimiter {
+	return &InstallationLimiter{
+		max:   max,
+		wait:  5 * time.Second,
+		slots: map[int64]chan struct{}{},
+	}
+}
+
+// acquire waits for a free slot for the installation, returning a function
+// that frees it again. It returns false if no slot became free in time or ctx
+// was done first.
+func (l *InstallationLimiter) acquire(ctx context.Context, instID int64) (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	l.mu.Lock()
+	slots, ok := l.slots[instID]
+	if !ok {
+		slots = make(chan struct{}, l.max)
+		l.slots[instID] = slots
+	}
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return nil, false
+}
+
+// limitInstallation acquires a slot for GitHub API operations on behalf of the
+// installation. If none is free, it responds 429 so that GitHub redelivers the
+// event later, and returns false.
+func (s *githubHook) limitInstallation(c *gin.Context, instID int64) (func(), bool) {
+	release, ok := s.opts.InstallationLimiter.acquire(c.Request.Context(), instID)
+	if !ok {
+		errorResponse(c, http.StatusTooManyRequests, CodeTooManyRequests, errInstallationBusy.Error())
+	}
+	return release, ok
+}
@@ -0,0 +1,158 @@
+package webhook
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+func TestInstallationLimiter(t *testing.T) {
+	l := NewInstallationLimiter(2)
+	ctx := context.Background()
+
+	var (
+		mu                sync.Mutex
+		inflight, maxSeen int
+		wg                sync.WaitGroup
+	)
+	l.wait = time.Second
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, ok := l.acquire(ctx, 1)
+			if !ok {
+				t.Error("expected to acquire a slot eventually")
+				return
+			}
+			mu.Lock()
+			inflight++
+			if inflight > maxSeen {
+				maxSeen = inflight
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			inflight--
+			mu.Unlock()
+			release()
+		}()
+	}
+	wg.Wait()
+	if maxSeen > 2 {
+		t.Fatalf("expected at most 2 concurrent operations, got %d", maxSeen)
+	}
+
+	l.wait = 10 * time.Millisecond
+	release1, ok1 := l.acquire(ctx, 1)
+	release2, ok2 := l.acquire(ctx, 1)
+	if !ok1 || !ok2 {
+		t.Fatal("expected two free slots")
+	}
+	if _, ok := l.acquire(ctx, 1); ok {
+		t.Fatal("expected a third operation to be refused")
+	}
+	// Other installations have their own slots
+	if release, ok := l.acquire(ctx, 2); !ok {
+		t.Fatal("expected a slot for another installation")
+	} else {
+		release()
+	}
+	release1()
+	if release, ok := l.acquire(ctx, 1); !ok {
+		t.Fatal("expected a slot to be freed")
+	} else {
+		release()
+	}
+	release2()
+
+	// A nil limiter limits nothing
+	var unlimited *InstallationLimiter
+	if _, ok := unlimited.acquire(ctx, 1); !ok {
+		t.Fatal("expected a nil limiter to allow operations")
+	}
+}
+
+func TestGithubHandler_installationLimit(t *testing.T) {
+	srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+		"GET /repos/baxterthehacker/public-repo/topics": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"names":["go"]}`))
+		},
+	})
+
+	tests := []struct {
+		name        string
+		event       string
+		payloadFile string
+		instID      int64
+		repoTopics  bool
+	}{
+		{
+			name:        "token",
+			event:       "check_suite",
+			payloadFile: "testdata/github-check_suite-payload.json",
+			instID:      777777,
+		},
+		{
+			name:        "default branch",
+			event:       "delete",
+			payloadFile: "testdata/github-delete-payload.json",
+		},
+		{
+			name:        "tag commit",
+			event:       "release",
+			payloadFile: "testdata/github-release-payload.json",
+		},
+		{
+			name:        "topics",
+			event:       "pull_request",
+			payloadFile: "testdata/github-pull_request-payload.json",
+			instID:      234,
+			repoTopics:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+			s := newTestGithubHandler(store, t)
+			s.key = newTestKey(t)
+			s.opts.AppID = 12345
+			s.opts.RepoTopics = tt.repoTopics
+			s.opts.InstallationLimiter = NewInstallationLimiter(1)
+			s.opts.InstallationLimiter.wait = 10 * time.Millisecond
+
+			payload, err := ioutil.ReadFile(tt.payloadFile)
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			// Another request is using the installation's only slot
+			release, ok := s.opts.InstallationLimiter.acquire(context.Background(), tt.instID)
+			if !ok {
+				t.Fatal("expected a free slot")
+			}
+			w := serveTestEvent(t, s, tt.event, "asdf", payload)
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("expected status %d, got %d\n%s", http.StatusTooManyRequests, w.Code, w.Body.String())
+			}
+			if len(store.builds) != 0 {
+				t.Fatalf("expected no builds, got %d", len(store.builds))
+			}
+
+			release()
+			w = serveTestEvent(t, s, tt.event, "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) == 0 {
+				t.Fatal("expected builds to be created")
+			}
+		})
+	}
+}
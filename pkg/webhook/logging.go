@@ -0,0 +1,35 @@
+package webhook
+
+import (
+	"log"
+	"time"
+
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
+
+// logRepoKey is the context key under which Handle records the repository a
+// delivery is for, for RequestLogger.
+const logRepoKey = "webhook.repo"
+
+// RequestLogger returns a middleware that logs one line per request with the
+// event type, delivery ID, repository and response status.
+//
+// Only those fields are logged. Request bodies and headers such as
+// X-Hub-Signature and Authorization, which carry secrets or values derived
+// from them, never are.
+func RequestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		log.Printf(
+			"method=%s path=%q event=%q delivery=%q repo=%q status=%d latency=%s",
+			c.Request.Method,
+			c.Request.URL.Path,
+			c.Request.Header.Get("X-GitHub-Event"),
+			c.Request.Header.Get("X-GitHub-Delivery"),
+			c.GetString(logRepoKey),
+			c.Writer.Status(),
+			time.Since(start),
+		)
+	}
+}
@@ -0,0 +1,136 @@
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	gin "gopkg.in/gin-gonic/gin.v1"
+
+	"github.com/brigadecore/brigade-github-app/pkg/webhook/webhooktest"
+)
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+	s := newTestGithubHandler(newTestStore(), t)
+	router := gin.New()
+	router.POST("/events/github", RequestLogger(), s.Handle)
+
+	r, err := webhooktest.NewSignedRequest("push", "asdf", payload)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	r.Header.Set("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+	r.Header.Set("Authorization", "Bearer sekret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	out := buf.String()
+	for _, expect := range []string{
+		`event="push"`,
+		`delivery="72d3162e-cc78-11e3-81ab-4c9367dc0958"`,
+		`repo="baxterthehacker/public-repo"`,
+		"status=200",
+	} {
+		if !strings.Contains(out, expect) {
+			t.Errorf("expected log to contain %s, got %q", expect, out)
+		}
+	}
+	for _, secret := range []string{r.Header.Get("X-Hub-Signature"), "sekret"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log contains secret %q: %q", secret, out)
+		}
+	}
+
+	// Nor is the signature of a forged delivery logged
+	buf.Reset()
+	if r, err = webhooktest.NewSignedRequest("push", "forged", payload); err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	router.ServeHTTP(httptest.NewRecorder(), r)
+	if out := buf.String(); !strings.Contains(out, "status=403") || strings.Contains(out, r.Header.Get("X-Hub-Signature")) {
+		t.Errorf("expected the rejection to be logged without the signature, got %q", out)
+	}
+}
+
+func TestRequestLogger_checkSuiteRequest(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	router := gin.New()
+	router.POST("/checks/:owner/:repo", RequestLogger(), NewCheckSuiteHandler(newTestStore(), nil, GithubOpts{ChecksToken: "sekret"}))
+
+	r, err := http.NewRequest("POST", "/checks/baxterthehacker/public-repo", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Bearer sekret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	out := buf.String()
+	for _, expect := range []string{
+		`path="/checks/baxterthehacker/public-repo"`,
+		`repo="baxterthehacker/public-repo"`,
+		"status=400",
+	} {
+		if !strings.Contains(out, expect) {
+			t.Errorf("expected log to contain %s, got %q", expect, out)
+		}
+	}
+	if strings.Contains(out, "sekret") {
+		t.Errorf("log contains the checks token: %q", out)
+	}
+}
+
+func TestGithubHandler_bodyLogging(t *testing.T) {
+	payload := []byte(`{"secret": "hunter2", "repository": }`)
+	tests := []struct {
+		maxBytes int
+		expected string
+	}{
+		{0, ""},
+		{13, `(body: "{\"secret\": \"h", 24 more bytes truncated)`},
+		{100, `(body: "{\"secret\": \"hunter2\", \"repository\": }")`},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.maxBytes), func(t *testing.T) {
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			defer log.SetOutput(os.Stderr)
+
+			s := newTestGithubHandler(newTestStore(), t)
+			s.opts.MaxBodyLogBytes = tt.maxBytes
+			w := serveTestEvent(t, s, "push", "asdf", payload)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+
+			logged := buf.String()
+			if !strings.Contains(logged, "Failed to parse body of") {
+				t.Fatalf("expected the parse failure to be logged, got %q", logged)
+			}
+			if tt.expected == "" && strings.Contains(logged, "hunter") {
+				t.Errorf("expected the body not to be logged, got %q", logged)
+			}
+			if !strings.Contains(logged, tt.expected) {
+				t.Errorf("expected %q to be logged, got %q", tt.expected, logged)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	ghlib "github.com/brigadecore/brigade-github-app/pkg/github"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *ghlib.AppKey
+)
+
+// newTestKey returns an RSA key suitable for signing app JWTs. The key is
+// generated once per test run.
+func newTestKey(t *testing.T) *ghlib.AppKey {
+	testKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("failed to generate key: %s", err)
+		}
+		testKey, err = ghlib.ParseAppKey(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}))
+		if err != nil {
+			t.Fatalf("failed to parse key: %s", err)
+		}
+	})
+	return testKey
+}
+
+// newTestGithubServer starts a server that impersonates the parts of the
+// GitHub (Enterprise) API used by the gateway. It mints an installation token
+// for any installation and otherwise serves the given routes, which are keyed
+// by "METHOD /path" relative to the API root.
+//
+// Point a project's Github.BaseURL at the returned server's URL to use it.
+func newTestGithubServer(t *testing.T, routes map[string]http.HandlerFunc) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/app/installations/", func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := routes[r.Method+" "+r.URL.Path]; ok {
+			h(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(
+			w,
+			`{"token":"v1.testtoken","expires_at":%q}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		h, ok := routes[r.Method+" "+r.URL.Path]
+		if !ok {
+			t.Errorf("unexpected request to mock GitHub API: %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		h(w, r)
+	})
+	srv := httptest.NewServer(http.StripPrefix("/api/v3", mux))
+	t.Cleanup(srv.Close)
+	return srv
+}
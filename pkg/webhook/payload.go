@@ -1,15 +1,120 @@
 package webhook
 
-import "time"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// PayloadVersion is set as "payloadVersion" on the payload of every build, so
+// that scripts can tell which fields to expect. Bump it whenever the gateway
+// adds a field, and note the fields here.
+//
+// Version 1 has the fields of Payload for check and issue comment events, and
+// appID, installationID and workerImage for all events.
+//
+// Version 2 adds commentBody and, for line comments, commentPath and
+// commentPosition for commit comment events, and topics for all events if
+// GithubOpts.RepoTopics or EmitTopicEvents is set.
+//
+// Version 3 adds labels, naming the event, action and repository, for all
+// events.
+//
+// Version 4 moves the fields added for all events, and those of commit
+// comments, under "gateway", as Gateway, so that they can't clash with the
+// fields of GitHub's payload. The Payload of check and issue comment events
+// keeps its own payloadVersion.
+const PayloadVersion = 4
 
 // Payload represents the data sent as the payload of an event.
 type Payload struct {
-	Type         string      `json:"type"`
-	Token        string      `json:"token"`
-	TokenExpires time.Time   `json:"tokenExpires"`
-	Body         interface{} `json:"body"`
-	AppID        int         `json:"-"`
-	InstID       int         `json:"-"`
-	Commit       string      `json:"commit"`
-	Branch       string      `json:"branch"`
+	Type         string          `json:"type"`
+	Token        string          `json:"token"`
+	TokenExpires time.Time       `json:"tokenExpires"`
+	Body         json.RawMessage `json:"body"`
+	AppID        int64           `json:"-"`
+	InstID       int64           `json:"-"`
+	Commit       string          `json:"commit"`
+	Branch       string          `json:"branch"`
+	// PRNumber is the number of the pull request the event relates to, if any.
+	// For check suites and runs, this is the first associated pull request.
+	PRNumber int `json:"prNumber,omitempty"`
+	// BaseRef is the base branch of that pull request
+	BaseRef string `json:"baseRef,omitempty"`
+	// Sender is the login of the user who triggered the event
+	Sender string `json:"sender,omitempty"`
+	// Conclusion is the aggregate conclusion of a completed check suite, or
+	// the conclusion of a completed check run
+	Conclusion string `json:"conclusion,omitempty"`
+	// Version is the PayloadVersion of the gateway that created the payload
+	Version int `json:"payloadVersion"`
+}
+
+// Gateway holds the fields the gateway adds to the payload of every build, as
+// "gateway".
+type Gateway struct {
+	// PayloadVersion is the PayloadVersion of the gateway that created the
+	// payload
+	PayloadVersion int `json:"payloadVersion"`
+	// AppID and InstallationID name the app and installation the event was
+	// delivered for, so that scripts can mint tokens
+	AppID          int64 `json:"appID,omitempty"`
+	InstallationID int64 `json:"installationID,omitempty"`
+	// WorkerImage is GithubOpts.WorkerImage
+	WorkerImage string `json:"workerImage,omitempty"`
+	// Labels name the event, its action and repository, if it has them
+	Labels map[string]string `json:"labels,omitempty"`
+	// Topics are the GitHub topics of the repository, if GithubOpts.RepoTopics
+	// or EmitTopicEvents is set
+	Topics []string `json:"topics,omitempty"`
+	// CommentBody is the body of a commit comment. Comments on a line of the
+	// commit's diff also have a CommentPath and CommentPosition.
+	CommentBody     string `json:"commentBody,omitempty"`
+	CommentPath     string `json:"commentPath,omitempty"`
+	CommentPosition int    `json:"commentPosition,omitempty"`
+}
+
+// withGateway returns payload, a JSON object, with gw added as "gateway". The
+// rest of the payload is copied as is rather than decoded and encoded again.
+// An empty payload is treated as an empty object.
+func withGateway(payload []byte, gw *Gateway) ([]byte, error) {
+	field, err := json.Marshal(gw)
+	if err != nil {
+		return nil, err
+	}
+	obj := bytes.TrimSpace(payload)
+	if len(obj) == 0 {
+		obj = []byte("{}")
+	}
+	if obj[0] != '{' {
+		return nil, errors.New("payload is not a JSON object")
+	}
+	res := make([]byte, 0, len(obj)+len(field)+len(`"gateway":,`))
+	res = append(res, `{"gateway":`...)
+	res = append(res, field...)
+	if rest := bytes.TrimSpace(obj[1:]); len(rest) > 0 && rest[0] != '}' {
+		res = append(res, ',')
+	}
+	return append(res, obj[1:]...), nil
+}
+
+// trimPushCommits returns the payload of a push event, a JSON object, with its
+// commits reduced to the head commit, or to none if there is no head commit.
+// Everything else is left as is.
+func trimPushCommits(payload []byte) ([]byte, error) {
+	obj := map[string]json.RawMessage{}
+	if err := json.Unmarshal(payload, &obj); err != nil {
+		return nil, err
+	}
+	commits := []json.RawMessage{}
+	if head := obj["head_commit"]; len(head) > 0 && string(head) != "null" {
+		commits = append(commits, head)
+	}
+	trimmed, err := json.Marshal(commits)
+	if err != nil {
+		return nil, err
+	}
+	obj["commits"] = trimmed
+	return json.Marshal(obj)
 }
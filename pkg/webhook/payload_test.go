@@ -0,0 +1,133 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestPayload_preservesIDs(t *testing.T) {
+	body := []byte(`{"action":"requested","installation":{"id":123456789012345},"check_suite":{"id":9007199254740993}}`)
+
+	payload, err := marshalWithGithubPayload(&Payload{Type: "check_suite"}, body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Consumers such as the check-run tool decode the stored payload and then
+	// the body within it
+	res := &Payload{}
+	if err := json.Unmarshal(payload, res); err != nil {
+		t.Fatalf("failed to unmarshal payload: %s", err)
+	}
+	if !bytes.Equal(res.Body, body) {
+		t.Fatalf("expected body\n\t%s\ngot\n\t%s", body, res.Body)
+	}
+
+	event := struct {
+		Installation struct {
+			ID int64 `json:"id"`
+		} `json:"installation"`
+		CheckSuite struct {
+			ID int64 `json:"id"`
+		} `json:"check_suite"`
+	}{}
+	if err := json.Unmarshal(res.Body, &event); err != nil {
+		t.Fatalf("failed to unmarshal body: %s", err)
+	}
+	if event.Installation.ID != 123456789012345 {
+		t.Errorf("expected installation ID 123456789012345, got %d", event.Installation.ID)
+	}
+	if event.CheckSuite.ID != 9007199254740993 {
+		t.Errorf("expected check suite ID 9007199254740993, got %d", event.CheckSuite.ID)
+	}
+}
+
+func TestWithGateway(t *testing.T) {
+	tests := []struct {
+		name      string
+		payload   string
+		expected  string
+		expectErr bool
+	}{
+		{
+			// The payload is kept as GitHub sent it
+			name:     "object",
+			payload:  ` {"installation": {"id": 9007199254740993}}`,
+			expected: `{"gateway":{"payloadVersion":4,"workerImage":"brigadecore/brigade-worker:v1.4.0"},"installation": {"id": 9007199254740993}}`,
+		},
+		{
+			name:     "empty object",
+			payload:  `{ }`,
+			expected: `{"gateway":{"payloadVersion":4,"workerImage":"brigadecore/brigade-worker:v1.4.0"} }`,
+		},
+		{
+			name:     "empty",
+			expected: `{"gateway":{"payloadVersion":4,"workerImage":"brigadecore/brigade-worker:v1.4.0"}}`,
+		},
+		{
+			name:      "not an object",
+			payload:   `[1, 2]`,
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := withGateway([]byte(tt.payload), &Gateway{PayloadVersion: 4, WorkerImage: "brigadecore/brigade-worker:v1.4.0"})
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(got) != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestTrimPushCommits(t *testing.T) {
+	tests := []struct {
+		name      string
+		payload   string
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "several commits",
+			payload:  `{"commits":[{"id":"a"},{"id":"b"}],"head_commit":{"id":"b"},"size":9007199254740993}`,
+			expected: `{"commits":[{"id":"b"}],"head_commit":{"id":"b"},"size":9007199254740993}`,
+		},
+		{
+			name:     "no head commit",
+			payload:  `{"commits":[],"head_commit":null}`,
+			expected: `{"commits":[],"head_commit":null}`,
+		},
+		{
+			name:      "not an object",
+			payload:   `[1, 2]`,
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := trimPushCommits([]byte(tt.payload))
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(got) != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package webhook
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/brigadecore/brigade/pkg/storage"
+	gin "gopkg.in/gin-gonic/gin.v1"
+
+	ghlib "github.com/brigadecore/brigade-github-app/pkg/github"
+)
+
+// NewReplayHandler creates a handler that runs a previously captured GitHub
+// webhook delivery through the same pipeline as NewGithubHookHandler.
+//
+// The request body is the raw payload and the X-GitHub-Event header names the
+// event, as in the original delivery. Instead of a webhook signature, requests
+// must carry opts.ReplayToken as a bearer token in the Authorization header. If
+// opts.ReplayToken is empty, every request is refused.
+func NewReplayHandler(s storage.Store, authors []string, key *ghlib.AppKey, opts GithubOpts) gin.HandlerFunc {
+	gh := &githubHook{
+		store:                   s,
+		updateIssueCommentEvent: updateIssueCommentEvent,
+		allowedAuthors:          authors,
+		key:                     key,
+		opts:                    opts,
+		defaultBranches:         newBranchCache(),
+		tagCommits:              newBranchCache(),
+		topics:                  newTopicCache(),
+		skipSignature:           true,
+	}
+	return func(c *gin.Context) {
+		if !validBearerToken(c.Request.Header.Get("Authorization"), opts.ReplayToken) {
+			errorResponse(c, http.StatusUnauthorized, CodeReplayUnauthorized, "invalid replay token")
+			return
+		}
+		gh.Handle(c)
+	}
+}
+
+// validBearerToken reports whether the Authorization header carries the
+// expected bearer token.
+func validBearerToken(header, token string) bool {
+	if token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
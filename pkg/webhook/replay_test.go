@@ -0,0 +1,97 @@
+package webhook
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
+
+func TestReplayHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		token          string
+		authorization  string
+		signature      string
+		expectedStatus int
+		expectedBuilds int
+	}{
+		{
+			// Replays don't need a valid signature
+			name:           "authorized",
+			token:          "replay-me",
+			authorization:  "Bearer replay-me",
+			signature:      "sha1=bogus",
+			expectedStatus: http.StatusOK,
+			expectedBuilds: 1,
+		},
+		{
+			name:           "wrong token",
+			token:          "replay-me",
+			authorization:  "Bearer guess",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "no token",
+			token:          "replay-me",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			// A valid signature is no substitute for the token
+			name:           "signature only",
+			token:          "replay-me",
+			signature:      SHA1HMAC([]byte("asdf"), mustReadFile(t, "testdata/github-push-payload.json")),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "replay disabled",
+			authorization:  "Bearer ",
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			h := NewReplayHandler(store, []string{"OWNER"}, nil, GithubOpts{
+				EmittedEvents: []string{"push"},
+				ReplayToken:   tt.token,
+			})
+
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "/events/replay", bytes.NewReader(mustReadFile(t, "testdata/github-push-payload.json")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Add("X-GitHub-Event", "push")
+			if tt.authorization != "" {
+				r.Header.Add("Authorization", tt.authorization)
+			}
+			if tt.signature != "" {
+				r.Header.Add(hubSignatureHeader, tt.signature)
+			}
+
+			router := gin.New()
+			router.POST("/events/replay", h)
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if len(store.builds) != tt.expectedBuilds {
+				t.Fatalf("expected %d builds, got %d", tt.expectedBuilds, len(store.builds))
+			}
+		})
+	}
+}
+
+func mustReadFile(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+	return data
+}
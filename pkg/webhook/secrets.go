@@ -0,0 +1,27 @@
+package webhook
+
+import "github.com/brigadecore/brigade/pkg/storage"
+
+// SecretResolver looks up the shared secret that webhooks for a repository are
+// signed with, for deployments that keep secrets outside of Brigade projects,
+// e.g. in Vault.
+type SecretResolver interface {
+	// SecretFor returns the shared secret of repo, which may be a
+	// comma-separated list, or an empty string if it has none.
+	SecretFor(repo string) (string, error)
+}
+
+// StoreSecretResolver is a SecretResolver that takes secrets from the
+// SharedSecret of Brigade projects.
+type StoreSecretResolver struct {
+	Store storage.Store
+}
+
+// SecretFor returns the SharedSecret of the project for repo.
+func (r StoreSecretResolver) SecretFor(repo string) (string, error) {
+	proj, err := r.Store.GetProject(repo)
+	if err != nil {
+		return "", err
+	}
+	return proj.SharedSecret, nil
+}
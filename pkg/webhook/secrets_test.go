@@ -0,0 +1,116 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// vaultResolver is a SecretResolver serving secrets the way an external
+// secret store would.
+type vaultResolver struct {
+	secrets map[string]string
+	err     error
+	lookups []string
+}
+
+func (v *vaultResolver) SecretFor(repo string) (string, error) {
+	v.lookups = append(v.lookups, repo)
+	return v.secrets[repo], v.err
+}
+
+func TestGithubHandler_secretResolver(t *testing.T) {
+	payload := mustReadFile(t, "testdata/github-push-payload.json")
+
+	tests := []struct {
+		name           string
+		resolver       *vaultResolver
+		secret         string
+		expectedStatus int
+		expectedCode   ErrorCode
+	}{
+		{
+			name:           "no resolver",
+			secret:         "asdf",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "resolved secret",
+			resolver: &vaultResolver{secrets: map[string]string{
+				"baxterthehacker/public-repo": "vault:v1:s3cr3t",
+			}},
+			secret:         "vault:v1:s3cr3t",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			// The project's secret is only used if the resolver has none
+			name: "project secret overridden",
+			resolver: &vaultResolver{secrets: map[string]string{
+				"baxterthehacker/public-repo": "vault:v1:s3cr3t",
+			}},
+			secret:         "asdf",
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   CodeSignatureInvalid,
+		},
+		{
+			name:           "no resolved secret",
+			resolver:       &vaultResolver{secrets: map[string]string{"baxterthehacker/other-repo": "vault:v1:s3cr3t"}},
+			secret:         "asdf",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "resolver failing",
+			resolver:       &vaultResolver{err: errors.New("vault is sealed")},
+			secret:         "asdf",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedCode:   CodeUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			if tt.resolver != nil {
+				s.opts.SecretResolver = tt.resolver
+			}
+
+			w := serveTestEvent(t, s, "push", tt.secret, payload)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.resolver != nil && (len(tt.resolver.lookups) != 1 || tt.resolver.lookups[0] != "baxterthehacker/public-repo") {
+				t.Errorf("expected the secret of baxterthehacker/public-repo to be resolved, got lookups %v", tt.resolver.lookups)
+			}
+			if tt.expectedCode == "" {
+				return
+			}
+			var res struct {
+				Code ErrorCode
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("failed to decode response %q: %s", w.Body.String(), err)
+			}
+			if res.Code != tt.expectedCode {
+				t.Errorf("expected code %q, got %q", tt.expectedCode, res.Code)
+			}
+		})
+	}
+}
+
+func TestStoreSecretResolver(t *testing.T) {
+	store := newTestStore()
+	secret, err := StoreSecretResolver{Store: store}.SecretFor("baxterthehacker/public-repo")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if secret != "asdf" {
+		t.Errorf("expected the project's secret, got %q", secret)
+	}
+
+	store.err = errors.New("not found")
+	if _, err := (StoreSecretResolver{Store: store}).SecretFor("baxterthehacker/public-repo"); err == nil {
+		t.Error("expected an error for a missing project")
+	}
+}
@@ -0,0 +1,93 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SourceRanges holds the IP ranges GitHub sends webhooks from, so that
+// deliveries from anywhere else can be rejected before their signature is
+// even checked. It is safe for concurrent use and should be shared by all
+// handlers.
+type SourceRanges struct {
+	fetch func(ctx context.Context) ([]string, error)
+
+	mu     sync.RWMutex
+	ranges []*net.IPNet
+}
+
+// NewSourceRanges returns SourceRanges that get the ranges, in CIDR notation,
+// from fetch. They allow no addresses until Refresh succeeds.
+func NewSourceRanges(fetch func(ctx context.Context) ([]string, error)) *SourceRanges {
+	return &SourceRanges{fetch: fetch}
+}
+
+// Refresh fetches the ranges again. If fetching or parsing them fails, the
+// ranges fetched before are kept.
+func (r *SourceRanges) Refresh(ctx context.Context) error {
+	cidrs, err := r.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	if len(cidrs) == 0 {
+		return fmt.Errorf("no hook ranges were returned")
+	}
+	ranges := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid hook range %q: %s", cidr, err)
+		}
+		ranges = append(ranges, n)
+	}
+	r.mu.Lock()
+	r.ranges = ranges
+	r.mu.Unlock()
+	return nil
+}
+
+// KeepFresh refreshes the ranges every interval until ctx is done. Failures
+// are logged, and the previous ranges are kept.
+func (r *SourceRanges) KeepFresh(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.Refresh(ctx); err != nil {
+					log.Printf("Failed to refresh GitHub hook ranges: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// allows returns whether the request was made from one of the ranges. Only the
+// address of the connection is considered, not headers such as
+// X-Forwarded-For.
+func (r *SourceRanges) allows(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, n := range r.ranges {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gin "gopkg.in/gin-gonic/gin.v1"
+
+	"github.com/brigadecore/brigade-github-app/pkg/webhook/webhooktest"
+)
+
+func TestGithubHandler_sourceRanges(t *testing.T) {
+	hookRanges := func(ctx context.Context) ([]string, error) {
+		return []string{"192.30.252.0/22", "2620:112:3000::/44"}, nil
+	}
+
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		expectedStatus int
+	}{
+		{"in range", "192.30.252.41:4567", http.StatusOK},
+		{"in IPv6 range", "[2620:112:3000::1]:4567", http.StatusOK},
+		{"out of range", "203.0.113.7:4567", http.StatusForbidden},
+		{"no port", "192.30.252.41", http.StatusForbidden},
+	}
+
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.SourceRanges = NewSourceRanges(hookRanges)
+			if err := s.opts.SourceRanges.Refresh(context.Background()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			w := httptest.NewRecorder()
+			r, err := webhooktest.NewSignedRequest("push", "asdf", payload)
+			if err != nil {
+				t.Fatalf("failed to create request: %s", err)
+			}
+			r.RemoteAddr = tt.remoteAddr
+			c, _ := gin.CreateTestContext(w)
+			c.Request = r
+
+			s.Handle(c)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.expectedStatus == http.StatusOK {
+				return
+			}
+			var res struct{ Code ErrorCode }
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("failed to decode response: %s", err)
+			}
+			if res.Code != CodeSourceForbidden {
+				t.Errorf("expected code %s, got %s", CodeSourceForbidden, res.Code)
+			}
+			if len(store.builds) != 0 {
+				t.Errorf("expected no builds, got %d", len(store.builds))
+			}
+		})
+	}
+}
+
+func TestSourceRanges_Refresh(t *testing.T) {
+	var fetched []string
+	var fetchErr error
+	ranges := NewSourceRanges(func(ctx context.Context) ([]string, error) {
+		return fetched, fetchErr
+	})
+	inRange := &http.Request{RemoteAddr: "192.30.252.41:4567"}
+
+	if ranges.allows(inRange) {
+		t.Fatal("expected no addresses to be allowed before the first refresh")
+	}
+
+	fetched = []string{"192.30.252.0/22"}
+	if err := ranges.Refresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ranges.allows(inRange) {
+		t.Fatal("expected the address to be allowed")
+	}
+
+	for _, tt := range []struct {
+		name    string
+		fetched []string
+		err     error
+	}{
+		{"fetch failed", nil, errors.New("meta API unavailable")},
+		{"no ranges", []string{}, nil},
+		{"invalid range", []string{"192.30.252.0/22", "not-a-cidr"}, nil},
+	} {
+		fetched, fetchErr = tt.fetched, tt.err
+		if err := ranges.Refresh(context.Background()); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+		if !ranges.allows(inRange) {
+			t.Errorf("%s: expected the previous ranges to be kept", tt.name)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v32/github"
+
+	ghlib "github.com/brigadecore/brigade-github-app/pkg/github"
+)
+
+// ReportMode determines what the gateway reports to GitHub about the builds it
+// schedules.
+type ReportMode string
+
+const (
+	// ReportNone reports nothing, leaving it to the builds themselves.
+	ReportNone ReportMode = "none"
+	// ReportStatus sets a pending commit status as soon as a build is
+	// scheduled for a pull request or push.
+	ReportStatus ReportMode = "status"
+)
+
+// statusContext is the context of the commit statuses reported by the
+// gateway. It is matched by the default GithubOpts.StatusContextDeny, so the
+// status events it causes don't trigger further builds.
+const statusContext = "brigade"
+
+// reportPending sets a pending commit status for sha in repo, linking to the
+// build if GithubOpts.BuildURL is set.
+func (s *githubHook) reportPending(ctx context.Context, repo string, instID int64, sha string, b *brigade.Build, proj *brigade.Project) error {
+	if s.opts.AppID == 0 || instID == 0 {
+		return errors.New("no app installation to authenticate as")
+	}
+	owner, name, err := ghlib.SplitRepoName(repo)
+	if err != nil {
+		return err
+	}
+	client, err := s.appClient(ctx, proj, int64(s.opts.AppID), instID)
+	if err != nil {
+		return err
+	}
+	status := &github.RepoStatus{
+		State:       github.String("pending"),
+		Context:     github.String(statusContext),
+		Description: github.String("Build scheduled"),
+	}
+	if s.opts.BuildURL != "" {
+		status.TargetURL = github.String(strings.Replace(s.opts.BuildURL, "{id}", b.ID, -1))
+	}
+	_, _, err = client.Repositories.CreateStatus(ctx, owner, name, sha, status)
+	return err
+}
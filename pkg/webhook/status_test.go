@@ -0,0 +1,94 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v32/github"
+)
+
+func TestGithubHandler_reportStatus(t *testing.T) {
+	tests := []struct {
+		name           string
+		mode           ReportMode
+		expectedStatus bool
+	}{
+		{"disabled", "", false},
+		{"none", ReportNone, false},
+		{"status", ReportStatus, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status *github.RepoStatus
+			srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+				"POST /repos/baxterthehacker/public-repo/statuses/0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c": func(w http.ResponseWriter, r *http.Request) {
+					status = &github.RepoStatus{}
+					if err := json.NewDecoder(r.Body).Decode(status); err != nil {
+						t.Errorf("failed to decode status: %s", err)
+					}
+					w.WriteHeader(http.StatusCreated)
+					w.Write([]byte(`{}`))
+				},
+			})
+			var audit bytes.Buffer
+			store := newTestStore()
+			store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+			s := newTestGithubHandler(store, t)
+			s.key = newTestKey(t)
+			s.opts.AppID = 12345
+			s.opts.AuditLog = NewAuditLogger(&audit)
+			s.opts.ReportMode = tt.mode
+			s.opts.BuildURL = "https://kashti.example.com/#!/build/{id}"
+
+			payload, err := ioutil.ReadFile("testdata/github-pull_request-payload.json")
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := serveTestEvent(t, s, "pull_request", "asdf", payload)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) == 0 {
+				t.Fatal("expected builds to be created")
+			}
+
+			if !tt.expectedStatus {
+				if status != nil {
+					t.Fatalf("expected no status to be reported, got %v", status)
+				}
+				return
+			}
+			if status == nil {
+				t.Fatal("expected a pending status to be reported")
+			}
+			if status.GetState() != "pending" {
+				t.Errorf("expected state pending, got %q", status.GetState())
+			}
+			if status.GetContext() != statusContext {
+				t.Errorf("expected context %q, got %q", statusContext, status.GetContext())
+			}
+			expectedURL := "https://kashti.example.com/#!/build/" + store.builds[0].ID
+			if status.GetTargetURL() != expectedURL {
+				t.Errorf("expected target URL %q, got %q", expectedURL, status.GetTargetURL())
+			}
+
+			// The token is minted like any other the gateway uses, after the
+			// signature is checked
+			var entry AuditEntry
+			for dec := json.NewDecoder(&audit); dec.More(); {
+				if err := dec.Decode(&entry); err != nil {
+					t.Fatalf("failed to decode audit log: %s", err)
+				}
+			}
+			if entry.Decision != AuditToken || entry.Reason != "used by the gateway" || entry.Installation != 234 {
+				t.Errorf("expected the status token to be audited, got %+v", entry)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package webhook
+
+import (
+	"sync"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/brigadecore/brigade/pkg/storage"
+)
+
+// NamespaceStores creates the builds of each project in the Kubernetes
+// namespace configured for the project, rather than in the namespace the
+// gateway looks projects up in, so that teams sharing a cluster get their
+// builds in their own namespace. A nil *NamespaceStores creates every build in
+// the handler's store.
+type NamespaceStores struct {
+	newStore func(namespace string) storage.Store
+
+	mu     sync.Mutex
+	stores map[string]storage.Store
+}
+
+// NewNamespaceStores returns NamespaceStores that call newStore for the store
+// of a namespace the first time a build is created in it.
+func NewNamespaceStores(newStore func(namespace string) storage.Store) *NamespaceStores {
+	return &NamespaceStores{
+		newStore: newStore,
+		stores:   map[string]storage.Store{},
+	}
+}
+
+// storeFor returns the store to create builds of proj in, or def if proj has
+// no namespace of its own.
+func (n *NamespaceStores) storeFor(proj *brigade.Project, def storage.Store) storage.Store {
+	ns := proj.Kubernetes.Namespace
+	if n == nil || ns == "" {
+		return def
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	store, ok := n.stores[ns]
+	if !ok {
+		store = n.newStore(ns)
+		n.stores[ns] = store
+	}
+	return store
+}
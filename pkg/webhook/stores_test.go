@@ -0,0 +1,114 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/brigadecore/brigade/pkg/storage"
+	"github.com/google/go-github/v32/github"
+)
+
+// projectsStore is a testStore with more than one project.
+type projectsStore struct {
+	*testStore
+	projects map[string]*brigade.Project
+}
+
+func (s *projectsStore) GetProject(name string) (*brigade.Project, error) {
+	if proj, ok := s.projects[name]; ok {
+		return proj, nil
+	}
+	return nil, fmt.Errorf("project %q not found", name)
+}
+
+func TestGithubHandler_namespaceStores(t *testing.T) {
+	publicPayload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+	event, err := github.ParseWebHook("push", publicPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event.(*github.PushEvent).Repo.FullName = github.String("baxterthehacker/private-repo")
+	privatePayload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	project := func(name, namespace string) *brigade.Project {
+		return &brigade.Project{
+			ID:           brigade.ProjectID(name),
+			Name:         name,
+			SharedSecret: "asdf",
+			Kubernetes:   brigade.Kubernetes{Namespace: namespace},
+		}
+	}
+	store := &projectsStore{
+		testStore: newTestStore(),
+		projects: map[string]*brigade.Project{
+			"baxterthehacker/public-repo":  project("baxterthehacker/public-repo", "team-a"),
+			"baxterthehacker/private-repo": project("baxterthehacker/private-repo", "team-b"),
+		},
+	}
+
+	tests := []struct {
+		name              string
+		namespaces        bool
+		expectedNamespace map[string]string
+	}{
+		{
+			name:       "per project",
+			namespaces: true,
+			expectedNamespace: map[string]string{
+				"baxterthehacker/public-repo":  "team-a",
+				"baxterthehacker/private-repo": "team-b",
+			},
+		},
+		{
+			name: "gateway namespace",
+			expectedNamespace: map[string]string{
+				"baxterthehacker/public-repo":  "gateway",
+				"baxterthehacker/private-repo": "gateway",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store.builds = nil
+			stores := map[string]*testStore{"gateway": store.testStore}
+			s := newTestGithubHandler(store, t)
+			s.opts.EmittedEvents = []string{"push"}
+			if tt.namespaces {
+				s.opts.NamespaceStores = NewNamespaceStores(func(ns string) storage.Store {
+					stores[ns] = newTestStore()
+					return stores[ns]
+				})
+			}
+
+			for _, payload := range [][]byte{publicPayload, privatePayload} {
+				w := serveTestEvent(t, s, "push", "asdf", payload)
+				if w.Code != http.StatusOK {
+					t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+				}
+			}
+
+			namespaces := map[string]string{}
+			for ns, nsStore := range stores {
+				for _, b := range nsStore.builds {
+					namespaces[b.ProjectID] = ns
+				}
+			}
+			for repo, ns := range tt.expectedNamespace {
+				if got := namespaces[brigade.ProjectID(repo)]; got != ns {
+					t.Errorf("expected the build for %s in namespace %q, got %q", repo, ns, got)
+				}
+			}
+		})
+	}
+}
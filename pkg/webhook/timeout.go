@@ -0,0 +1,94 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
+
+// buildsKey is the context key under which completeResponse records the
+// number of builds created for a delivery, for RequestTimeout.
+const buildsKey = "webhook.builds"
+
+// RequestTimeout returns a middleware that bounds the time spent handling a
+// request, so that a slow GitHub or Kubernetes API can't tie up the gateway
+// indefinitely. The request's context is cancelled once timeout passes, which
+// ends the handler's calls to either API. If the handler hasn't finished by
+// then, its response is discarded and 503 is sent instead, so that the
+// delivery can be redelivered. The handler's response is kept if it created
+// builds, though, as redelivering the event would create them again.
+func RequestTimeout(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		w := &bufferedWriter{ResponseWriter: c.Writer, header: http.Header{}}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+
+		if ctx.Err() == context.DeadlineExceeded && c.GetInt(buildsKey) == 0 {
+			log.Printf("Handling %s %s took longer than %s", c.Request.Method, c.Request.URL.Path, timeout)
+			errorResponse(c, http.StatusServiceUnavailable, CodeTimeout, "request timed out")
+			return
+		}
+		w.flush()
+	}
+}
+
+// bufferedWriter holds back the headers and body of a response until it is
+// flushed, so that they can be replaced if the request times out. The status
+// is passed on, as gin only sends it with the body.
+type bufferedWriter struct {
+	gin.ResponseWriter
+	header  http.Header
+	body    bytes.Buffer
+	written bool
+}
+
+func (w *bufferedWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedWriter) WriteHeaderNow() {
+	w.written = true
+}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	w.written = true
+	return w.body.Write(data)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	w.written = true
+	return w.body.WriteString(s)
+}
+
+func (w *bufferedWriter) Size() int {
+	if !w.written {
+		return -1
+	}
+	return w.body.Len()
+}
+
+func (w *bufferedWriter) Written() bool {
+	return w.written
+}
+
+// Flush is a no-op, as the response is only sent by flush.
+func (w *bufferedWriter) Flush() {}
+
+// flush sends the response to the underlying writer.
+func (w *bufferedWriter) flush() {
+	for k, v := range w.header {
+		w.ResponseWriter.Header()[k] = v
+	}
+	if w.written {
+		w.ResponseWriter.Write(w.body.Bytes())
+	}
+}
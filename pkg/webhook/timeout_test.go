@@ -0,0 +1,123 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gin "gopkg.in/gin-gonic/gin.v1"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+
+	"github.com/brigadecore/brigade-github-app/pkg/webhook/webhooktest"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name           string
+		handler        gin.HandlerFunc
+		expectedStatus int
+		expectedCode   ErrorCode
+		expectedHeader string
+	}{
+		{
+			name: "in time",
+			handler: func(c *gin.Context) {
+				c.Header("X-Test", "kept")
+				c.JSON(http.StatusAccepted, gin.H{"status": "Complete"})
+			},
+			expectedStatus: http.StatusAccepted,
+			expectedHeader: "kept",
+		},
+		{
+			// The handler gives up once the request's context is cancelled
+			name: "too slow",
+			handler: func(c *gin.Context) {
+				select {
+				case <-c.Request.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+				c.Header("X-Test", "discarded")
+				errorResponse(c, http.StatusInternalServerError, CodeInternal, "context canceled")
+			},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedCode:   CodeTimeout,
+		},
+		{
+			// Redelivering the event would create the build again
+			name: "too slow after a build",
+			handler: func(c *gin.Context) {
+				<-c.Request.Context().Done()
+				c.Header("X-Test", "kept")
+				completeResponse(c, []*brigade.Build{{ID: "build-1"}})
+			},
+			expectedStatus: http.StatusOK,
+			expectedHeader: "kept",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(RequestTimeout(50 * time.Millisecond))
+			router.POST("/events/github", tt.handler)
+
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "/events/github", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			router.ServeHTTP(w, r)
+
+			if time.Since(start) > time.Second {
+				t.Errorf("expected the request to be cut short, took %s", time.Since(start))
+			}
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d\n%s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("X-Test"); got != tt.expectedHeader {
+				t.Errorf("expected header %q, got %q", tt.expectedHeader, got)
+			}
+			var res struct {
+				Status string
+				Code   ErrorCode
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("failed to decode response %q: %s", w.Body.String(), err)
+			}
+			if res.Code != tt.expectedCode {
+				t.Errorf("expected code %q, got %q", tt.expectedCode, res.Code)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_timedOutBuilds(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+
+	payload := mustReadFile(t, "testdata/github-push-payload.json")
+	router := gin.New()
+	router.Use(RequestTimeout(time.Nanosecond))
+	router.POST("/events/github", func(c *gin.Context) {
+		<-c.Request.Context().Done()
+		s.Handle(c)
+	})
+
+	w := httptest.NewRecorder()
+	r, err := webhooktest.NewSignedRequest("push", "asdf", payload)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d\n%s", http.StatusServiceUnavailable, w.Code, w.Body.String())
+	}
+	if len(store.builds) != 0 {
+		t.Errorf("expected no builds once the request timed out, got %d", len(store.builds))
+	}
+}
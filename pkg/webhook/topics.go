@@ -0,0 +1,113 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v32/github"
+
+	ghlib "github.com/brigadecore/brigade-github-app/pkg/github"
+)
+
+// repoTopics returns the GitHub topics of the repository event belongs to.
+//
+// The topics are taken from the event payload when GitHub includes them, and
+// are otherwise looked up via the GitHub API as the app installation. Either
+// way they are cached per repo. If they cannot be determined, nil is returned.
+func (s *githubHook) repoTopics(ctx context.Context, event interface{}, proj *brigade.Project) []string {
+	var name string
+	switch e := event.(type) {
+	case *github.PushEvent:
+		// Push events have a repository type of their own, without topics
+		name = e.GetRepo().GetFullName()
+	case repoEvent:
+		repo := e.GetRepo()
+		name = repo.GetFullName()
+		if repo != nil && repo.Topics != nil {
+			s.topics.set(name, repo.Topics)
+			return repo.Topics
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	if topics, ok := s.topics.get(name); ok {
+		return topics
+	}
+	topics, err := s.fetchTopics(ctx, name, getInstallationID(event), proj)
+	if err != nil {
+		log.Printf("Failed to determine topics of %q: %s", name, err)
+		return nil
+	}
+	s.topics.set(name, topics)
+	return topics
+}
+
+// fetchTopics retrieves the topics of the repo from the GitHub API.
+func (s *githubHook) fetchTopics(ctx context.Context, repo string, instID int64, proj *brigade.Project) ([]string, error) {
+	if s.opts.AppID == 0 || instID == 0 {
+		return nil, errors.New("no app installation to authenticate as")
+	}
+	owner, name, err := ghlib.SplitRepoName(repo)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.appClient(ctx, proj, int64(s.opts.AppID), instID)
+	if err != nil {
+		return nil, err
+	}
+	topics, _, err := client.Repositories.ListAllTopics(ctx, owner, name)
+	if err != nil {
+		return nil, err
+	}
+	if topics == nil {
+		topics = []string{}
+	}
+	return topics, nil
+}
+
+// topicTypes returns the topic-suffixed event types, eventType:topic, emitted
+// for each of topics. Topics named like the event's action are skipped, since
+// eventType:action is already emitted for them.
+func topicTypes(eventType, action string, topics []string) []string {
+	types := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if topic != action {
+			types = append(types, eventType+":"+topic)
+		}
+	}
+	return types
+}
+
+// topicCache is a concurrency-safe map of repo names to their topics. A nil
+// *topicCache caches nothing.
+type topicCache struct {
+	mu     sync.RWMutex
+	topics map[string][]string
+}
+
+func newTopicCache() *topicCache {
+	return &topicCache{topics: map[string][]string{}}
+}
+
+func (t *topicCache) get(repo string) ([]string, bool) {
+	if t == nil {
+		return nil, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	topics, ok := t.topics[repo]
+	return topics, ok
+}
+
+func (t *topicCache) set(repo string, topics []string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.topics[repo] = topics
+}
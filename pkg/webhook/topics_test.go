@@ -0,0 +1,176 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v32/github"
+
+	ghlib "github.com/brigadecore/brigade-github-app/pkg/github"
+)
+
+func TestGithubHandler_repoTopics(t *testing.T) {
+	var lookups int
+	srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+		"GET /repos/baxterthehacker/public-repo/topics": func(w http.ResponseWriter, r *http.Request) {
+			lookups++
+			w.Write([]byte(`{"names":["team-payments","go"]}`))
+		},
+	})
+
+	payload, err := ioutil.ReadFile("testdata/github-pull_request-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+	event, err := github.ParseWebHook("pull_request", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event.(*github.PullRequestEvent).Repo.Topics = []string{"opened", "team-web"}
+	withTopics, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push, err := github.ParseWebHook("push", mustReadFile(t, "testdata/github-push-payload.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	push.(*github.PushEvent).Installation = &github.Installation{ID: github.Int64(234)}
+	pushPayload, err := json.Marshal(push)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		event           string
+		payload         []byte
+		repoTopics      bool
+		emitTopics      bool
+		expectedTypes   []string
+		expectedTopics  []string
+		expectedLookups int
+	}{
+		{
+			name:          "disabled",
+			payload:       payload,
+			expectedTypes: []string{"pull_request", "pull_request:opened"},
+		},
+		{
+			name:            "payload only",
+			payload:         payload,
+			repoTopics:      true,
+			expectedTypes:   []string{"pull_request", "pull_request:opened"},
+			expectedTopics:  []string{"team-payments", "go"},
+			expectedLookups: 1,
+		},
+		{
+			name:            "topic events",
+			payload:         payload,
+			emitTopics:      true,
+			expectedTypes:   []string{"pull_request", "pull_request:opened", "pull_request:team-payments", "pull_request:go"},
+			expectedTopics:  []string{"team-payments", "go"},
+			expectedLookups: 1,
+		},
+		{
+			// A topic named like the action doesn't emit a second build
+			name:           "topics in delivery",
+			payload:        withTopics,
+			emitTopics:     true,
+			expectedTypes:  []string{"pull_request", "pull_request:opened", "pull_request:team-web"},
+			expectedTopics: []string{"opened", "team-web"},
+		},
+		{
+			// Push events never include topics
+			name:            "push",
+			event:           "push",
+			payload:         pushPayload,
+			emitTopics:      true,
+			expectedTypes:   []string{"push", "push:team-payments", "push:go"},
+			expectedTopics:  []string{"team-payments", "go"},
+			expectedLookups: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookups = 0
+			store := newTestStore()
+			store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+			s := newTestGithubHandler(store, t)
+			s.key = newTestKey(t)
+			s.opts.AppID = 12345
+			s.opts.RepoTopics = tt.repoTopics
+			s.opts.EmitTopicEvents = tt.emitTopics
+			s.topics = newTopicCache()
+
+			// The second delivery is served from the cache
+			for i := 0; i < 2; i++ {
+				store.builds = nil
+				eventType := tt.event
+				if eventType == "" {
+					eventType = "pull_request"
+				}
+				w := serveTestEvent(t, s, eventType, "asdf", tt.payload)
+				if w.Code != http.StatusOK {
+					t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
+				}
+			}
+			if lookups != tt.expectedLookups {
+				t.Errorf("expected %d topic lookups, got %d", tt.expectedLookups, lookups)
+			}
+
+			var types []string
+			for _, b := range store.builds {
+				types = append(types, b.Type)
+				var pl struct {
+					Gateway Gateway `json:"gateway"`
+				}
+				if err := json.Unmarshal(b.Payload, &pl); err != nil {
+					t.Fatalf("failed to decode payload: %s", err)
+				}
+				if !reflect.DeepEqual(pl.Gateway.Topics, tt.expectedTopics) {
+					t.Errorf("%s: expected topics %v, got %v", b.Type, tt.expectedTopics, pl.Gateway.Topics)
+				}
+			}
+			if !reflect.DeepEqual(types, tt.expectedTypes) {
+				t.Errorf("expected builds %v, got %v", tt.expectedTypes, types)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_clientOptions(t *testing.T) {
+	done := make(chan struct{})
+	srv := newTestGithubServer(t, map[string]http.HandlerFunc{
+		"GET /repos/baxterthehacker/public-repo/topics": func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+			}
+		},
+	})
+	// Release the handler before the server waits for it to return
+	defer close(done)
+
+	store := newTestStore()
+	store.proj.Github = brigade.Github{BaseURL: srv.URL, UploadURL: srv.URL}
+	s := newTestGithubHandler(store, t)
+	s.key = newTestKey(t)
+	s.opts.AppID = 12345
+	s.opts.ClientOptions = []ghlib.ClientOption{ghlib.WithTimeout(50 * time.Millisecond)}
+
+	start := time.Now()
+	if _, err := s.fetchTopics(context.Background(), "baxterthehacker/public-repo", 777777, store.proj); err == nil {
+		t.Fatal("expected the lookup to time out")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expected the lookup to be cut short, took %s", time.Since(start))
+	}
+}
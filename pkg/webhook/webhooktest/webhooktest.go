@@ -0,0 +1,31 @@
+// Package webhooktest provides utilities for testing GitHub webhook handlers.
+package webhooktest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+)
+
+// NewSignedRequest returns a request delivering body as a GitHub webhook of
+// the given event type to /events/github, signed with secret the way GitHub
+// signs deliveries.
+func NewSignedRequest(eventType, secret string, body []byte) (*http.Request, error) {
+	r, err := http.NewRequest("POST", "/events/github", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("X-GitHub-Event", eventType)
+	r.Header.Set("X-Hub-Signature", Signature(secret, body))
+	return r, nil
+}
+
+// Signature returns the X-Hub-Signature header GitHub sends for body when the
+// webhook's secret is secret.
+func Signature(secret string, body []byte) string {
+	digest := hmac.New(sha1.New, []byte(secret))
+	digest.Write(body)
+	return fmt.Sprintf("sha1=%x", digest.Sum(nil))
+}
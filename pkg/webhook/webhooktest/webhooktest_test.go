@@ -0,0 +1,33 @@
+package webhooktest
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestNewSignedRequest(t *testing.T) {
+	body := []byte(`{"zen":"Keep it logically awesome."}`)
+	r, err := NewSignedRequest("ping", "asdf", body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if r.Method != "POST" {
+		t.Errorf("expected method POST, got %s", r.Method)
+	}
+	if got := r.Header.Get("X-GitHub-Event"); got != "ping" {
+		t.Errorf("expected event ping, got %q", got)
+	}
+	// Computed with: echo -n "$body" | openssl dgst -sha1 -hmac asdf
+	expected := "sha1=a0ad2bc59600a1910aca3fbe6daac55334df7efe"
+	if got := r.Header.Get("X-Hub-Signature"); got != expected {
+		t.Errorf("expected signature %q, got %q", expected, got)
+	}
+	sent, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %s", err)
+	}
+	if string(sent) != string(body) {
+		t.Errorf("expected body %s, got %s", body, sent)
+	}
+}